@@ -0,0 +1,239 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ifIMust/srsr/message"
+)
+
+const (
+	// Each request of WaitFor waits this long at the server.
+	waitPerRequest = 30 * time.Second
+	// WaitFor pauses this long before retrying a failed request,
+	// and starts a new request at most this often.
+	waitRetry = time.Second
+)
+
+// waitClient has no timeout of its own, as its requests wait at the server.
+// Their contexts end them instead.
+var waitClient = &http.Client{}
+
+// API makes individual requests to a registry server. It suits tools that
+// manage registrations themselves; services should use ServiceRegistryClient,
+// which sends heartbeats for them.
+type API struct {
+	serverAddress string
+	adminToken    string
+}
+
+// NewAPI returns an API for serverAddress. adminToken is only needed
+// for admin requests, and may be empty.
+func NewAPI(serverAddress string, adminToken string) *API {
+	return &API{serverAddress: serverAddress, adminToken: adminToken}
+}
+
+// Register registers a service once. Unless heartbeats are sent for the
+// returned ID, the registration expires after the server's timeout.
+func (a *API) Register(request message.RegisterRequest) (string, error) {
+	response := message.RegisterResponse{}
+	err := post(a.serverAddress+"/register", request, &response)
+	if err != nil {
+		return "", err
+	}
+	if !response.Success {
+		return "", errors.New("server reported failure for " + request.Name)
+	}
+	return response.ID, nil
+}
+
+// RegisterBatch registers several services at once. It returns a result for each,
+// in the same order; a result's Success is false if that registration failed.
+func (a *API) RegisterBatch(requests []message.RegisterRequest) ([]message.RegisterResponse, error) {
+	response := message.RegisterBatchResponse{}
+	err := post(a.serverAddress+"/register/batch", message.RegisterBatchRequest{Registrations: requests}, &response)
+	return response.Results, err
+}
+
+// Deregister reports whether the server knew the ID.
+func (a *API) Deregister(id string) (bool, error) {
+	response := message.DeregisterResponse{}
+	err := post(a.serverAddress+"/deregister", message.DeregisterRequest{ID: id}, &response)
+	return response.Success, err
+}
+
+// Heartbeat reports whether the server knew the ID. load may be nil.
+func (a *API) Heartbeat(id string, load *message.Load) (bool, error) {
+	response := message.HeartbeatResponse{}
+	err := post(a.serverAddress+"/heartbeat", message.HeartbeatRequest{ID: id, Load: load}, &response)
+	return response.Success, err
+}
+
+// HeartbeatBatch sends several heartbeats at once,
+// and reports whether the server knew each ID, in the same order.
+func (a *API) HeartbeatBatch(requests []message.HeartbeatRequest) ([]bool, error) {
+	response := message.HeartbeatBatchResponse{}
+	err := post(a.serverAddress+"/heartbeat/batch", message.HeartbeatBatchRequest{Heartbeats: requests}, &response)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]bool, len(response.Results))
+	for i, r := range response.Results {
+		known[i] = r.Success
+	}
+	return known, nil
+}
+
+// Lookup returns an address for the named service, and whether one was found.
+func (a *API) Lookup(name string) (string, bool, error) {
+	response := message.LookupResponse{}
+	err := post(a.serverAddress+"/lookup", message.LookupRequest{Name: name}, &response)
+	return response.Address, response.Success, err
+}
+
+// WaitFor returns an address for the named service, waiting until one registers
+// or ctx is done. Failed requests are retried, so it may be called before the server is up.
+// If ctx ends first, the error is ctx.Err(), joined with the last failure, if any.
+func (a *API) WaitFor(ctx context.Context, name string) (string, error) {
+	response, err := a.WaitForWith(ctx, message.LookupRequest{Name: name})
+	return response.Address, err
+}
+
+// WaitForWith waits as WaitFor does, for a lookup as request asks, returning the whole response.
+func (a *API) WaitForWith(ctx context.Context, request message.LookupRequest) (message.LookupResponse, error) {
+	url := a.serverAddress + "/lookup?wait=" + waitPerRequest.String()
+	var failure error
+	for {
+		started := time.Now()
+		response := message.LookupResponse{}
+		requestCtx, cancel := context.WithTimeout(ctx, waitPerRequest+requestTimeout)
+		err := sendWith(requestCtx, waitClient, http.MethodPost, url, "", request, &response)
+		cancel()
+		if err == nil && response.Success {
+			return response, nil
+		}
+
+		pause := waitRetry
+		if err == nil {
+			// The server found nothing. It should have waited, but an old server, or a proxy
+			// that drops the query, answers at once, so rounds are at least waitRetry apart.
+			pause -= time.Since(started)
+		} else if ctx.Err() == nil {
+			failure = err
+		}
+		if ctx.Err() != nil {
+			return message.LookupResponse{}, errors.Join(ctx.Err(), failure)
+		}
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return message.LookupResponse{}, errors.Join(ctx.Err(), failure)
+		}
+	}
+}
+
+// LookupWith looks up as request asks, returning the whole response.
+func (a *API) LookupWith(request message.LookupRequest) (message.LookupResponse, error) {
+	response := message.LookupResponse{}
+	err := post(a.serverAddress+"/lookup", request, &response)
+	return response, err
+}
+
+// LookupNear returns an address for the named service, preferring instances in zone,
+// and whether one was found. region is used if the service falls back to other zones.
+func (a *API) LookupNear(name string, zone string, region string) (string, bool, error) {
+	response := message.LookupResponse{}
+	err := post(a.serverAddress+"/lookup", message.LookupRequest{Name: name, Zone: zone, Region: region}, &response)
+	return response.Address, response.Success, err
+}
+
+// LookupComponents returns the components of an address for the named service,
+// and whether one was found.
+func (a *API) LookupComponents(name string) (message.AddressComponents, bool, error) {
+	response := message.LookupResponse{}
+	err := post(a.serverAddress+"/lookup", message.LookupRequest{Name: name, Components: true}, &response)
+	if err != nil || response.Components == nil {
+		return message.AddressComponents{}, false, err
+	}
+	return *response.Components, response.Success, nil
+}
+
+// Status returns a summary of the server's state.
+func (a *API) Status() (message.StatusResponse, error) {
+	response := message.StatusResponse{}
+	err := send(http.MethodGet, a.serverAddress+"/status", "", nil, &response)
+	return response, err
+}
+
+// Snapshot returns the state of the registry. It requires the admin token.
+func (a *API) Snapshot() (message.Snapshot, error) {
+	response := message.Snapshot{}
+	err := send(http.MethodGet, a.serverAddress+"/admin/snapshot", a.adminToken, nil, &response)
+	return response, err
+}
+
+// RestoreOptions control how Restore restores a snapshot.
+type RestoreOptions struct {
+	// Mode is "merge" (if empty) or "replace".
+	Mode string
+	// ResetDeadlines treats each instance as if it had just sent a heartbeat.
+	ResetDeadlines bool
+	// Timeout sets the server's timeout to the snapshot's.
+	Timeout bool
+}
+
+// Restore restores a snapshot, returning the number of instances restored.
+// It requires the admin token.
+func (a *API) Restore(snapshot message.Snapshot, opts RestoreOptions) (int, error) {
+	if opts.Mode == "" {
+		opts.Mode = "merge"
+	}
+	query := url.Values{
+		"mode":            {opts.Mode},
+		"reset_deadlines": {strconv.FormatBool(opts.ResetDeadlines)},
+		"restore_timeout": {strconv.FormatBool(opts.Timeout)},
+	}
+	response := message.RestoreResponse{}
+	err := send(http.MethodPost, a.serverAddress+"/admin/snapshot?"+query.Encode(), a.adminToken, snapshot, &response)
+	if err == nil && !response.Success {
+		err = errors.New("restore failed: " + response.Error)
+	}
+	return response.Restored, err
+}
+
+// Traffic lists the traffic policies. It requires the admin token.
+func (a *API) Traffic() ([]message.TrafficInfo, error) {
+	response := message.TrafficPoliciesResponse{}
+	err := send(http.MethodGet, a.serverAddress+"/admin/api/traffic", a.adminToken, nil, &response)
+	return response.Policies, err
+}
+
+// SetTraffic sets, or without a tag removes, the traffic policy of a service.
+// It requires the admin token.
+func (a *API) SetTraffic(request message.TrafficRequest) error {
+	response := message.TrafficResponse{}
+	err := send(http.MethodPost, a.serverAddress+"/admin/api/traffic", a.adminToken, request, &response)
+	if err == nil && !response.Success {
+		err = errors.New("traffic policy refused: " + response.Error)
+	}
+	return err
+}
+
+// DeadLetters lists the events that could not be delivered to webhooks.
+// It requires the admin token.
+func (a *API) DeadLetters() ([]message.DeadLetter, error) {
+	response := message.DeadLettersResponse{}
+	err := send(http.MethodGet, a.serverAddress+"/admin/api/webhooks/dead-letters", a.adminToken, nil, &response)
+	return response.DeadLetters, err
+}
+
+// Instances lists every registered instance. It requires the admin token.
+func (a *API) Instances() ([]message.InstanceInfo, error) {
+	response := message.InstancesResponse{}
+	err := send(http.MethodGet, a.serverAddress+"/admin/api/instances", a.adminToken, nil, &response)
+	return response.Instances, err
+}
@@ -0,0 +1,197 @@
+package client_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/ifIMust/srsr/client"
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("API", func() {
+	const token = "sekrit"
+
+	var reg registry.Registry
+	var srv *httptest.Server
+	var api *client.API
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		srv = httptest.NewServer(server.SetupRouter(reg, server.WithAdminToken(token)))
+		api = client.NewAPI(srv.URL, token)
+	})
+	AfterEach(func() {
+		srv.Close()
+	})
+
+	It("registers, heartbeats, looks up and deregisters", func() {
+		id, err := api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5000"})
+		Expect(err).NotTo(HaveOccurred())
+
+		ok, err := api.Heartbeat(id, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		address, ok, err := api.Lookup("dungen")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(address).To(Equal("http://localhost:5000"))
+
+		ok, err = api.Deregister(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		_, ok, err = api.Lookup("dungen")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+	It("looks up instances near a zone", func() {
+		api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5000", Zone: "a"})
+		api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5001", Zone: "b"})
+		for i := 0; i < 10; i++ {
+			address, ok, err := api.LookupNear("dungen", "b", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(address).To(Equal("http://localhost:5001"))
+		}
+	})
+	It("looks up address components", func() {
+		api.Register(message.RegisterRequest{Name: "dungen", Address: "grpc://[::1]", Port: "9000"})
+		c, ok, err := api.LookupComponents("dungen")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(c).To(Equal(message.AddressComponents{Scheme: "grpc", Host: "::1", Port: "9000"}))
+	})
+	It("waits for a service to register", func() {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5000"})
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		address, err := api.WaitFor(ctx, "dungen")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(address).To(Equal("http://localhost:5000"))
+	})
+	It("stops waiting when the context is done", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := api.WaitFor(ctx, "dungen")
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	})
+	It("waits between lookups if the server doesn't wait", func() {
+		var lookups atomic.Int32
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lookups.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"success": false}`))
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		_, err := api.WaitFor(ctx, "dungen")
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(lookups.Load()).To(BeNumerically("<=", 2))
+	})
+	It("waits for a service to register near a zone", func() {
+		api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5000", Zone: "a"})
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5001", Zone: "b"})
+		}()
+		reg.SetFallback("dungen", registry.FallbackNone)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		response, err := api.WaitForWith(ctx, message.LookupRequest{Name: "dungen", Zone: "b"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.Address).To(Equal("http://localhost:5001"))
+		Expect(response.Zone).To(Equal("b"))
+	})
+	It("reports why it couldn't reach the server", func() {
+		srv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := api.WaitFor(ctx, "dungen")
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("connect"))
+	})
+	It("reports unknown IDs", func() {
+		ok, err := api.Heartbeat("nope", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+	It("registers and heartbeats in batches", func() {
+		results, err := api.RegisterBatch([]message.RegisterRequest{
+			{Name: "dungen", Address: "http://localhost:5000"},
+			{Name: "dungen", Address: "nope"},
+			{Name: "flard", Address: "http://localhost:5001"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(3))
+		Expect(results[0].Success).To(BeTrue())
+		Expect(results[1].Success).To(BeFalse())
+		Expect(results[2].Success).To(BeTrue())
+
+		known, err := api.HeartbeatBatch([]message.HeartbeatRequest{
+			{ID: results[0].ID},
+			{ID: "nope"},
+			{ID: results[2].ID, Load: &message.Load{InFlight: 1}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(known).To(Equal([]bool{true, false, true}))
+	})
+	It("exports and restores snapshots", func() {
+		id, _ := api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5000"})
+		snapshot, err := api.Snapshot()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snapshot.Instances).To(HaveLen(1))
+
+		api.Deregister(id)
+		restored, err := api.Restore(snapshot, client.RestoreOptions{ResetDeadlines: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored).To(Equal(1))
+		Expect(reg.Lookup("dungen")).To(Equal("http://localhost:5000"))
+	})
+	It("explains failed restores", func() {
+		_, err := api.Restore(message.Snapshot{Version: 99}, client.RestoreOptions{})
+		Expect(err).To(MatchError(ContainSubstring("version")))
+	})
+	It("reports status", func() {
+		api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5000"})
+		api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5001"})
+		status, err := api.Status()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Services).To(Equal(1))
+		Expect(status.Instances).To(Equal(2))
+	})
+	It("sets and lists traffic policies", func() {
+		err := api.SetTraffic(message.TrafficRequest{Name: "dungen", Tag: "version", Weights: map[string]int{"1": 9, "2": 1}})
+		Expect(err).NotTo(HaveOccurred())
+		policies, err := api.Traffic()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policies).To(HaveLen(1))
+		Expect(policies[0].Weights).To(Equal(map[string]int{"1": 9, "2": 1}))
+
+		err = api.SetTraffic(message.TrafficRequest{Name: "dungen", Tag: "version"})
+		Expect(err).To(MatchError(ContainSubstring("positive")))
+	})
+	It("lists instances with the admin token", func() {
+		api.Register(message.RegisterRequest{Name: "dungen", Address: "http://localhost:5000"})
+		instances, err := api.Instances()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instances).To(HaveLen(1))
+		Expect(instances[0].Name).To(Equal("dungen"))
+	})
+	It("fails to list instances without the admin token", func() {
+		_, err := client.NewAPI(srv.URL, "").Instances()
+		Expect(err).To(HaveOccurred())
+	})
+})
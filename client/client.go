@@ -2,10 +2,16 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
+
 	"github.com/ifIMust/srsr/message"
 )
 
@@ -14,112 +20,471 @@ const contentType = "application/json"
 // Default service timeout is expected to be 30 seconds.
 const heartbeatInterval = 20 * time.Second
 
+// Requests to a server that is down should fail over, rather than hang.
+const requestTimeout = 5 * time.Second
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
 type ServiceRegistryClient interface {
+	// Register the client with the server, and begin sending heartbeats.
 	Register() error
+
+	// Deregister stops heartbeats and removes the client from the server.
+	// It does nothing if the client is not registered.
+	// The client may Register again afterwards.
 	Deregister()
+
+	// Close deregisters the client if needed, and permanently stops it.
+	// It is safe to call more than once.
+	Close() error
+
+	// Done is closed once the client has been closed.
+	Done() <-chan struct{}
+}
+
+// endpoint is one named address registered on behalf of the process.
+type endpoint struct {
+	name    string
+	address string
+	port    string
+}
+
+// locality is where the process runs.
+type locality struct {
+	zone   string
+	region string
+}
+
+type clientState int
+
+const (
+	stateIdle clientState = iota
+	stateRegistered
+	stateClosed
+)
+
+// session holds the IDs of a registration, keyed by server address.
+// While registered, it is owned by the heartbeat goroutine.
+type session struct {
+	ids map[string][]string
 }
 
 type client struct {
-	serverAddress string
-	
-	clientName string
-	clientAddress string
-	
-	clientID string
-	isRegistered bool
-	cancel chan int
+	servers     *serverList
+	registerAll bool
+
+	// endpoints[0] is the primary endpoint, using the client name.
+	endpoints     []endpoint
+	detectAddress bool
+	instanceID    string
+	locality      locality
+
+	// load, if set, is called for each round of heartbeats.
+	load func() message.Load
+
+	heartbeatInterval time.Duration
+
+	// mutex guards the fields below, and serializes Register, Deregister and Close.
+	mutex   sync.Mutex
+	state   clientState
+	session *session
+
+	// stop is closed to end the heartbeat goroutine, which closes stopped on exit.
+	stop    chan struct{}
+	stopped chan struct{}
+
+	done chan struct{}
 }
 
-func NewServiceRegistryClient(clientName string, clientAddress string, serverAddress string) ServiceRegistryClient {
-	return &client{
-		serverAddress: serverAddress,
-		clientName: clientName,
-		clientAddress: clientAddress,
-		cancel: make(chan int),
+// Option configures optional client behaviour.
+type Option func(*client)
+
+// WithPort sets the port of the primary endpoint.
+// If the client address is empty, the server deduces the address from the request.
+func WithPort(port string) Option {
+	return func(c *client) {
+		c.endpoints[0].port = port
 	}
 }
 
-func (c *client) sendHeartbeat() {
-	request := message.HeartbeatRequest{
-		ID: c.clientID,
+// WithDetectedAddress fills in any empty endpoint address with the IP of the
+// interface used to reach the server. Detection happens on each Register.
+func WithDetectedAddress() Option {
+	return func(c *client) {
+		c.detectAddress = true
+	}
+}
+
+// WithEndpoint registers an additional endpoint for the same process,
+// under the service name EndpointName(clientName, name).
+// Address and port behave as they do for the primary endpoint.
+func WithEndpoint(name string, address string, port string) Option {
+	return func(c *client) {
+		c.endpoints = append(c.endpoints, endpoint{
+			name:    EndpointName(c.endpoints[0].name, name),
+			address: address,
+			port:    port,
+		})
+	}
+}
+
+// WithInstanceID registers with a stable, client-chosen ID, such as a pod or host name,
+// instead of a random one. Registering again with the same ID updates the existing
+// registration, so a restarted service keeps its identity.
+func WithInstanceID(id string) Option {
+	return func(c *client) {
+		c.instanceID = id
+	}
+}
+
+// WithLocality registers every endpoint in a zone and region, so that callers
+// in the same zone are sent to it first. Either may be empty.
+func WithLocality(zone string, region string) Option {
+	return func(c *client) {
+		c.locality = locality{zone: zone, region: region}
+	}
+}
+
+// WithLoad reports the service's load with each heartbeat, as returned by load,
+// so that least-loaded lookups can favour less busy instances.
+func WithLoad(load func() message.Load) Option {
+	return func(c *client) {
+		c.load = load
 	}
+}
 
-	buf := new(bytes.Buffer)
-	err := json.NewEncoder(buf).Encode(request)
+// WithHeartbeatInterval overrides the default heartbeat interval.
+// It should be comfortably shorter than the server's timeout.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(c *client) {
+		c.heartbeatInterval = interval
+	}
+}
+
+// WithServers adds more registry servers. If a server cannot be reached,
+// the client fails over to the next, preferring servers that have recently worked.
+func WithServers(serverAddresses ...string) Option {
+	return func(c *client) {
+		for _, address := range serverAddresses {
+			c.servers.servers = append(c.servers.servers, &serverHealth{address: address})
+		}
+	}
+}
+
+// WithRegisterAll registers with every server instead of only one,
+// so discovery continues if any single server goes down.
+// Register succeeds if at least one server accepts the registration.
+func WithRegisterAll() Option {
+	return func(c *client) {
+		c.registerAll = true
+	}
+}
+
+// EndpointName returns the service name used to register and look up
+// a named endpoint, such as "grpc" or "metrics", of a service.
+func EndpointName(serviceName string, endpointName string) string {
+	return serviceName + "." + endpointName
+}
+
+// NewServiceRegistryClient creates a client for the service clientName.
+// clientAddress may be left empty if WithPort or WithDetectedAddress is used.
+func NewServiceRegistryClient(clientName string, clientAddress string, serverAddress string, opts ...Option) ServiceRegistryClient {
+	c := &client{
+		servers:           newServerList([]string{serverAddress}),
+		endpoints:         []endpoint{{name: clientName, address: clientAddress}},
+		heartbeatInterval: heartbeatInterval,
+		done:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// outboundAddress returns an http URL for the local IP used to reach serverAddress.
+// No packets are sent; dialing UDP only selects a route.
+func outboundAddress(serverAddress string) (string, error) {
+	u, err := url.Parse(serverAddress)
 	if err != nil {
-		return
+		return "", err
 	}
-	
-	resp, err := http.Post(c.serverAddress + "/heartbeat", contentType, buf)
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := net.Dial("udp", host)
 	if err != nil {
-		return
+		return "", err
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	if ip.To4() == nil {
+		return "http://[" + ip.String() + "]", nil
 	}
-	defer resp.Body.Close()	
+	return "http://" + ip.String(), nil
 }
 
-func (c *client) Register() error {
-	if c.isRegistered {
-		return errors.New("Register- already registered!")
-	}
-	
-	request := message.RegisterRequest{
-		Name: c.clientName,
-		Address: c.clientAddress,
+func post(url string, request any, response any) error {
+	return send(http.MethodPost, url, "", request, response)
+}
+
+// send makes a request with an optional JSON body and bearer token,
+// decoding the JSON response if response is not nil.
+func send(method string, url string, token string, request any, response any) error {
+	return sendWith(context.Background(), httpClient, method, url, token, request, response)
+}
+
+// sendWith is send, using hc and ending when ctx is done.
+func sendWith(ctx context.Context, hc *http.Client, method string, url string, token string, request any, response any) error {
+	var body io.Reader
+	if request != nil {
+		buf := new(bytes.Buffer)
+		err := json.NewEncoder(buf).Encode(request)
+		if err != nil {
+			return err
+		}
+		body = buf
 	}
 
-	buf := new(bytes.Buffer)
-	err := json.NewEncoder(buf).Encode(request)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return err
 	}
+	if request != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	resp, err := http.Post(c.serverAddress + "/register", contentType, buf)
+	resp, err := hc.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return errors.New("Register- bad status: " + resp.Status)
+		// Error responses usually explain themselves.
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+			return errors.New("bad status: " + resp.Status + ": " + body.Error)
+		}
+		return errors.New("bad status: " + resp.Status)
+	}
+	if response == nil {
+		return nil
 	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
 
-	response := message.RegisterResponse{}
-	err = json.NewDecoder(resp.Body).Decode(&response)
+func sendHeartbeat(server string, id string, load *message.Load) error {
+	request := message.HeartbeatRequest{
+		ID:   id,
+		Load: load,
+	}
+	response := message.HeartbeatResponse{}
+	err := post(server+"/heartbeat", request, &response)
 	if err != nil {
 		return err
 	}
-	c.clientID = response.ID
-	c.isRegistered = true
+	if !response.Success {
+		return errors.New("heartbeat rejected for ID " + id)
+	}
+	return nil
+}
 
-	go func() {
-		for c.isRegistered {
-			select {
-			case <-time.After(heartbeatInterval):
-				c.sendHeartbeat()
-			case <-c.cancel:
-				c.isRegistered = false
+func sendDeregister(server string, ids []string) error {
+	var errs []error
+	for _, id := range ids {
+		request := message.DeregisterRequest{
+			ID: id,
+		}
+		errs = append(errs, post(server+"/deregister", request, nil))
+	}
+	return errors.Join(errs...)
+}
+
+func registerEndpoint(server string, e endpoint, detected string, instanceID string, l locality) (string, error) {
+	request := message.RegisterRequest{
+		Name:    e.name,
+		Address: e.address,
+		Port:    e.port,
+		ID:      instanceID,
+		Zone:    l.zone,
+		Region:  l.region,
+	}
+	if request.Address == "" {
+		request.Address = detected
+	}
+	response := message.RegisterResponse{}
+	err := post(server+"/register", request, &response)
+	if err != nil {
+		return "", err
+	}
+	if !response.Success {
+		return "", errors.New("server reported failure for " + e.name)
+	}
+	return response.ID, nil
+}
+
+// registerWith registers every endpoint with one server,
+// and records the outcome in the server's health.
+func (c *client) registerWith(server string) ([]string, error) {
+	ids, err := c.registerEndpoints(server)
+	c.servers.report(server, err)
+	return ids, err
+}
+
+func (c *client) registerEndpoints(server string) ([]string, error) {
+	var detected string
+	if c.detectAddress {
+		var err error
+		detected, err = outboundAddress(server)
+		if err != nil {
+			return nil, errors.New("address detection failed: " + err.Error())
+		}
+	}
+
+	ids := make([]string, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		id, err := registerEndpoint(server, e, detected, c.instanceID, c.locality)
+		if err != nil {
+			// Don't leave a partial registration behind.
+			sendDeregister(server, ids)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// fill registers with servers missing from the session: every server
+// when registering with all, otherwise the healthiest one that works.
+func (c *client) fill(s *session) error {
+	var errs []error
+	for _, server := range c.servers.ordered() {
+		if _, ok := s.ids[server]; ok {
+			continue
+		}
+		if !c.registerAll && len(s.ids) > 0 {
+			break
+		}
+		ids, err := c.registerWith(server)
+		if err != nil {
+			errs = append(errs, errors.New(server+": "+err.Error()))
+			continue
+		}
+		s.ids[server] = ids
+	}
+	if len(s.ids) == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// refresh sends heartbeats for the session. A server that can't be reached,
+// or that no longer knows an ID, is dropped and replaced.
+func (c *client) refresh(s *session) {
+	var load *message.Load
+	if c.load != nil {
+		l := c.load()
+		load = &l
+	}
+	for server, ids := range s.ids {
+		var err error
+		for _, id := range ids {
+			err = sendHeartbeat(server, id, load)
+			if err != nil {
+				break
 			}
 		}
-	}()
-	
-	return err
+		c.servers.report(server, err)
+		if err != nil {
+			delete(s.ids, server)
+			// If the server is still up, clear out whatever it still holds before registering again.
+			sendDeregister(server, ids)
+		}
+	}
+	c.fill(s)
 }
 
-func (c *client) Deregister() {
-	c.cancel <- 1
-	
-	request := message.DeregisterRequest{
-		ID: c.clientID,
+// heartbeat runs until stop is closed. It never needs the client mutex,
+// because the session is handed back only after stopped is closed.
+func (c *client) heartbeat(s *session, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refresh(s)
+		case <-stop:
+			return
+		}
 	}
+}
 
-	buf := new(bytes.Buffer)
-	err := json.NewEncoder(buf).Encode(request)
-	if err != nil {
-		return
+func (c *client) Register() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch c.state {
+	case stateRegistered:
+		return errors.New("Register- already registered!")
+	case stateClosed:
+		return errors.New("Register- client is closed")
 	}
-	
-	resp, err := http.Post(c.serverAddress + "/deregister", contentType, buf)
+
+	s := &session{ids: make(map[string][]string)}
+	err := c.fill(s)
 	if err != nil {
-		return
+		return errors.New("Register- " + err.Error())
 	}
-	defer resp.Body.Close()
+
+	c.session = s
+	c.state = stateRegistered
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go c.heartbeat(c.session, c.stop, c.stopped)
+	return nil
+}
+
+// deregister must be called with the mutex held.
+func (c *client) deregister() error {
+	if c.state != stateRegistered {
+		return nil
+	}
+	close(c.stop)
+	<-c.stopped
+	c.state = stateIdle
+
+	var errs []error
+	for server, ids := range c.session.ids {
+		errs = append(errs, sendDeregister(server, ids))
+	}
+	c.session = nil
+	return errors.Join(errs...)
+}
+
+func (c *client) Deregister() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deregister()
+}
+
+func (c *client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == stateClosed {
+		return nil
+	}
+	err := c.deregister()
+	c.state = stateClosed
+	close(c.done)
+	return err
+}
+
+func (c *client) Done() <-chan struct{} {
+	return c.done
 }
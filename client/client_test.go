@@ -0,0 +1,298 @@
+package client_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/ifIMust/srsr/client"
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("Client", func() {
+	var reg registry.Registry
+	var srv *httptest.Server
+	var c client.ServiceRegistryClient
+
+	const name = "flardtech"
+	const address = "http://localhost:4949"
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		srv = httptest.NewServer(server.SetupRouter(reg))
+		c = client.NewServiceRegistryClient(name, address, srv.URL)
+	})
+	AfterEach(func() {
+		c.Close()
+		srv.Close()
+	})
+
+	Describe("Register", func() {
+		It("registers with the server", func() {
+			Expect(c.Register()).To(Succeed())
+			Expect(reg.Lookup(name)).To(Equal(address))
+		})
+		It("fails when already registered", func() {
+			Expect(c.Register()).To(Succeed())
+			Expect(c.Register()).NotTo(Succeed())
+		})
+		It("fails after Close", func() {
+			Expect(c.Close()).To(Succeed())
+			Expect(c.Register()).NotTo(Succeed())
+		})
+		It("fails when the server is unreachable", func() {
+			srv.Close()
+			Expect(c.Register()).NotTo(Succeed())
+		})
+		It("may register again after Deregister", func() {
+			Expect(c.Register()).To(Succeed())
+			c.Deregister()
+			Expect(c.Register()).To(Succeed())
+			Expect(reg.Lookup(name)).To(Equal(address))
+		})
+		It("registers a zone and region", func() {
+			c = client.NewServiceRegistryClient(name, address, srv.URL, client.WithLocality("eu-west-1a", "eu-west-1"))
+			Expect(c.Register()).To(Succeed())
+			instance, _ := reg.LookupInstance(name, nil)
+			Expect(instance.Locality).To(Equal(registry.Locality{Zone: "eu-west-1a", Region: "eu-west-1"}))
+		})
+	})
+
+	Describe("Deregister", func() {
+		It("removes the service from the server", func() {
+			Expect(c.Register()).To(Succeed())
+			c.Deregister()
+			Expect(reg.Lookup(name)).To(BeEmpty())
+		})
+		It("does not block before Register", func(ctx SpecContext) {
+			c.Deregister()
+		}, SpecTimeout(time.Second))
+		It("does not block when called twice", func(ctx SpecContext) {
+			Expect(c.Register()).To(Succeed())
+			c.Deregister()
+			c.Deregister()
+		}, SpecTimeout(time.Second))
+	})
+
+	Describe("Close", func() {
+		It("deregisters the service", func() {
+			Expect(c.Register()).To(Succeed())
+			Expect(c.Close()).To(Succeed())
+			Expect(reg.Lookup(name)).To(BeEmpty())
+		})
+		It("is safe to call more than once", func() {
+			Expect(c.Register()).To(Succeed())
+			Expect(c.Close()).To(Succeed())
+			Expect(c.Close()).To(Succeed())
+		})
+		It("is safe to call concurrently", func() {
+			Expect(c.Register()).To(Succeed())
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.Close()
+				}()
+			}
+			wg.Wait()
+			Expect(reg.Lookup(name)).To(BeEmpty())
+		})
+		It("closes Done", func() {
+			Expect(c.Done()).NotTo(BeClosed())
+			c.Close()
+			Expect(c.Done()).To(BeClosed())
+		})
+	})
+
+	Describe("Heartbeats", func() {
+		BeforeEach(func() {
+			reg.SetTimeout(100 * time.Millisecond)
+			c = client.NewServiceRegistryClient(name, address, srv.URL,
+				client.WithHeartbeatInterval(10*time.Millisecond))
+		})
+		It("keep the service registered", func() {
+			// The timeout allows many heartbeats to be late under load,
+			// and the check outlasts it, so that only heartbeats can be keeping the service.
+			reg.SetTimeout(250 * time.Millisecond)
+			Expect(c.Register()).To(Succeed())
+			Consistently(func() string {
+				return reg.Lookup(name)
+			}, 600*time.Millisecond, 20*time.Millisecond).Should(Equal(address))
+		})
+		It("register again after the server forgets the service", func() {
+			c = client.NewServiceRegistryClient(name, address, srv.URL,
+				client.WithHeartbeatInterval(150*time.Millisecond))
+			Expect(c.Register()).To(Succeed())
+			Eventually(func() string {
+				return reg.Lookup(name)
+			}, time.Second, 5*time.Millisecond).Should(BeEmpty())
+			Eventually(func() string {
+				return reg.Lookup(name)
+			}, time.Second, 5*time.Millisecond).Should(Equal(address))
+		})
+		It("report load", func() {
+			c = client.NewServiceRegistryClient(name, address, srv.URL,
+				client.WithHeartbeatInterval(10*time.Millisecond),
+				client.WithLoad(func() message.Load {
+					return message.Load{InFlight: 3, Capacity: 10}
+				}))
+			Expect(c.Register()).To(Succeed())
+			Eventually(func() registry.Load {
+				return reg.Instances()[0].Load
+			}, time.Second, 10*time.Millisecond).Should(Equal(registry.Load{InFlight: 3, Capacity: 10}))
+		})
+		It("stop after Deregister", func() {
+			Expect(c.Register()).To(Succeed())
+			c.Deregister()
+			Consistently(func() string {
+				return reg.Lookup(name)
+			}, 200*time.Millisecond, 20*time.Millisecond).Should(BeEmpty())
+		})
+	})
+
+	Describe("Addresses", func() {
+		It("registers with port only", func() {
+			c = client.NewServiceRegistryClient(name, "", srv.URL, client.WithPort("4949"))
+			Expect(c.Register()).To(Succeed())
+			Expect(reg.Lookup(name)).To(Equal("http://127.0.0.1:4949"))
+		})
+		It("detects the outbound address", func() {
+			c = client.NewServiceRegistryClient(name, "", srv.URL,
+				client.WithDetectedAddress(), client.WithPort("4949"))
+			Expect(c.Register()).To(Succeed())
+			Expect(reg.Lookup(name)).To(Equal("http://127.0.0.1:4949"))
+		})
+		It("prefers an explicit address over detection", func() {
+			c = client.NewServiceRegistryClient(name, address, srv.URL, client.WithDetectedAddress())
+			Expect(c.Register()).To(Succeed())
+			Expect(reg.Lookup(name)).To(Equal(address))
+		})
+	})
+
+	Describe("Instance ID", func() {
+		BeforeEach(func() {
+			c = client.NewServiceRegistryClient(name, address, srv.URL,
+				client.WithInstanceID("host-1"),
+				client.WithEndpoint("metrics", "", "9090"))
+		})
+		It("registers every endpoint with the chosen ID", func() {
+			Expect(c.Register()).To(Succeed())
+			ids := []string{}
+			for _, instance := range reg.Instances() {
+				ids = append(ids, instance.ID)
+			}
+			Expect(ids).To(ConsistOf(
+				registry.InstanceID(name, "host-1"),
+				registry.InstanceID(client.EndpointName(name, "metrics"), "host-1")))
+		})
+		It("keeps the ID when registering again", func() {
+			Expect(c.Register()).To(Succeed())
+			other := client.NewServiceRegistryClient(name, address, srv.URL, client.WithInstanceID("host-1"))
+			defer other.Close()
+			Expect(other.Register()).To(Succeed())
+			Expect(reg.Instances()).To(HaveLen(2))
+		})
+	})
+
+	Describe("Endpoints", func() {
+		BeforeEach(func() {
+			c = client.NewServiceRegistryClient(name, address, srv.URL,
+				client.WithEndpoint("grpc", "grpc://localhost:5050", ""),
+				client.WithEndpoint("metrics", "", "9090"))
+		})
+		It("registers every endpoint", func() {
+			Expect(c.Register()).To(Succeed())
+			Expect(reg.Lookup(name)).To(Equal(address))
+			Expect(reg.Lookup(client.EndpointName(name, "grpc"))).To(Equal("grpc://localhost:5050"))
+			Expect(reg.Lookup(client.EndpointName(name, "metrics"))).To(Equal("http://127.0.0.1:9090"))
+		})
+		It("deregisters every endpoint", func() {
+			Expect(c.Register()).To(Succeed())
+			Expect(c.Close()).To(Succeed())
+			Expect(reg.Lookup(name)).To(BeEmpty())
+			Expect(reg.Lookup(client.EndpointName(name, "grpc"))).To(BeEmpty())
+			Expect(reg.Lookup(client.EndpointName(name, "metrics"))).To(BeEmpty())
+		})
+		It("rolls back when one endpoint fails", func() {
+			c = client.NewServiceRegistryClient(name, address, srv.URL,
+				client.WithEndpoint("broken", "not a url", ""))
+			Expect(c.Register()).NotTo(Succeed())
+			Expect(reg.Lookup(name)).To(BeEmpty())
+		})
+	})
+
+	Describe("Multiple servers", func() {
+		var otherReg registry.Registry
+		var otherSrv *httptest.Server
+
+		BeforeEach(func() {
+			otherReg = registry.NewServiceRegistry()
+			otherSrv = httptest.NewServer(server.SetupRouter(otherReg))
+		})
+		AfterEach(func() {
+			c.Close()
+			otherSrv.Close()
+		})
+
+		Context("with failover", func() {
+			BeforeEach(func() {
+				c = client.NewServiceRegistryClient(name, address, srv.URL,
+					client.WithServers(otherSrv.URL),
+					client.WithHeartbeatInterval(10*time.Millisecond))
+			})
+			It("registers with the first server only", func() {
+				Expect(c.Register()).To(Succeed())
+				Expect(reg.Lookup(name)).To(Equal(address))
+				Expect(otherReg.Lookup(name)).To(BeEmpty())
+			})
+			It("registers with the next server when the first is down", func() {
+				srv.Close()
+				Expect(c.Register()).To(Succeed())
+				Expect(otherReg.Lookup(name)).To(Equal(address))
+			})
+			It("fails when every server is down", func() {
+				srv.Close()
+				otherSrv.Close()
+				Expect(c.Register()).NotTo(Succeed())
+			})
+			It("moves to the next server when heartbeats fail", func() {
+				Expect(c.Register()).To(Succeed())
+				srv.Close()
+				Eventually(func() string {
+					return otherReg.Lookup(name)
+				}, time.Second, 10*time.Millisecond).Should(Equal(address))
+			})
+		})
+
+		Context("registering with all", func() {
+			BeforeEach(func() {
+				c = client.NewServiceRegistryClient(name, address, srv.URL,
+					client.WithServers(otherSrv.URL),
+					client.WithRegisterAll(),
+					client.WithHeartbeatInterval(10*time.Millisecond))
+			})
+			It("registers with every server", func() {
+				Expect(c.Register()).To(Succeed())
+				Expect(reg.Lookup(name)).To(Equal(address))
+				Expect(otherReg.Lookup(name)).To(Equal(address))
+			})
+			It("succeeds while any server is up", func() {
+				srv.Close()
+				Expect(c.Register()).To(Succeed())
+				Expect(otherReg.Lookup(name)).To(Equal(address))
+			})
+			It("deregisters from every server", func() {
+				Expect(c.Register()).To(Succeed())
+				Expect(c.Close()).To(Succeed())
+				Expect(reg.Lookup(name)).To(BeEmpty())
+				Expect(otherReg.Lookup(name)).To(BeEmpty())
+			})
+		})
+	})
+})
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"sort"
+	"sync"
+)
+
+type serverHealth struct {
+	address string
+
+	// failures counts consecutive failed requests. It is reset by any success.
+	failures int
+}
+
+// serverList tracks the health of each registry server, so that requests
+// are sent to servers that have recently worked before those that have not.
+type serverList struct {
+	mutex   sync.Mutex
+	servers []*serverHealth
+}
+
+func newServerList(addresses []string) *serverList {
+	l := &serverList{}
+	for _, address := range addresses {
+		l.servers = append(l.servers, &serverHealth{address: address})
+	}
+	return l
+}
+
+// ordered returns the server addresses, healthiest first.
+// Servers with equal health keep the order they were configured in.
+func (l *serverList) ordered() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sorted := make([]*serverHealth, len(l.servers))
+	copy(sorted, l.servers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].failures < sorted[j].failures
+	})
+	addresses := make([]string, len(sorted))
+	for i, s := range sorted {
+		addresses[i] = s.address
+	}
+	return addresses
+}
+
+// report records the outcome of a request to a server.
+func (l *serverList) report(address string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, s := range l.servers {
+		if s.address == address {
+			if err == nil {
+				s.failures = 0
+			} else {
+				s.failures++
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ifIMust/srsr/client"
+	"github.com/ifIMust/srsr/message"
+)
+
+type ctl struct {
+	api    *client.API
+	server string
+	format string
+	out    io.Writer
+}
+
+func newCtl(server string, token string, format string, out io.Writer) *ctl {
+	return &ctl{
+		api:    client.NewAPI(server, token),
+		server: server,
+		format: format,
+		out:    out,
+	}
+}
+
+// tagFlags collects repeated -tag K=V flags.
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+	pairs := make([]string, 0, len(t))
+	for k, v := range t {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t tagFlags) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("tag %q is not K=V", value)
+	}
+	t[k] = v
+	return nil
+}
+
+// weightFlags collects repeated -weight VALUE=WEIGHT flags.
+type weightFlags map[string]int
+
+func (f weightFlags) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+strconv.Itoa(v))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f weightFlags) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	weight, err := strconv.Atoi(v)
+	if !ok || err != nil {
+		return fmt.Errorf("weight %q is not VALUE=WEIGHT", value)
+	}
+	f[k] = weight
+	return nil
+}
+
+// parse parses flags and checks the number of positional arguments.
+func parse(fs *flag.FlagSet, args []string, minArgs int, maxArgs int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, usageError{fs.Name() + ": " + err.Error()}
+	}
+	n := fs.NArg()
+	if n < minArgs || n > maxArgs {
+		return nil, usageError{fs.Name() + ": wrong number of arguments"}
+	}
+	return fs.Args(), nil
+}
+
+func runRegister(ctl *ctl, args []string) error {
+	fs := flag.NewFlagSet("register", flag.ContinueOnError)
+	port := fs.String("port", "", "port of the service")
+	instanceID := fs.String("id", "", "stable instance ID, such as a host name")
+	zone := fs.String("zone", "", "zone of the service")
+	region := fs.String("region", "", "region of the service")
+	tags := tagFlags{}
+	fs.Var(tags, "tag", "tag K=V, may be repeated")
+	args, err := parse(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	request := message.RegisterRequest{Name: args[0], Port: *port, Tags: tags, ID: *instanceID, Zone: *zone, Region: *region}
+	if len(args) == 2 {
+		request.Address = args[1]
+	}
+	id, err := ctl.api.Register(request)
+	if err != nil {
+		return err
+	}
+	return ctl.print(fields{"id": id}, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, id)
+	})
+}
+
+func runDeregister(ctl *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("deregister", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	ok, err := ctl.api.Deregister(args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("ID %s: %w", args[0], errNotFound)
+	}
+	return nil
+}
+
+func runHeartbeat(ctl *ctl, args []string) error {
+	fs := flag.NewFlagSet("heartbeat", flag.ContinueOnError)
+	interval := fs.Duration("interval", 0, "keep sending heartbeats at this interval, until interrupted")
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	id := args[0]
+
+	beat := func() error {
+		ok, err := ctl.api.Heartbeat(id, nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("ID %s: %w", id, errNotFound)
+		}
+		return nil
+	}
+	if *interval <= 0 {
+		return beat()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := beat(); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+func runLookup(ctl *ctl, args []string) error {
+	fs := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	split := fs.Bool("components", false, "print the scheme, host, port and path of the address")
+	zone := fs.String("zone", "", "prefer instances in this zone")
+	region := fs.String("region", "", "region of the zone, for services that fall back to the region")
+	wait := fs.Duration("wait", 0, "wait up to this long for an instance to register")
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	request := message.LookupRequest{Name: args[0], Zone: *zone, Region: *region, Components: *split}
+	var response message.LookupResponse
+	if *wait > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), *wait)
+		defer cancel()
+		response, err = ctl.api.WaitForWith(ctx, request)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("service %s: %w", args[0], errNotFound)
+		}
+	} else {
+		response, err = ctl.api.LookupWith(request)
+	}
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("service %s: %w", args[0], errNotFound)
+	}
+	if *split {
+		return ctl.printComponents(response)
+	}
+	address := response.Address
+	return ctl.print(fields{"address": address}, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, address)
+	})
+}
+
+func (ctl *ctl) printComponents(response message.LookupResponse) error {
+	if response.Components == nil {
+		return errors.New("the server sent no address components")
+	}
+	c := *response.Components
+	return ctl.print(c, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "SCHEME\tHOST\tPORT\tPATH")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Scheme, c.Host, c.Port, c.Path)
+	})
+}
+
+// instances lists instances, only of the named service if name is not empty.
+func (ctl *ctl) instances(name string) ([]message.InstanceInfo, error) {
+	all, err := ctl.api.Instances()
+	if err != nil || name == "" {
+		return all, err
+	}
+	named := []message.InstanceInfo{}
+	for _, instance := range all {
+		if instance.Name == name {
+			named = append(named, instance)
+		}
+	}
+	return named, nil
+}
+
+func runList(ctl *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("list", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	var name string
+	if len(args) == 1 {
+		name = args[0]
+	}
+	instances, err := ctl.instances(name)
+	if err != nil {
+		return err
+	}
+	if name != "" && len(instances) == 0 {
+		return fmt.Errorf("service %s: %w", name, errNotFound)
+	}
+	return ctl.print(instances, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NAME\tID\tADDRESS\tSTATUS\tHEARTBEAT AGE\tEXPIRES IN\tTAGS")
+		for _, i := range instances {
+			age, expires := fmt.Sprintf("%.1fs", i.HeartbeatAge), fmt.Sprintf("%.1fs", i.ExpiresIn)
+			if i.Static {
+				age, expires = "static", "never"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				i.Name, i.ID, i.Address, i.Status, age, expires, tagFlags(i.Tags))
+		}
+	})
+}
+
+func runTraffic(ctl *ctl, args []string) error {
+	fs := flag.NewFlagSet("traffic", flag.ContinueOnError)
+	tag := fs.String("tag", "", "split lookups by the value of this tag")
+	weights := weightFlags{}
+	fs.Var(weights, "weight", "weight VALUE=WEIGHT of instances with the tag value, may be repeated")
+	remove := fs.Bool("clear", false, "remove the traffic policy")
+	args, err := parse(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	if *tag != "" || *remove {
+		if len(args) != 1 || (*tag != "") == *remove {
+			return usageError{"traffic: -tag or -clear needs a NAME, and not both"}
+		}
+		return ctl.api.SetTraffic(message.TrafficRequest{Name: args[0], Tag: *tag, Weights: weights})
+	}
+
+	policies, err := ctl.api.Traffic()
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		policies = slices.DeleteFunc(policies, func(p message.TrafficInfo) bool {
+			return p.Name != args[0]
+		})
+		if len(policies) == 0 {
+			return fmt.Errorf("traffic policy for %s: %w", args[0], errNotFound)
+		}
+	}
+	return ctl.print(policies, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NAME\tTAG\tVALUE\tWEIGHT\tINSTANCES\tSHARE")
+		for _, p := range policies {
+			values := make([]string, 0, len(p.Weights))
+			for v := range p.Weights {
+				values = append(values, v)
+			}
+			sort.Strings(values)
+			for _, v := range values {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%.0f%%\n",
+					p.Name, p.Tag, v, p.Weights[v], p.Instances[v], p.Share[v]*100)
+			}
+		}
+	})
+}
+
+type watchEvent struct {
+	Event    string               `json:"event"`
+	Time     time.Time            `json:"time"`
+	Instance message.InstanceInfo `json:"instance"`
+}
+
+func runWatch(ctl *ctl, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", 2*time.Second, "polling interval")
+	args, err := parse(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	var name string
+	if len(args) == 1 {
+		name = args[0]
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	known := make(map[string]message.InstanceInfo)
+	for {
+		instances, err := ctl.instances(name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		seen := make(map[string]bool)
+		for _, instance := range instances {
+			seen[instance.ID] = true
+			previous, ok := known[instance.ID]
+			switch {
+			case !ok:
+				ctl.printEvent(watchEvent{"added", now, instance})
+			case previous.Status != instance.Status || previous.Address != instance.Address:
+				ctl.printEvent(watchEvent{"changed", now, instance})
+			}
+			known[instance.ID] = instance
+		}
+		for id, instance := range known {
+			if !seen[id] {
+				ctl.printEvent(watchEvent{"removed", now, instance})
+				delete(known, id)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+func (ctl *ctl) printEvent(e watchEvent) {
+	switch ctl.format {
+	case "json":
+		json.NewEncoder(ctl.out).Encode(e)
+	case "yaml":
+		fmt.Fprintln(ctl.out, "---")
+		ctl.print(e, nil)
+	default:
+		fmt.Fprintf(ctl.out, "%s %-8s %s %s %s %s\n", e.Time.Format(time.TimeOnly),
+			e.Event, e.Instance.Name, e.Instance.ID, e.Instance.Address, e.Instance.Status)
+	}
+}
+
+func runExport(ctl *ctl, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	file := fs.String("f", "", "write to this file instead of standard output")
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	doc, err := ctl.api.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		ctl.out = f
+	}
+	// A document is always structured; table output means JSON here.
+	if ctl.format == "table" {
+		ctl.format = "json"
+	}
+	return ctl.print(doc, nil)
+}
+
+func readDocument(file string) (message.Snapshot, error) {
+	var doc message.Snapshot
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return doc, err
+	}
+	if json.Unmarshal(data, &doc) != nil {
+		// Not JSON, so try YAML, which maps onto the same JSON field names.
+		var generic any
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return doc, fmt.Errorf("%s is neither JSON nor YAML: %w", file, err)
+		}
+		data, err = json.Marshal(generic)
+		if err != nil {
+			return doc, err
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return doc, err
+		}
+	}
+	if doc.Version != message.SnapshotVersion {
+		return doc, fmt.Errorf("%s has unsupported version %d", file, doc.Version)
+	}
+	return doc, nil
+}
+
+// runImport restores a document written by export, keeping instance IDs.
+func runImport(ctl *ctl, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	replace := fs.Bool("replace", false, "remove instances not in the document, instead of merging")
+	reset := fs.Bool("reset-deadlines", false, "treat each instance as if it had just sent a heartbeat")
+	timeout := fs.Bool("timeout", false, "set the server's timeout to the document's")
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	doc, err := readDocument(args[0])
+	if err != nil {
+		return err
+	}
+
+	opts := client.RestoreOptions{ResetDeadlines: *reset, Timeout: *timeout}
+	if *replace {
+		opts.Mode = "replace"
+	}
+	restored, err := ctl.api.Restore(doc, opts)
+	if err != nil {
+		return err
+	}
+	return ctl.print(fields{"restored": restored}, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Restored %d instances.\n", restored)
+	})
+}
+
+func runStatus(ctl *ctl, args []string) error {
+	if _, err := parse(flag.NewFlagSet("status", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	status, err := ctl.api.Status()
+	if err != nil {
+		return err
+	}
+	return ctl.print(status, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Server:\t%s\n", ctl.server)
+		fmt.Fprintf(w, "Services:\t%d\n", status.Services)
+		fmt.Fprintf(w, "Instances:\t%d\n", status.Instances)
+		fmt.Fprintf(w, "Timeout:\t%gs\n", status.TimeoutSeconds)
+	})
+}
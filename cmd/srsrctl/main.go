@@ -0,0 +1,135 @@
+// srsrctl is a command-line tool for operating srsr servers.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Exit codes, for scripts.
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+// errNotFound is returned by commands when the server doesn't know the requested name or ID.
+var errNotFound = errors.New("not found")
+
+// usageError is returned by commands given bad arguments.
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctl *ctl, args []string) error
+}
+
+var commands = []command{
+	{"register", "[-id ID] [-port PORT] [-zone ZONE] [-region REGION] [-tag K=V]... NAME [ADDRESS]", "register a service once, printing its ID", runRegister},
+	{"deregister", "ID", "deregister a service", runDeregister},
+	{"heartbeat", "[-interval DURATION] ID", "send a heartbeat, or keep sending them at an interval", runHeartbeat},
+	{"lookup", "[-components] [-zone ZONE] [-region REGION] [-wait DURATION] NAME", "print an address for a service, or its components", runLookup},
+	{"list", "[NAME]", "list registered instances (admin)", runList},
+	{"traffic", "[-tag TAG -weight VALUE=WEIGHT... | -clear] [NAME]", "print traffic policies, or set or clear one for canary releases (admin)", runTraffic},
+	{"watch", "[-interval DURATION] [NAME]", "print instances as they are added, changed and removed (admin)", runWatch},
+	{"export", "[-f FILE]", "write a snapshot of the registry to a document (admin)", runExport},
+	{"import", "[-replace] [-reset-deadlines] [-timeout] FILE", "restore a document written by export (admin)", runImport},
+	{"status", "", "print a summary of the server's state", runStatus},
+}
+
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintln(out, "Usage: srsrctl [-s SERVER] [-token TOKEN] [-o table|json|yaml] COMMAND [ARGS]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", c.name, c.summary)
+		if c.args != "" {
+			fmt.Fprintf(out, "  %-10s   %s %s\n", "", c.name, c.args)
+		}
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Options:")
+	fs.PrintDefaults()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Exit status is 0 on success, 1 on failure, 2 for bad usage, and 3 if the name or ID is not found.")
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command line args, writing results to stdout and errors to stderr,
+// and returns the exit status.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("srsrctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var server, token, format string
+	fs.StringVar(&server, "s", envOr("SRSR_SERVER", "http://localhost:4214"), "Server address. Defaults to $SRSR_SERVER.")
+	fs.StringVar(&token, "token", os.Getenv("SRSR_ADMIN_TOKEN"), "Admin token, for admin commands. Defaults to $SRSR_ADMIN_TOKEN.")
+	fs.StringVar(&format, "o", "table", "Output format: table, json or yaml.")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if fs.NArg() == 0 {
+		usage(fs)
+		return exitUsage
+	}
+	if format != "table" && format != "json" && format != "yaml" {
+		fmt.Fprintln(stderr, "srsrctl: unknown output format", format)
+		return exitUsage
+	}
+
+	name := fs.Arg(0)
+	for _, c := range commands {
+		if c.name == name {
+			ctl := newCtl(strings.TrimSuffix(server, "/"), token, format, stdout)
+			return exitCode(c.run(ctl, fs.Args()[1:]), stderr)
+		}
+	}
+	fmt.Fprintln(stderr, "srsrctl: unknown command", name)
+	usage(fs)
+	return exitUsage
+}
+
+// exitCode reports err, if any, to stderr, and returns the exit status for it.
+func exitCode(err error, stderr io.Writer) int {
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(stderr, "srsrctl:", err)
+	var usageErr usageError
+	switch {
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, errNotFound):
+		return exitNotFound
+	default:
+		return exitFailure
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fields is a small structured result, for commands that print a single value.
+type fields map[string]any
+
+// print writes v in the chosen format. In table format, table writes v instead;
+// if table is nil, v is written as JSON.
+func (ctl *ctl) print(v any, table func(w *tabwriter.Writer)) error {
+	switch {
+	case ctl.format == "yaml":
+		// Go through JSON, so YAML uses the same field names.
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic any
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		encoder := yaml.NewEncoder(ctl.out)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(generic); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case ctl.format == "table" && table != nil:
+		w := tabwriter.NewWriter(ctl.out, 0, 4, 2, ' ', 0)
+		table(w)
+		return w.Flush()
+	default:
+		encoder := json.NewEncoder(ctl.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+}
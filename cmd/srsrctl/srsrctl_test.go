@@ -0,0 +1,241 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("srsrctl", func() {
+	const token = "sekrit"
+
+	var reg registry.Registry
+	var srv *httptest.Server
+	var stdout, stderr *bytes.Buffer
+
+	// srsrctl runs a command line against srv, with the admin token, and returns the exit status.
+	srsrctl := func(args ...string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return run(append([]string{"-s", srv.URL, "-token", token}, args...), stdout, stderr)
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		srv = httptest.NewServer(server.SetupRouter(reg, server.WithAdminToken(token)))
+		stdout = new(bytes.Buffer)
+		stderr = new(bytes.Buffer)
+	})
+	AfterEach(func() {
+		srv.Close()
+	})
+
+	Describe("usage", func() {
+		It("prints usage without a command", func() {
+			Expect(srsrctl()).To(Equal(exitUsage))
+			Expect(stderr.String()).To(ContainSubstring("Usage: srsrctl"))
+		})
+		It("prints usage for -h", func() {
+			Expect(srsrctl("-h")).To(Equal(exitOK))
+			Expect(stderr.String()).To(ContainSubstring("Commands:"))
+		})
+		It("rejects unknown commands", func() {
+			Expect(srsrctl("flard")).To(Equal(exitUsage))
+			Expect(stderr.String()).To(ContainSubstring("unknown command flard"))
+		})
+		It("rejects unknown output formats", func() {
+			Expect(srsrctl("-o", "xml", "status")).To(Equal(exitUsage))
+		})
+		It("rejects unknown flags of commands", func() {
+			Expect(srsrctl("lookup", "-nope", "dungen")).To(Equal(exitUsage))
+			Expect(stderr.String()).To(ContainSubstring("lookup:"))
+		})
+		It("rejects the wrong number of arguments", func() {
+			Expect(srsrctl("lookup")).To(Equal(exitUsage))
+			Expect(srsrctl("deregister", "a", "b")).To(Equal(exitUsage))
+			Expect(srsrctl("register", "-tag", "nope", "dungen")).To(Equal(exitUsage))
+		})
+		It("rejects -tag and -clear together", func() {
+			Expect(srsrctl("traffic", "-tag", "version", "-clear", "dungen")).To(Equal(exitUsage))
+		})
+	})
+
+	Describe("register", func() {
+		It("prints the ID", func() {
+			Expect(srsrctl("register", "-tag", "version=2", "dungen", "http://localhost:5000")).To(Equal(exitOK))
+			id := strings.TrimSpace(stdout.String())
+			instance, ok := reg.Instance(id)
+			Expect(ok).To(BeTrue())
+			Expect(instance.Address).To(Equal("http://localhost:5000"))
+			Expect(instance.Tags).To(Equal(map[string]string{"version": "2"}))
+		})
+		It("prints the ID as JSON", func() {
+			Expect(srsrctl("-o", "json", "register", "dungen", "http://localhost:5000")).To(Equal(exitOK))
+			var result map[string]string
+			Expect(json.Unmarshal(stdout.Bytes(), &result)).To(Succeed())
+			_, ok := reg.Instance(result["id"])
+			Expect(ok).To(BeTrue())
+		})
+		It("fails for invalid addresses", func() {
+			Expect(srsrctl("register", "dungen", "not an address")).To(Equal(exitFailure))
+			Expect(stderr.String()).To(HavePrefix("srsrctl:"))
+		})
+	})
+
+	Describe("deregister and heartbeat", func() {
+		var id string
+
+		BeforeEach(func() {
+			id, _ = reg.Register("dungen", "http://localhost:5000")
+		})
+		It("sends a heartbeat", func() {
+			Expect(srsrctl("heartbeat", id)).To(Equal(exitOK))
+		})
+		It("deregisters", func() {
+			Expect(srsrctl("deregister", id)).To(Equal(exitOK))
+			Expect(reg.Lookup("dungen")).To(BeEmpty())
+		})
+		It("reports unknown IDs as not found", func() {
+			Expect(srsrctl("heartbeat", "nope")).To(Equal(exitNotFound))
+			Expect(srsrctl("deregister", "nope")).To(Equal(exitNotFound))
+		})
+	})
+
+	Describe("lookup", func() {
+		BeforeEach(func() {
+			reg.Register("dungen", "http://localhost:5000/api")
+		})
+		It("prints the address", func() {
+			Expect(srsrctl("lookup", "dungen")).To(Equal(exitOK))
+			Expect(stdout.String()).To(Equal("http://localhost:5000/api\n"))
+		})
+		It("prints the address as YAML", func() {
+			Expect(srsrctl("-o", "yaml", "lookup", "dungen")).To(Equal(exitOK))
+			Expect(stdout.String()).To(Equal("address: http://localhost:5000/api\n"))
+		})
+		It("prints the components as a table", func() {
+			Expect(srsrctl("lookup", "-components", "dungen")).To(Equal(exitOK))
+			lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+			Expect(lines).To(HaveLen(2))
+			Expect(strings.Fields(lines[0])).To(Equal([]string{"SCHEME", "HOST", "PORT", "PATH"}))
+			Expect(strings.Fields(lines[1])).To(Equal([]string{"http", "localhost", "5000", "/api"}))
+		})
+		It("reports unknown services as not found", func() {
+			Expect(srsrctl("lookup", "flard")).To(Equal(exitNotFound))
+			Expect(stderr.String()).To(ContainSubstring("service flard: not found"))
+		})
+		It("reports services that don't register in time as not found", func() {
+			Expect(srsrctl("lookup", "-wait", "50ms", "flard")).To(Equal(exitNotFound))
+		})
+		It("waits for an instance in the zone", func() {
+			reg.SetFallback("dungen", registry.FallbackNone)
+			reg.RegisterInstance(registry.Instance{Name: "dungen", Address: "http://localhost:5001", Locality: registry.Locality{Zone: "a"}})
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				reg.RegisterInstance(registry.Instance{Name: "dungen", Address: "http://localhost:5002", Locality: registry.Locality{Zone: "b"}})
+			}()
+			Expect(srsrctl("lookup", "-wait", "5s", "-zone", "b", "dungen")).To(Equal(exitOK))
+			Expect(stdout.String()).To(Equal("http://localhost:5002\n"))
+		})
+		It("fails when the server can't be reached", func() {
+			srv.Close()
+			Expect(srsrctl("lookup", "dungen")).To(Equal(exitFailure))
+		})
+	})
+
+	Describe("list", func() {
+		BeforeEach(func() {
+			reg.RegisterInstance(registry.Instance{Name: "dungen", Address: "http://localhost:5000", Tags: map[string]string{"version": "2"}})
+			reg.Register("flard", "http://localhost:5001")
+		})
+		It("prints a table", func() {
+			Expect(srsrctl("list", "dungen")).To(Equal(exitOK))
+			lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0]).To(HavePrefix("NAME"))
+			Expect(strings.Fields(lines[1])).To(ContainElements("dungen", "http://localhost:5000", "up", "version=2"))
+		})
+		It("prints JSON", func() {
+			Expect(srsrctl("-o", "json", "list")).To(Equal(exitOK))
+			var instances []message.InstanceInfo
+			Expect(json.Unmarshal(stdout.Bytes(), &instances)).To(Succeed())
+			Expect(instances).To(HaveLen(2))
+		})
+		It("prints YAML with the JSON field names", func() {
+			Expect(srsrctl("-o", "yaml", "list", "dungen")).To(Equal(exitOK))
+			var instances []map[string]any
+			Expect(yaml.Unmarshal(stdout.Bytes(), &instances)).To(Succeed())
+			Expect(instances).To(HaveLen(1))
+			Expect(instances[0]).To(HaveKeyWithValue("name", "dungen"))
+			Expect(instances[0]).To(HaveKeyWithValue("address", "http://localhost:5000"))
+		})
+		It("reports unknown services as not found", func() {
+			Expect(srsrctl("list", "nope")).To(Equal(exitNotFound))
+		})
+		It("fails without the admin token", func() {
+			Expect(run([]string{"-s", srv.URL, "-token", "", "list"}, stdout, stderr)).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("401"))
+		})
+	})
+
+	Describe("traffic", func() {
+		It("sets, prints and clears a policy", func() {
+			Expect(srsrctl("traffic", "-tag", "version", "-weight", "1=90", "-weight", "2=10", "dungen")).To(Equal(exitOK))
+			Expect(srsrctl("traffic", "dungen")).To(Equal(exitOK))
+			lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(strings.Fields(lines[1])[:4]).To(Equal([]string{"dungen", "version", "1", "90"}))
+			Expect(strings.Fields(lines[2])[:4]).To(Equal([]string{"dungen", "version", "2", "10"}))
+
+			Expect(srsrctl("traffic", "-clear", "dungen")).To(Equal(exitOK))
+			Expect(srsrctl("traffic", "dungen")).To(Equal(exitNotFound))
+		})
+	})
+
+	Describe("export and import", func() {
+		It("copies instances to another server", func() {
+			id, _ := reg.Register("dungen", "http://localhost:5000")
+			for _, format := range []string{"json", "yaml"} {
+				path := filepath.Join(GinkgoT().TempDir(), "snapshot")
+				Expect(srsrctl("-o", format, "export", "-f", path)).To(Equal(exitOK))
+
+				reg = registry.NewServiceRegistry()
+				srv.Close()
+				srv = httptest.NewServer(server.SetupRouter(reg, server.WithAdminToken(token)))
+				Expect(srsrctl("import", "-reset-deadlines", path)).To(Equal(exitOK))
+				Expect(stdout.String()).To(Equal("Restored 1 instances.\n"))
+				_, ok := reg.Instance(id)
+				Expect(ok).To(BeTrue())
+			}
+		})
+		It("rejects documents that aren't snapshots", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "snapshot")
+			os.WriteFile(path, []byte("version: 99\n"), 0o600)
+			Expect(srsrctl("import", path)).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("unsupported version"))
+		})
+	})
+
+	Describe("status", func() {
+		It("prints a summary", func() {
+			reg.Register("dungen", "http://localhost:5000")
+			Expect(srsrctl("status")).To(Equal(exitOK))
+			Expect(stdout.String()).To(MatchRegexp(`Services:\s+1\n`))
+			Expect(stdout.String()).To(MatchRegexp(`Instances:\s+1\n`))
+			Expect(stdout.String()).To(MatchRegexp(`Timeout:\s+30s\n`))
+		})
+	})
+})
@@ -22,5 +22,5 @@ func main() {
 	<- time.After(time.Second * 22)
 	
 	// A while later, when shutting down...
-	c.Deregister()
+	c.Close()
 }
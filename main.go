@@ -1,21 +1,286 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"log/slog"
+	"net/netip"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/sqlitestore"
 	"github.com/ifIMust/srsr/server"
 )
 
 func main() {
+	// "srsr run ..." wraps a child process, instead of serving.
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(run(os.Args[2:]))
+	}
+
 	var port int
 	flag.IntVar(&port, "p", 4214, "The server will listen on this port.")
 	var timeoutSeconds int
 	flag.IntVar(&timeoutSeconds, "t", 30, "Heartbeat timeout (seconds). Clients will be deregistered after this period, if they don't send a heartbeat.")
+	var enableProxy bool
+	flag.BoolVar(&enableProxy, "proxy", false, "Forward requests for /proxy/NAME/PATH to an instance of service NAME.")
+	var adminToken string
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("SRSR_ADMIN_TOKEN"), "Serve the admin dashboard and API at /admin, protected by this token. Defaults to $SRSR_ADMIN_TOKEN.")
+	defaultPolicy := registry.PolicyAllow
+	flag.Func("default-policy", "Registration policy for services without their own: allow, replace, reject or singleton. (default allow)", func(value string) error {
+		var err error
+		defaultPolicy, err = registry.ParsePolicy(value)
+		return err
+	})
+	policies := make(map[string]registry.Policy)
+	flag.Func("policy", "Registration policy for one service, as NAME=POLICY. May be repeated.", func(value string) error {
+		name, p, ok := strings.Cut(value, "=")
+		if !ok {
+			return errors.New("expected NAME=POLICY")
+		}
+		policy, err := registry.ParsePolicy(p)
+		policies[name] = policy
+		return err
+	})
+	defaultStrategy := registry.StrategyRandom
+	flag.Func("default-strategy", "Lookup strategy for services without their own: random or least-loaded. (default random)", func(value string) error {
+		var err error
+		defaultStrategy, err = registry.ParseStrategy(value)
+		return err
+	})
+	strategies := make(map[string]registry.Strategy)
+	flag.Func("strategy", "Lookup strategy for one service, as NAME=STRATEGY. May be repeated.", func(value string) error {
+		name, st, ok := strings.Cut(value, "=")
+		if !ok {
+			return errors.New("expected NAME=STRATEGY")
+		}
+		strategy, err := registry.ParseStrategy(st)
+		strategies[name] = strategy
+		return err
+	})
+	defaultFallback := registry.FallbackAny
+	flag.Func("default-zone-fallback", "Which instances a lookup may return when none are healthy in the caller's zone, for services without their own: any, region or none. (default any)", func(value string) error {
+		var err error
+		defaultFallback, err = registry.ParseFallback(value)
+		return err
+	})
+	fallbacks := make(map[string]registry.Fallback)
+	flag.Func("zone-fallback", "Zone fallback for one service, as NAME=FALLBACK. May be repeated.", func(value string) error {
+		name, f, ok := strings.Cut(value, "=")
+		if !ok {
+			return errors.New("expected NAME=FALLBACK")
+		}
+		fallback, err := registry.ParseFallback(f)
+		fallbacks[name] = fallback
+		return err
+	})
+	var defaultWindows registry.Windows
+	flag.DurationVar(&defaultWindows.Warmup, "default-warmup", 0, "Keep new instances out of lookups until their first heartbeat, or for this long.")
+	flag.DurationVar(&defaultWindows.Drain, "default-drain", 0, "Keep deregistered and expired instances as draining, out of lookups, for this long before removing them.")
+	windows := make(map[string]registry.Windows)
+	flag.Func("warmup", "Warmup window for one service, as NAME=DURATION. May be repeated.", func(value string) error {
+		name, d, err := parseNamedDuration(value)
+		w := windows[name]
+		w.Warmup = d
+		windows[name] = w
+		return err
+	})
+	flag.Func("drain", "Drain window for one service, as NAME=DURATION. May be repeated.", func(value string) error {
+		name, d, err := parseNamedDuration(value)
+		w := windows[name]
+		w.Drain = d
+		windows[name] = w
+		return err
+	})
+	var rateLimitOpts []server.Option
+	flag.Func("rate-limit", "Limit each client IP to RATE requests per second, after a burst of BURST, for routes without their own limit. As RATE,BURST.", func(value string) error {
+		rate, burst, err := parseRateLimit(value)
+		rateLimitOpts = append(rateLimitOpts, server.WithDefaultRateLimit(rate, burst))
+		return err
+	})
+	flag.Func("route-rate-limit", "Rate limit for one route, such as /register, as PATH=RATE,BURST. May be repeated.", func(value string) error {
+		path, limit, ok := strings.Cut(value, "=")
+		if !ok {
+			return errors.New("expected PATH=RATE,BURST")
+		}
+		rate, burst, err := parseRateLimit(limit)
+		rateLimitOpts = append(rateLimitOpts, server.WithRateLimit(path, rate, burst))
+		return err
+	})
+	var maxInstances, maxPerName int
+	flag.IntVar(&maxInstances, "max-instances", 0, "Refuse registrations beyond this many instances in total. 0 means no limit.")
+	flag.IntVar(&maxPerName, "max-per-name", 0, "Refuse registrations beyond this many instances of one service. 0 means no limit.")
+	var maxBodyBytes int64
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", 1<<20, "Refuse request bodies larger than this, other than proxied requests.")
+	var storePath string
+	flag.StringVar(&storePath, "store-file", "", "Keep registered instances in this file, so they survive restarts. By default, they are kept in memory.")
+	var sqlitePath string
+	flag.StringVar(&sqlitePath, "store-sqlite", "", "Keep registered instances in this SQLite database, instead of a file from -store-file.")
+	var staticPath string
+	flag.StringVar(&staticPath, "static", "", "Register the static instances listed in this YAML file. They never expire.")
+	var webhookPath string
+	flag.StringVar(&webhookPath, "webhooks", "", "Send changes to the registry to the webhooks listed in this YAML file.")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Log level: debug, info, warn or error. Logs are JSON, on stderr.")
+	var auditPath string
+	flag.StringVar(&auditPath, "audit-log", "", "Record registrations, deregistrations, expiries and admin actions to this file.")
+	var auditMaxBytes int64
+	flag.Int64Var(&auditMaxBytes, "audit-max-bytes", 10<<20, "Rotate the audit log when it reaches this size.")
+	var auditKeep int
+	flag.IntVar(&auditKeep, "audit-keep", 5, "Number of rotated audit logs to keep.")
+	var trustedProxies []netip.Prefix
+	var trustSet bool
+	flag.Func("trusted-proxy", "Trust the forwarded headers of this proxy IP or CIDR, instead of loopback proxies. May be repeated; \"none\" trusts no proxy.", func(value string) error {
+		trustSet = true
+		if value == "none" {
+			return nil
+		}
+		network, err := parseNetwork(value)
+		trustedProxies = append(trustedProxies, network)
+		return err
+	})
+	var forwardedHeaders []string
+	flag.Func("forwarded-header", "Header that trusted proxies forward the client IP in. May be repeated. (default X-Forwarded-For, then X-Real-IP)", func(value string) error {
+		forwardedHeaders = append(forwardedHeaders, value)
+		return nil
+	})
+	var noDeduction bool
+	flag.BoolVar(&noDeduction, "no-deduce-address", false, "Refuse registrations without an address, instead of deducing it from the client IP.")
+	var checkSource bool
+	flag.BoolVar(&checkSource, "check-source", false, "Refuse registrations with an address other than the client IP, or a name resolving to it.")
 	flag.Parse()
-	registry := registry.NewServiceRegistry()
-	registry.SetTimeout(time.Duration(timeoutSeconds) * time.Second)
-	router := server.SetupRouter(registry)
-	router.Run("localhost:" + strconv.Itoa(port))
+
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(logger)
+
+	var store registry.Store = registry.NewMemoryStore()
+	switch {
+	case storePath != "" && sqlitePath != "":
+		logger.Error("-store-file and -store-sqlite can't both be used")
+		os.Exit(1)
+	case storePath != "":
+		fileStore, err := registry.OpenFileStore(storePath)
+		if err != nil {
+			logger.Error("opening store failed", "error", err)
+			os.Exit(1)
+		}
+		defer fileStore.Close()
+		store = fileStore
+	case sqlitePath != "":
+		sqliteStore, err := sqlitestore.Open(sqlitePath)
+		if err != nil {
+			logger.Error("opening store failed", "error", err)
+			os.Exit(1)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+	}
+	registry, err := registry.New(
+		registry.WithTimeout(time.Duration(timeoutSeconds)*time.Second),
+		registry.WithStrategy(defaultStrategy),
+		registry.WithStore(store))
+	if err != nil {
+		logger.Error("loading stored instances failed", "error", err)
+		os.Exit(1)
+	}
+	registry.SetDefaultPolicy(defaultPolicy)
+	for name, policy := range policies {
+		registry.SetPolicy(name, policy)
+	}
+	for name, strategy := range strategies {
+		registry.SetStrategy(name, strategy)
+	}
+	registry.SetDefaultFallback(defaultFallback)
+	for name, fallback := range fallbacks {
+		registry.SetFallback(name, fallback)
+	}
+	registry.SetDefaultWindows(defaultWindows)
+	for name, w := range windows {
+		registry.SetWindows(name, w)
+	}
+	registry.SetLimits(maxInstances, maxPerName)
+	if staticPath != "" {
+		if _, err := server.LoadStaticFile(registry, staticPath); err != nil {
+			logger.Error("loading static instances failed", "error", err)
+			os.Exit(1)
+		}
+	}
+	opts := append(rateLimitOpts, server.WithMaxBodyBytes(maxBodyBytes), server.WithLogger(logger))
+	if auditPath != "" {
+		auditFile, err := server.OpenAuditFile(auditPath, auditMaxBytes, auditKeep)
+		if err != nil {
+			logger.Error("opening audit log failed", "error", err)
+			os.Exit(1)
+		}
+		defer auditFile.Close()
+		opts = append(opts, server.WithAuditLog(auditFile))
+	}
+	if webhookPath != "" {
+		webhooks, err := server.LoadWebhookFile(webhookPath)
+		if err != nil {
+			logger.Error("loading webhooks failed", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, server.WithWebhooks(webhooks...))
+	}
+	if trustSet {
+		opts = append(opts, server.WithTrustedProxies(trustedProxies...))
+	}
+	if forwardedHeaders != nil {
+		opts = append(opts, server.WithForwardedHeaders(forwardedHeaders...))
+	}
+	if noDeduction {
+		opts = append(opts, server.WithoutAddressDeduction())
+	}
+	if checkSource {
+		opts = append(opts, server.WithSourceCheck())
+	}
+	if enableProxy {
+		opts = append(opts, server.WithProxy())
+	}
+	if adminToken != "" {
+		opts = append(opts, server.WithAdminToken(adminToken))
+	}
+	router := server.SetupRouter(registry, opts...)
+	if err := router.Run("localhost:" + strconv.Itoa(port)); err != nil {
+		logger.Error("serving failed", "error", err)
+	}
+}
+
+// parseNamedDuration parses NAME=DURATION.
+func parseNamedDuration(value string) (string, time.Duration, error) {
+	name, d, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", 0, errors.New("expected NAME=DURATION")
+	}
+	duration, err := time.ParseDuration(d)
+	return name, duration, err
+}
+
+// parseRateLimit parses RATE,BURST.
+func parseRateLimit(value string) (float64, int, error) {
+	r, b, ok := strings.Cut(value, ",")
+	if !ok {
+		return 0, 0, errors.New("expected RATE,BURST")
+	}
+	rate, err := strconv.ParseFloat(r, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	burst, err := strconv.Atoi(b)
+	return rate, burst, err
+}
+
+// parseNetwork parses an IP or CIDR. An IP is a network of one address.
+func parseNetwork(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		return netip.ParsePrefix(value)
+	}
+	ip, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
 }
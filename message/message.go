@@ -1,14 +1,42 @@
 package message
 
+import "time"
+
 type RegisterRequest struct {
-	Name    string `json:"name" binding:"required"`
-	Address string `json:"address"`
-	Port    string `json:"port"`
+	Name    string            `json:"name" binding:"required"`
+	Address string            `json:"address"`
+	Port    string            `json:"port"`
+	Tags    map[string]string `json:"tags,omitempty"`
+
+	// ID optionally chooses a stable instance ID, such as a pod or host name.
+	// The registered ID is namespaced by the name, as "name/id".
+	ID string `json:"id,omitempty"`
+
+	// Zone and Region are where the instance runs, for zone-aware lookups.
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
 }
 
 type RegisterResponse struct {
 	ID      string `json:"id"`
 	Success bool   `json:"success"`
+
+	// Result is "created", "replaced" or "rejected", depending on the registration policy,
+	// or "updated" for a client-chosen ID that was already registered.
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RegisterBatchRequest registers several instances at once.
+type RegisterBatchRequest struct {
+	Registrations []RegisterRequest `json:"registrations" binding:"required"`
+}
+
+// RegisterBatchResponse has a result for each registration, in the same order.
+// Success is true if every registration succeeded.
+type RegisterBatchResponse struct {
+	Success bool               `json:"success"`
+	Results []RegisterResponse `json:"results"`
 }
 
 type DeregisterRequest struct {
@@ -21,17 +49,231 @@ type DeregisterResponse struct {
 
 type LookupRequest struct {
 	Name string `json:"name" binding:"required"`
+
+	// Components requests the components of the address, as well as its URL.
+	Components bool `json:"components,omitempty"`
+
+	// Zone and Region are where the caller runs. Instances in the caller's zone are preferred.
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
 }
 
 type LookupResponse struct {
 	Success bool   `json:"success"`
 	Address string `json:"address"`
+
+	// Static is set if the address is a static entry, which sends no heartbeats.
+	Static bool `json:"static,omitempty"`
+
+	// Components is set if requested.
+	Components *AddressComponents `json:"components,omitempty"`
+
+	// Zone and Region are those of the instance.
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
+}
+
+// AddressComponents is an address split into its parts. Host has no brackets,
+// even for IPv6. Path is the socket path of a unix address, or a base path.
+type AddressComponents struct {
+	Scheme string `json:"scheme"`
+	Host   string `json:"host,omitempty"`
+	Port   string `json:"port,omitempty"`
+	Path   string `json:"path,omitempty"`
 }
 
 type HeartbeatRequest struct {
 	ID string `json:"id" binding:"required"`
+
+	// Load is optional, for least-loaded lookups.
+	Load *Load `json:"load,omitempty"`
+}
+
+// Load is reported by an instance with its heartbeats. Every field is optional.
+type Load struct {
+	InFlight   int     `json:"in_flight,omitempty"`
+	CPU        float64 `json:"cpu,omitempty"`
+	QueueDepth int     `json:"queue_depth,omitempty"`
+	Capacity   int     `json:"capacity,omitempty"`
 }
 
 type HeartbeatResponse struct {
 	Success bool `json:"success"`
 }
+
+// HeartbeatBatchRequest sends several heartbeats at once.
+type HeartbeatBatchRequest struct {
+	Heartbeats []HeartbeatRequest `json:"heartbeats" binding:"required"`
+}
+
+// HeartbeatBatchResponse has a result for each heartbeat, in the same order.
+// Success is true if every ID was known.
+type HeartbeatBatchResponse struct {
+	Success bool                `json:"success"`
+	Results []HeartbeatResponse `json:"results"`
+}
+
+type StatusResponse struct {
+	Success        bool    `json:"success"`
+	Services       int     `json:"services"`
+	Instances      int     `json:"instances"`
+	TimeoutSeconds float64 `json:"timeout_seconds"`
+}
+
+// InstanceInfo describes a registered instance, for admin tools.
+type InstanceInfo struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Address       string            `json:"address"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Status        string            `json:"status"`
+	Static        bool              `json:"static,omitempty"`
+	Zone          string            `json:"zone,omitempty"`
+	Region        string            `json:"region,omitempty"`
+	Registered    time.Time         `json:"registered"`
+	LastHeartbeat time.Time         `json:"last_heartbeat"`
+
+	// Seconds since the last heartbeat, and until the instance expires without one.
+	// For static instances, which never expire, ExpiresIn and TTL are 0.
+	HeartbeatAge float64 `json:"heartbeat_age_seconds"`
+	ExpiresIn    float64 `json:"expires_in_seconds"`
+	TTL          float64 `json:"ttl_seconds"`
+
+	// Load is the load last reported with a heartbeat, if any.
+	Load *Load `json:"load,omitempty"`
+}
+
+type InstancesResponse struct {
+	Success   bool           `json:"success"`
+	Instances []InstanceInfo `json:"instances"`
+}
+
+type MaintenanceRequest struct {
+	ID          string `json:"id" binding:"required"`
+	Maintenance bool   `json:"maintenance"`
+}
+
+type MaintenanceResponse struct {
+	Success bool `json:"success"`
+}
+
+type PolicyRequest struct {
+	Name   string `json:"name" binding:"required"`
+	Policy string `json:"policy" binding:"required"`
+}
+
+type PolicyResponse struct {
+	Success bool `json:"success"`
+}
+
+// WindowsRequest sets the warmup and drain windows of a service. Zero disables a window.
+type WindowsRequest struct {
+	Name          string  `json:"name" binding:"required"`
+	WarmupSeconds float64 `json:"warmup_seconds"`
+	DrainSeconds  float64 `json:"drain_seconds"`
+}
+
+type WindowsResponse struct {
+	Success bool `json:"success"`
+}
+
+// FallbackRequest sets the zone fallback of a service: "any", "region" or "none".
+type FallbackRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Fallback string `json:"fallback" binding:"required"`
+}
+
+type FallbackResponse struct {
+	Success bool `json:"success"`
+}
+
+// TrafficRequest sets the traffic policy of a service, splitting its lookups between
+// instances by the value of Tag, in proportion to Weights. Without a tag, the policy is removed.
+type TrafficRequest struct {
+	Name    string         `json:"name" binding:"required"`
+	Tag     string         `json:"tag"`
+	Weights map[string]int `json:"weights,omitempty"`
+}
+
+type TrafficResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// TrafficInfo describes the traffic policy of a service.
+type TrafficInfo struct {
+	Name    string         `json:"name"`
+	Tag     string         `json:"tag"`
+	Weights map[string]int `json:"weights"`
+
+	// Instances is the number of instances up in each weighted group, and Share the fraction
+	// of lookups each group receives as a result. Groups without an instance receive none.
+	Instances map[string]int     `json:"instances"`
+	Share     map[string]float64 `json:"share"`
+}
+
+type TrafficPoliciesResponse struct {
+	Success  bool          `json:"success"`
+	Policies []TrafficInfo `json:"policies"`
+}
+
+// WebhookEvent is the body POSTed to a webhook for a change to the registry.
+// ID is the same for every attempt to deliver the event, so receivers can ignore repeats.
+type WebhookEvent struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Time     time.Time    `json:"time"`
+	Instance InstanceInfo `json:"instance"`
+}
+
+// DeadLetter is an event that could not be delivered to a webhook.
+type DeadLetter struct {
+	Webhook  string       `json:"webhook"`
+	Event    WebhookEvent `json:"event"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Failed   time.Time    `json:"failed"`
+}
+
+type DeadLettersResponse struct {
+	Success     bool         `json:"success"`
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// SnapshotVersion is the version of the Snapshot document format.
+const SnapshotVersion = 1
+
+// Snapshot is the state of a registry, from GET /admin/snapshot.
+// It may be restored with POST /admin/snapshot.
+type Snapshot struct {
+	Version        int       `json:"version"`
+	Created        time.Time `json:"created"`
+	TimeoutSeconds float64   `json:"timeout_seconds"`
+
+	// Policies, Strategies, Windows, Fallbacks and Traffic are those set for individual names.
+	Policies   map[string]string        `json:"policies,omitempty"`
+	Strategies map[string]string        `json:"strategies,omitempty"`
+	Windows    map[string]Windows       `json:"windows,omitempty"`
+	Fallbacks  map[string]string        `json:"fallbacks,omitempty"`
+	Traffic    map[string]TrafficPolicy `json:"traffic,omitempty"`
+
+	Instances []InstanceInfo `json:"instances"`
+}
+
+// Windows are the warmup and drain windows of a service, in a Snapshot.
+type Windows struct {
+	WarmupSeconds float64 `json:"warmup_seconds"`
+	DrainSeconds  float64 `json:"drain_seconds"`
+}
+
+// TrafficPolicy is the traffic policy of a service, in a Snapshot. See TrafficRequest.
+type TrafficPolicy struct {
+	Tag     string         `json:"tag"`
+	Weights map[string]int `json:"weights"`
+}
+
+type RestoreResponse struct {
+	Success  bool   `json:"success"`
+	Restored int    `json:"restored"`
+	Error    string `json:"error,omitempty"`
+}
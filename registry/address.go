@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Schemes with particular meaning to srsr. Other schemes, such as postgres,
+// are accepted if they name a host.
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+	SchemeGRPC  = "grpc"
+	SchemeTCP   = "tcp"
+	SchemeUnix  = "unix"
+)
+
+var (
+	ErrAddress      = errors.New("invalid address")
+	ErrPortConflict = errors.New("conflicting ports")
+)
+
+// Address is an instance address, split into its components.
+type Address struct {
+	Scheme string
+
+	// Host is a name or IP, without the brackets of an IPv6 address.
+	// It is empty for unix addresses.
+	Host string
+	Port string
+
+	// Path is the socket path of a unix address, or a base path, such as "/api".
+	Path string
+}
+
+// ParseAddress parses and normalizes an address. A bare "host:port" is taken to be http,
+// IPv6 hosts must be in brackets, and a unix address needs an absolute path,
+// as in "unix:///run/app.sock". Credentials, queries and fragments are refused.
+func ParseAddress(address string) (Address, error) {
+	if !strings.Contains(address, "://") && !strings.HasPrefix(strings.ToLower(address), SchemeUnix+":") {
+		return Address{}, fmt.Errorf("%w: %q has no scheme", ErrAddress, address)
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return Address{}, fmt.Errorf("%w: %v", ErrAddress, err)
+	}
+	if u.User != nil || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return Address{}, fmt.Errorf("%w: %q may not have credentials, a query or a fragment", ErrAddress, address)
+	}
+
+	a := Address{Scheme: strings.ToLower(u.Scheme)}
+	if a.Scheme == SchemeUnix {
+		if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+			return Address{}, fmt.Errorf("%w: %q needs an absolute socket path, as unix:///run/app.sock", ErrAddress, address)
+		}
+		a.Path = u.Path
+		return a, nil
+	}
+
+	a.Host = strings.ToLower(u.Hostname())
+	if a.Host == "" {
+		return Address{}, fmt.Errorf("%w: %q has no host", ErrAddress, address)
+	}
+	if strings.Contains(a.Host, ":") && (!strings.HasPrefix(u.Host, "[") || net.ParseIP(a.Host) == nil) {
+		return Address{}, fmt.Errorf("%w: %q must have its IPv6 host in brackets", ErrAddress, address)
+	}
+	if u.Port() != "" {
+		if a.Port, err = parsePort(u.Port()); err != nil {
+			return Address{}, err
+		}
+	}
+	if u.Path != "/" {
+		a.Path = u.Path
+	}
+	return a, nil
+}
+
+func parsePort(port string) (string, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("%w: invalid port %q", ErrAddress, port)
+	}
+	return strconv.Itoa(n), nil
+}
+
+// WithPort returns the address with port, which must agree with any port it already has.
+// An empty port leaves the address as it is.
+func (a Address) WithPort(port string) (Address, error) {
+	if port == "" {
+		return a, nil
+	}
+	if a.Scheme == SchemeUnix {
+		return a, fmt.Errorf("%w: unix address %s can't have port %s", ErrPortConflict, a, port)
+	}
+	port, err := parsePort(port)
+	if err != nil {
+		return a, err
+	}
+	if a.Port != "" && a.Port != port {
+		return a, fmt.Errorf("%w: address %s already has a port other than %s", ErrPortConflict, a, port)
+	}
+	a.Port = port
+	return a, nil
+}
+
+// HostPort returns the host and port, as for net.Dial, with brackets around an IPv6 host.
+func (a Address) HostPort() string {
+	if a.Port != "" {
+		return net.JoinHostPort(a.Host, a.Port)
+	}
+	if strings.Contains(a.Host, ":") {
+		return "[" + a.Host + "]"
+	}
+	return a.Host
+}
+
+// String returns the address as a URL.
+func (a Address) String() string {
+	u := url.URL{Scheme: a.Scheme, Host: a.HostPort(), Path: a.Path}
+	return u.String()
+}
@@ -0,0 +1,29 @@
+package registry
+
+import "time"
+
+// Clock tells the time, and waits, for a registry. Tests may use a fake clock,
+// like that of the clocktest package, to expire instances without waiting for real time to pass.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f after d, like time.AfterFunc. The registry takes its own lock in f,
+	// so a Clock must not call f while the registry is calling the Clock.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer made by a Clock, like a *time.Timer made by time.AfterFunc.
+type Timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// SystemClock is the real time. It is the Clock of a registry without WithClock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,142 @@
+// Package clocktest has a fake registry.Clock, whose time passes only when it is advanced,
+// for testing timeouts without waiting for them:
+//
+//	clock := clocktest.New(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+//	reg, _ := registry.New(registry.WithClock(clock), registry.WithTimeout(30*time.Second))
+//	reg.Register("orders", "http://10.0.0.1:8080")
+//	clock.Advance(30 * time.Second) // the instance has expired
+package clocktest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+// Clock is a fake registry.Clock. It is safe for concurrent use.
+type Clock struct {
+	mutex sync.Mutex
+	now   time.Time
+	// timers are the timers that have yet to fire.
+	timers []*timer
+	// scheduled counts the timers scheduled, to order those with the same deadline.
+	scheduled uint64
+}
+
+var _ registry.Clock = (*Clock)(nil)
+
+// New returns a clock that is stopped at now.
+func New(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f when the clock is advanced by at least d, or right away
+// on the next Advance, if d is not positive.
+func (c *Clock) AfterFunc(d time.Duration, f func()) registry.Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &timer{clock: c, f: f}
+	t.schedule(d)
+	return t
+}
+
+// Advance moves the clock forward by d. Each timer that is due by then is fired in turn,
+// in the order of their deadlines, with the clock set to its deadline. The functions
+// of the timers are called before Advance returns, so their effects can be checked
+// right away. A timer scheduled by one of them is also fired, if it is due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	for {
+		next := c.next(end)
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		next.stop()
+		c.mutex.Unlock()
+		next.f()
+		c.mutex.Lock()
+	}
+	c.now = end
+	c.mutex.Unlock()
+}
+
+// Pending returns the number of timers that have yet to fire.
+func (c *Clock) Pending() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+// next returns the timer due first, by end, if there is one.
+// Timers due at the same time fire in the order they were scheduled.
+// It must be called with the mutex held.
+func (c *Clock) next(end time.Time) *timer {
+	var next *timer
+	for _, t := range c.timers {
+		if !t.when.After(end) && (next == nil || t.when.Before(next.when) ||
+			(t.when.Equal(next.when) && t.seq < next.seq)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// timer is a timer of a Clock.
+type timer struct {
+	clock *Clock
+	f     func()
+	when  time.Time
+	seq   uint64
+	// active is whether the timer is in its clock's timers.
+	active bool
+}
+
+// schedule sets the timer to fire after d. It must be called with the clock's mutex held.
+func (t *timer) schedule(d time.Duration) {
+	if !t.active {
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	t.clock.scheduled++
+	t.when = t.clock.now.Add(max(d, 0))
+	t.seq = t.clock.scheduled
+	t.active = true
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.schedule(d)
+	return active
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.stop()
+	return active
+}
+
+// stop removes the timer from its clock. It must be called with the clock's mutex held.
+func (t *timer) stop() {
+	if !t.active {
+		return
+	}
+	t.active = false
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			break
+		}
+	}
+}
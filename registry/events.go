@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType identifies a change to the registry.
+type EventType string
+
+const (
+	// EventRegistered is a new instance.
+	EventRegistered EventType = "registered"
+	// EventUpdated is an instance registered again with its client-chosen ID.
+	EventUpdated EventType = "updated"
+	// EventDeregistered is an instance removed by Deregister.
+	EventDeregistered EventType = "deregistered"
+	// EventExpired is an instance removed for lack of heartbeats.
+	EventExpired EventType = "expired"
+	// EventReplaced is an instance removed by the registration policy, in favour of a new one.
+	EventReplaced EventType = "replaced"
+	// EventStatus is a change to an instance's status, other than by registering it again:
+	// into or out of maintenance, from warming to up, or into draining. The instance
+	// is removed from draining with EventDeregistered or EventExpired.
+	EventStatus EventType = "status"
+)
+
+// ParseEventType parses the name of an event type, such as "expired".
+func ParseEventType(s string) (EventType, error) {
+	switch t := EventType(s); t {
+	case EventRegistered, EventUpdated, EventDeregistered, EventExpired, EventReplaced, EventStatus:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown event type %q", s)
+}
+
+// Event describes a change to one instance. Instance is as it was after the change,
+// or just before it was removed.
+type Event struct {
+	Type     EventType
+	Instance Instance
+	Time     time.Time
+}
+
+// AddHook calls hook for every change to the registry, in order.
+// hook is called with the registry locked, so it must be quick,
+// and must not call the registry.
+func (s *ServiceRegistry) AddHook(hook func(Event)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// emit must be called with the mutex held.
+func (s *ServiceRegistry) emit(t EventType, instance Instance) {
+	s.wake(instance.Name)
+	if len(s.hooks) == 0 {
+		return
+	}
+	e := Event{Type: t, Instance: instance, Time: s.clock.Now()}
+	for _, hook := range s.hooks {
+		hook(e)
+	}
+}
@@ -0,0 +1,87 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"sync"
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/clocktest"
+)
+
+var _ = Describe("Events", func() {
+	const name = "flardmaster"
+	const address = "http://128.128.128.128:128"
+
+	var reg registry.Registry
+	var clock *clocktest.Clock
+	var mutex sync.Mutex
+	var events []registry.Event
+
+	types := func() []registry.EventType {
+		mutex.Lock()
+		defer mutex.Unlock()
+		t := []registry.EventType{}
+		for _, e := range events {
+			t = append(t, e.Type)
+		}
+		return t
+	}
+
+	BeforeEach(func() {
+		clock = clocktest.New(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+		reg, _ = registry.New(registry.WithClock(clock))
+		events = nil
+		reg.AddHook(func(e registry.Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, e)
+		})
+	})
+
+	Describe("ParseEventType", func() {
+		It("accepts known event types", func() {
+			t, err := registry.ParseEventType("expired")
+			Expect(err).To(BeNil())
+			Expect(t).To(Equal(registry.EventExpired))
+		})
+		It("rejects unknown event types", func() {
+			_, err := registry.ParseEventType("exploded")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	It("reports registration and deregistration", func() {
+		id, _ := reg.Register(name, address)
+		reg.Deregister(id)
+		Expect(types()).To(Equal([]registry.EventType{registry.EventRegistered, registry.EventDeregistered}))
+		Expect(events[1].Instance.ID).To(Equal(id))
+		Expect(events[1].Instance.Address).To(Equal(address))
+	})
+	It("reports updates", func() {
+		reg.RegisterInstance(registry.Instance{Name: name, Address: address, ID: "one"})
+		reg.RegisterInstance(registry.Instance{Name: name, Address: address, ID: "one"})
+		Expect(types()).To(Equal([]registry.EventType{registry.EventRegistered, registry.EventUpdated}))
+	})
+	It("reports replacements", func() {
+		reg.SetPolicy(name, registry.PolicyReplace)
+		first, _ := reg.Register(name, address)
+		reg.Register(name, address)
+		Expect(types()).To(Equal([]registry.EventType{registry.EventRegistered, registry.EventReplaced, registry.EventRegistered}))
+		Expect(events[1].Instance.ID).To(Equal(first))
+	})
+	It("reports status changes", func() {
+		id, _ := reg.Register(name, address)
+		reg.SetMaintenance(id, true)
+		reg.SetMaintenance(id, true)
+		Expect(types()).To(Equal([]registry.EventType{registry.EventRegistered, registry.EventStatus}))
+		Expect(events[1].Instance.Status).To(Equal(registry.StatusMaintenance))
+	})
+	It("reports expiry", func() {
+		reg.Register(name, address)
+		clock.Advance(reg.Timeout())
+		Expect(types()).To(Equal([]registry.EventType{registry.EventRegistered, registry.EventExpired}))
+	})
+})
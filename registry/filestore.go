@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// compactMin is the number of records a FileStore writes before it considers compacting.
+const compactMin = 1000
+
+// FileStore keeps instances in a single file, so they survive restarts.
+// It keeps a copy in memory, and appends each change to the file as a line of JSON.
+// When the file has grown to more than twice the records it needs, it is compacted,
+// by writing a new file and renaming it over the old.
+//
+// Changes are written to the operating system before they are reported as saved,
+// so they survive the process crashing, but are not synced to disk one by one.
+type FileStore struct {
+	*MemoryStore
+	path string
+	file *os.File
+	// records is the number of records in the file.
+	records int
+}
+
+// fileRecord is one line of a FileStore's file. Put records have an Instance,
+// and Delete records only an ID.
+type fileRecord struct {
+	Instance *Instance `json:",omitempty"`
+	ID       string    `json:",omitempty"`
+}
+
+// OpenFileStore opens the store at path, creating the file if it doesn't exist.
+func OpenFileStore(path string) (*FileStore, error) {
+	f := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+	unterminated, err := f.load()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if unterminated {
+		// The next record must start on a line of its own.
+		if _, err := file.WriteString("\n"); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	f.file = file
+	return f, nil
+}
+
+// load replays the records of the file, if there is one. It reports whether
+// the last record is complete, but has no newline after it.
+func (f *FileStore) load() (bool, error) {
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record fileRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				// A write cut short by a crash. The change was never reported as saved,
+				// so it is cut off, for the next record to start on a line of its own.
+				return false, os.Truncate(f.path, int64(len(data)-len(line)))
+			}
+			return false, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if record.Instance != nil {
+			f.MemoryStore.Put(*record.Instance)
+		} else {
+			f.MemoryStore.Delete(record.ID)
+		}
+		f.records++
+	}
+	return len(data) > 0 && data[len(data)-1] != '\n', nil
+}
+
+func (f *FileStore) Put(instance Instance) error {
+	if err := f.write(fileRecord{Instance: &instance}); err != nil {
+		return err
+	}
+	f.MemoryStore.Put(instance)
+	f.compact()
+	return nil
+}
+
+func (f *FileStore) Delete(id string) error {
+	if _, ok := f.instances[id]; !ok {
+		return nil
+	}
+	if err := f.write(fileRecord{ID: id}); err != nil {
+		return err
+	}
+	f.MemoryStore.Delete(id)
+	f.compact()
+	return nil
+}
+
+// write appends a record to the file.
+func (f *FileStore) write(record fileRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	f.records++
+	return nil
+}
+
+// compact rewrites the file with only the current instances, if it has grown enough.
+// If it fails, the old file is kept, and compaction is tried again after the next change.
+func (f *FileStore) compact() error {
+	if f.records < compactMin || f.records <= 2*f.Len() {
+		return nil
+	}
+	temp := f.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	encoder := json.NewEncoder(w)
+	instances := f.All()
+	for i := range instances {
+		if err := encoder.Encode(fileRecord{Instance: &instances[i]}); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(temp, f.path); err != nil {
+		file.Close()
+		return err
+	}
+	// The new file is already open for writing, and positioned at its end.
+	f.file.Close()
+	f.file = file
+	f.records = len(instances)
+	return nil
+}
+
+// Close closes the file. The store must not be used after.
+func (f *FileStore) Close() error {
+	return f.file.Close()
+}
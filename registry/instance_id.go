@@ -0,0 +1,26 @@
+package registry
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// validInstanceID matches client-chosen IDs, such as pod or host names.
+var validInstanceID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// ErrInvalidID is returned for a client-chosen ID that is empty, too long,
+// or contains characters other than letters, digits, '.', '_' and '-'.
+var ErrInvalidID = errors.New("instance ID must be 1-128 letters, digits, '.', '_' or '-', starting with a letter or digit")
+
+// InstanceID returns the registered ID for a client-chosen ID.
+// IDs are namespaced by service name, so services can't collide by choosing the same ID.
+func InstanceID(name string, id string) string {
+	return name + "/" + id
+}
+
+// IsChosenID reports whether a registered ID was chosen by the client, rather than generated.
+// Generated IDs are random, but chosen ones, like pod names, may be guessed.
+func IsChosenID(id string) bool {
+	return strings.Contains(id, "/")
+}
@@ -0,0 +1,114 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/clocktest"
+)
+
+var _ = Describe("Client-chosen instance IDs", func() {
+	const name = "flardmaster"
+	const address = "http://128.128.128.128:128"
+	const other_address = "http://129.129.129.129:129"
+
+	var reg registry.Registry
+
+	register := func(id string, address string) (string, registry.RegisterResult, error) {
+		return reg.RegisterInstance(registry.Instance{ID: id, Name: name, Address: address})
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+	})
+
+	It("tells chosen IDs from generated ones", func() {
+		chosen, _, _ := register("pod-7", address)
+		generated, _ := reg.Register(name, other_address)
+		Expect(registry.IsChosenID(chosen)).To(BeTrue())
+		Expect(registry.IsChosenID(generated)).To(BeFalse())
+	})
+	It("namespaces the ID by name", func() {
+		id, result, err := register("pod-7", address)
+		Expect(err).To(BeNil())
+		Expect(result).To(Equal(registry.ResultCreated))
+		Expect(id).To(Equal(registry.InstanceID(name, "pod-7")))
+		Expect(id).To(Equal("flardmaster/pod-7"))
+		Expect(reg.Heartbeat(id)).To(BeTrue())
+	})
+
+	It("lets different services choose the same ID", func() {
+		first, _, _ := register("pod-7", address)
+		second, _, err := reg.RegisterInstance(registry.Instance{ID: "pod-7", Name: "other", Address: address})
+		Expect(err).To(BeNil())
+		Expect(second).NotTo(Equal(first))
+		Expect(reg.Instances()).To(HaveLen(2))
+	})
+
+	DescribeTable("rejects invalid IDs",
+		func(id string) {
+			_, _, err := register(id, address)
+			Expect(err).To(MatchError(registry.ErrInvalidID))
+			Expect(reg.Instances()).To(BeEmpty())
+		},
+		Entry("with a slash", "a/b"),
+		Entry("with a space", "a b"),
+		Entry("starting with a dot", ".hidden"),
+		Entry("too long", string(make([]byte, 129))),
+	)
+
+	Context("registering again with the same ID", func() {
+		var id string
+
+		BeforeEach(func() {
+			id, _, _ = reg.RegisterInstance(registry.Instance{
+				ID:      "pod-7",
+				Name:    name,
+				Address: address,
+				Tags:    map[string]string{"version": "1"},
+			})
+		})
+
+		It("updates the existing entry", func() {
+			again, result, err := reg.RegisterInstance(registry.Instance{
+				ID:      "pod-7",
+				Name:    name,
+				Address: other_address,
+				Tags:    map[string]string{"version": "2"},
+			})
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultUpdated))
+			Expect(again).To(Equal(id))
+			instances := reg.Instances()
+			Expect(instances).To(HaveLen(1))
+			Expect(instances[0].Address).To(Equal(other_address))
+			Expect(instances[0].Tags).To(HaveKeyWithValue("version", "2"))
+		})
+
+		It("is not rejected by its own policy", func() {
+			reg.SetPolicy(name, registry.PolicySingleton)
+			_, result, err := register("pod-7", address)
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultUpdated))
+		})
+
+		It("resets the timeout", func() {
+			clock := clocktest.New(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+			reg, _ = registry.New(registry.WithClock(clock), registry.WithTimeout(2*time.Second))
+			id, _, _ = register("pod-8", address)
+			for i := 0; i < 4; i++ {
+				clock.Advance(time.Second)
+				register("pod-8", address)
+			}
+			clock.Advance(2*time.Second - time.Nanosecond)
+			_, ok := reg.Instance(id)
+			Expect(ok).To(BeTrue())
+			clock.Advance(time.Nanosecond)
+			_, ok = reg.Instance(id)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
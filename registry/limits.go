@@ -0,0 +1,39 @@
+package registry
+
+import "errors"
+
+// ErrLimit is returned when registering would exceed the limits set with SetLimits.
+var ErrLimit = errors.New("instance limit reached")
+
+// SetLimits caps the number of registered instances, in total and per name.
+// Zero means no limit. Instances already registered are not removed.
+// Draining instances are not counted, as they are on their way out.
+func (s *ServiceRegistry) SetLimits(maxInstances int, maxPerName int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxInstances = maxInstances
+	s.maxPerName = maxPerName
+}
+
+// checkLimits reports whether another instance of the name may be registered.
+// It must be called with the mutex held.
+func (s *ServiceRegistry) checkLimits(name string) error {
+	if s.maxInstances > 0 && live(s.store.All()) >= s.maxInstances {
+		return ErrLimit
+	}
+	if s.maxPerName > 0 && live(s.store.Name(name)) >= s.maxPerName {
+		return ErrLimit
+	}
+	return nil
+}
+
+// live counts the instances that aren't draining.
+func live(instances []Instance) int {
+	n := 0
+	for _, instance := range instances {
+		if instance.Status != StatusDraining {
+			n++
+		}
+	}
+	return n
+}
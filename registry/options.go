@@ -0,0 +1,46 @@
+package registry
+
+import "time"
+
+// Option configures a registry made by New.
+type Option func(*ServiceRegistry)
+
+// WithTimeout sets how long instances may go without a heartbeat before they expire.
+// The default is 30 seconds. It may be changed later with SetTimeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *ServiceRegistry) {
+		s.serviceTimeout = timeout
+	}
+}
+
+// WithClock sets the registry's clock. The default is SystemClock.
+func WithClock(clock Clock) Option {
+	return func(s *ServiceRegistry) {
+		s.clock = clock
+	}
+}
+
+// WithStrategy sets the lookup strategy for names without their own. The default is StrategyRandom.
+// It may be changed later with SetDefaultStrategy.
+func WithStrategy(strategy Strategy) Option {
+	return func(s *ServiceRegistry) {
+		s.defaultStrategy = strategy
+	}
+}
+
+// WithStore keeps the registry's instances in store, instead of a new MemoryStore.
+// Instances already in the store are kept, as if they had just sent a heartbeat,
+// except that draining instances are removed, and warming instances are put up.
+func WithStore(store Store) Option {
+	return func(s *ServiceRegistry) {
+		s.store = store
+	}
+}
+
+// WithHook calls hook for every change to the registry, as AddHook does.
+// It may be given more than once.
+func WithHook(hook func(Event)) Option {
+	return func(s *ServiceRegistry) {
+		s.hooks = append(s.hooks, hook)
+	}
+}
@@ -0,0 +1,77 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+// stoppedClock is the system clock, except that it is always noon.
+type stoppedClock struct {
+	registry.SystemClock
+}
+
+var noon = time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+
+func (stoppedClock) Now() time.Time {
+	return noon
+}
+
+var _ = Describe("New", func() {
+	It("has the same defaults as NewServiceRegistry", func() {
+		reg, err := registry.New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reg.Timeout()).To(Equal(30 * time.Second))
+		reg.Register("dungen", "http://localhost:5000")
+		Expect(reg.Lookup("dungen")).To(Equal("http://localhost:5000"))
+	})
+	It("sets the timeout", func() {
+		reg, _ := registry.New(registry.WithTimeout(time.Minute))
+		Expect(reg.Timeout()).To(Equal(time.Minute))
+	})
+	It("sets the clock", func() {
+		reg, _ := registry.New(registry.WithClock(stoppedClock{}))
+		id, _ := reg.Register("dungen", "http://localhost:5000")
+		instance, _ := reg.Instance(id)
+		Expect(instance.Registered).To(Equal(noon))
+		Expect(instance.LastHeartbeat).To(Equal(noon))
+	})
+	It("sets the default strategy", func() {
+		reg, _ := registry.New(registry.WithStrategy(registry.StrategyLeastLoaded))
+		idle, _ := reg.Register("dungen", "http://1.1.1.1:1")
+		busy, _ := reg.Register("dungen", "http://2.2.2.2:2")
+		reg.HeartbeatLoad(idle, registry.Load{InFlight: 1, Capacity: 10})
+		reg.HeartbeatLoad(busy, registry.Load{InFlight: 9, Capacity: 10})
+		for i := 0; i < 50; i++ {
+			Expect(reg.Lookup("dungen")).To(Equal("http://1.1.1.1:1"))
+		}
+	})
+	It("sets the store", func() {
+		store := registry.NewMemoryStore()
+		reg, _ := registry.New(registry.WithStore(store))
+		reg.Register("dungen", "http://localhost:5000")
+		Expect(store.Len()).To(Equal(1))
+	})
+	It("keeps instances already in the store", func() {
+		store := registry.NewMemoryStore()
+		store.Put(registry.Instance{ID: "1", Name: "dungen", Address: "http://localhost:5000", Status: registry.StatusWarming})
+		store.Put(registry.Instance{ID: "2", Name: "dungen", Address: "http://localhost:5001", Status: registry.StatusDraining})
+		reg, err := registry.New(registry.WithStore(store), registry.WithClock(stoppedClock{}))
+		Expect(err).NotTo(HaveOccurred())
+		instances := reg.Instances()
+		Expect(instances).To(HaveLen(1))
+		Expect(instances[0].Status).To(Equal(registry.StatusUp))
+		Expect(instances[0].LastHeartbeat).To(Equal(noon))
+	})
+	It("adds hooks", func() {
+		var events []registry.EventType
+		reg, _ := registry.New(
+			registry.WithHook(func(e registry.Event) { events = append(events, e.Type) }),
+			registry.WithHook(func(e registry.Event) { events = append(events, e.Type) }))
+		reg.Register("dungen", "http://localhost:5000")
+		Expect(events).To(Equal([]registry.EventType{registry.EventRegistered, registry.EventRegistered}))
+	})
+})
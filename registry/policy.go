@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Policy decides what happens when a service registers while
+// other instances with the same name are registered.
+type Policy string
+
+const (
+	// PolicyAllow registers a new instance, even with the same address as another.
+	PolicyAllow Policy = "allow"
+	// PolicyReplace removes any instance with the same address, then registers.
+	PolicyReplace Policy = "replace"
+	// PolicyReject refuses to register an instance with the same address as another.
+	PolicyReject Policy = "reject"
+	// PolicySingleton allows one instance per name. Registering with the same address
+	// replaces it, and registering with a different address is refused.
+	PolicySingleton Policy = "singleton"
+)
+
+// RegisterResult reports what a registration did.
+type RegisterResult string
+
+const (
+	ResultCreated  RegisterResult = "created"
+	ResultReplaced RegisterResult = "replaced"
+	ResultUpdated  RegisterResult = "updated"
+	ResultRejected RegisterResult = "rejected"
+)
+
+// ErrConflict is returned when a policy refuses a registration.
+var ErrConflict = errors.New("registration conflicts with a registered instance")
+
+// ErrStatic is returned when a change to a static instance is refused.
+var ErrStatic = errors.New("static instances may only be changed by admins")
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyAllow, PolicyReplace, PolicyReject, PolicySingleton:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown policy %q", s)
+}
+
+// resolveConflicts applies the policy for an instance at address, removing replaced instances.
+// self is the ID of the instance being updated, if any, which never conflicts with itself.
+// It must be called with the mutex held.
+func (s *ServiceRegistry) resolveConflicts(name string, address string, self string) (RegisterResult, error) {
+	// Draining instances conflict with nothing, but are replaced like any other.
+	var same []Instance
+	live, others := 0, 0
+	for _, e := range s.store.Name(name) {
+		if e.ID == self {
+			continue
+		}
+		draining := e.Status == StatusDraining
+		if e.Address == address {
+			same = append(same, e)
+			if !draining {
+				live++
+			}
+		} else if !draining {
+			others++
+		}
+	}
+
+	switch s.policy(name) {
+	case PolicyReject:
+		if live > 0 {
+			return ResultRejected, ErrConflict
+		}
+	case PolicySingleton:
+		if others > 0 {
+			return ResultRejected, ErrConflict
+		}
+		fallthrough
+	case PolicyReplace:
+		for _, e := range same {
+			if e.Static {
+				return ResultRejected, ErrStatic
+			}
+		}
+		for _, e := range same {
+			if err := s.remove(e.ID); err != nil {
+				return ResultRejected, err
+			}
+			s.emit(EventReplaced, e)
+		}
+		if len(same) > 0 {
+			return ResultReplaced, nil
+		}
+	}
+	return ResultCreated, nil
+}
+
+// policy must be called with the mutex held.
+func (s *ServiceRegistry) policy(name string) Policy {
+	if p, ok := s.policies[name]; ok {
+		return p
+	}
+	return s.defaultPolicy
+}
+
+func (s *ServiceRegistry) SetPolicy(name string, policy Policy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.policies[name] = policy
+}
+
+func (s *ServiceRegistry) SetDefaultPolicy(policy Policy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultPolicy = policy
+}
@@ -0,0 +1,126 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+var _ = Describe("Policy", func() {
+	const name = "flardmaster"
+	const address = "http://128.128.128.128:128"
+	const other_address = "http://129.129.129.129:129"
+
+	var reg registry.Registry
+	var first_id string
+
+	register := func(address string) (string, registry.RegisterResult, error) {
+		return reg.RegisterInstance(registry.Instance{Name: name, Address: address})
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+	})
+
+	Describe("ParsePolicy", func() {
+		It("accepts known policies", func() {
+			p, err := registry.ParsePolicy("singleton")
+			Expect(err).To(BeNil())
+			Expect(p).To(Equal(registry.PolicySingleton))
+		})
+		It("rejects unknown policies", func() {
+			_, err := registry.ParsePolicy("anarchy")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	When("allowing duplicates", func() {
+		It("is the default", func() {
+			first_id, _, _ = register(address)
+			id, result, err := register(address)
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultCreated))
+			Expect(id).NotTo(Equal(first_id))
+			Expect(reg.Instances()).To(HaveLen(2))
+		})
+	})
+
+	When("replacing", func() {
+		BeforeEach(func() {
+			reg.SetPolicy(name, registry.PolicyReplace)
+			first_id, _, _ = register(address)
+		})
+		It("replaces an instance with the same address", func() {
+			id, result, err := register(address)
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultReplaced))
+			Expect(reg.Instances()).To(HaveLen(1))
+			Expect(reg.Instances()[0].ID).To(Equal(id))
+			Expect(reg.Heartbeat(first_id)).To(BeFalse())
+		})
+		It("keeps instances with other addresses", func() {
+			_, result, _ := register(other_address)
+			Expect(result).To(Equal(registry.ResultCreated))
+			Expect(reg.Instances()).To(HaveLen(2))
+		})
+	})
+
+	When("rejecting", func() {
+		BeforeEach(func() {
+			reg.SetPolicy(name, registry.PolicyReject)
+			first_id, _, _ = register(address)
+		})
+		It("rejects an instance with the same address", func() {
+			_, result, err := register(address)
+			Expect(err).To(MatchError(registry.ErrConflict))
+			Expect(result).To(Equal(registry.ResultRejected))
+			Expect(reg.Instances()).To(HaveLen(1))
+			Expect(reg.Instances()[0].ID).To(Equal(first_id))
+		})
+		It("allows instances with other addresses", func() {
+			_, _, err := register(other_address)
+			Expect(err).To(BeNil())
+		})
+	})
+
+	When("singleton", func() {
+		BeforeEach(func() {
+			reg.SetPolicy(name, registry.PolicySingleton)
+			first_id, _, _ = register(address)
+		})
+		It("rejects an instance with another address", func() {
+			_, result, err := register(other_address)
+			Expect(err).To(MatchError(registry.ErrConflict))
+			Expect(result).To(Equal(registry.ResultRejected))
+			Expect(reg.Lookup(name)).To(Equal(address))
+		})
+		It("replaces an instance with the same address", func() {
+			_, result, err := register(address)
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultReplaced))
+			Expect(reg.Instances()).To(HaveLen(1))
+		})
+		It("allows another address once the first is gone", func() {
+			reg.Deregister(first_id)
+			_, _, err := register(other_address)
+			Expect(err).To(BeNil())
+		})
+	})
+
+	When("a default policy is set", func() {
+		It("applies to names without their own policy", func() {
+			reg.SetDefaultPolicy(registry.PolicyReject)
+			register(address)
+			_, _, err := register(address)
+			Expect(err).To(MatchError(registry.ErrConflict))
+		})
+		It("does not override a name's own policy", func() {
+			reg.SetDefaultPolicy(registry.PolicyReject)
+			reg.SetPolicy(name, registry.PolicyAllow)
+			register(address)
+			_, _, err := register(address)
+			Expect(err).To(BeNil())
+		})
+	})
+})
@@ -1,9 +1,12 @@
+// Package registry keeps the instances of services registered with srsr,
+// expires them without heartbeats, and chooses one for each lookup.
+// To embed a registry in another program, see New.
 package registry
 
 import (
+	"context"
 	"errors"
-	"math/rand"
-	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,134 +15,635 @@ import (
 
 const defaultTimeout = 30 * time.Second
 
+const (
+	// StatusUp instances are returned by lookups.
+	StatusUp = "up"
+	// StatusMaintenance instances remain registered, but are not returned by lookups.
+	StatusMaintenance = "maintenance"
+	// StatusWarming instances are new, and not yet returned by lookups. See Windows.
+	StatusWarming = "warming"
+	// StatusDraining instances are being removed, and no longer returned by lookups. See Windows.
+	StatusDraining = "draining"
+)
+
 type Registry interface {
 	Register(name string, address string) (string, error)
+
+	// RegisterInstance registers using the Name, Address and Tags of instance,
+	// subject to the policy for the name. It returns the ID, and what was done.
+	// If instance.ID is set, it is a client-chosen ID, registered as InstanceID(Name, ID).
+	// Registering again with the same ID updates the existing entry.
+	// If instance.Static is set, the instance never expires.
+	// If the Store fails to save the instance, the error wraps ErrStorage.
+	RegisterInstance(instance Instance) (string, RegisterResult, error)
+	// RegisterBatch registers each instance as RegisterInstance would, holding the lock once.
+	// The results are in the same order as instances.
+	RegisterBatch(instances []Instance) []Registration
+
+	// SetPolicy sets the registration policy for one name.
+	SetPolicy(name string, policy Policy)
+	// SetDefaultPolicy sets the policy for names without their own. It is PolicyAllow initially.
+	SetDefaultPolicy(policy Policy)
+
+	// Deregister removes an instance, after the drain window of its service.
+	// Static instances are refused with ErrStatic.
 	Deregister(id string) error
+	// ForceDeregister removes any instance at once, including static ones. It is for admins.
+	ForceDeregister(id string) error
 	Lookup(name string) string
+
+	// LookupInstance selects an instance of the named service the same way Lookup does,
+	// ignoring any instance for which skip returns true. skip may be nil.
+	LookupInstance(name string, skip func(Instance) bool) (Instance, bool)
+	// LookupNear is LookupInstance for a caller at near. It prefers instances in the caller's zone,
+	// and falls back to others, when none are healthy there, as the name's Fallback allows.
+	LookupNear(name string, near Locality, skip func(Instance) bool) (Instance, bool)
+	// LookupWait is LookupNear, but if no instance is found, it waits until one is,
+	// or until ctx is done.
+	LookupWait(ctx context.Context, name string, near Locality, skip func(Instance) bool) (Instance, bool)
+
+	// Instances returns every registered instance, ordered by name.
+	Instances() []Instance
+	// Instance returns the instance with the ID, if it is registered.
+	Instance(id string) (Instance, bool)
+
+	// SetMaintenance puts an instance into or out of maintenance.
+	SetMaintenance(id string, maintenance bool) error
+
 	Heartbeat(id string) bool
+	// HeartbeatLoad is a heartbeat that also reports the instance's load.
+	HeartbeatLoad(id string, load Load) bool
+	// HeartbeatBatch sends each heartbeat, holding the lock once.
+	// It reports whether each ID was known, in the same order as beats.
+	HeartbeatBatch(beats []Beat) []bool
+
+	// SetWindows sets the warmup and drain windows for one name.
+	SetWindows(name string, windows Windows)
+	// SetDefaultWindows sets the windows for names without their own. They are zero initially.
+	SetDefaultWindows(windows Windows)
+
+	// SetStrategy sets the lookup strategy for one name.
+	SetStrategy(name string, strategy Strategy)
+	// SetDefaultStrategy sets the strategy for names without their own. It is StrategyRandom initially.
+	SetDefaultStrategy(strategy Strategy)
+
+	// SetFallback sets the zone fallback for one name.
+	SetFallback(name string, fallback Fallback)
+	// SetDefaultFallback sets the fallback for names without their own. It is FallbackAny initially.
+	SetDefaultFallback(fallback Fallback)
+
+	// SetTraffic splits the lookups of one name between groups of its instances. See TrafficPolicy.
+	// Invalid policies are refused with ErrTraffic.
+	SetTraffic(name string, policy TrafficPolicy) error
+	// ClearTraffic removes the traffic policy of a name.
+	ClearTraffic(name string)
+	// Traffic returns the traffic policies, by name.
+	Traffic() map[string]TrafficPolicy
+
+	// SetLimits caps the number of instances, in total and per name. Zero means no limit.
+	// Registrations over a limit fail with ErrLimit.
+	SetLimits(maxInstances int, maxPerName int)
+
+	// Snapshot returns every instance, and the policies and strategies of individual names.
+	Snapshot() Snapshot
+	// Restore registers the instances of a snapshot, keeping their IDs.
+	Restore(snapshot Snapshot, mode RestoreMode, resetDeadlines bool) error
+
+	// AddHook calls hook for every change to the registry.
+	// hook is called with the registry locked, so it must not call the registry.
+	AddHook(hook func(Event))
+
 	SetTimeout(duration time.Duration)
+	Timeout() time.Duration
 }
 
-type service_entry struct {
-	ID      string
-	Name    string
+// Instance describes one registered instance of a service.
+type Instance struct {
+	ID   string
+	Name string
+
+	// Address is the normalized URL of the instance, and Parsed its components.
+	// Parsed is filled in on registration.
 	Address string
+	Parsed  Address
+
+	Tags   map[string]string
+	Status string
+
+	// Locality is where the instance runs, for zone-aware lookups.
+	Locality
+
+	// Static instances never expire, and may only be removed by ForceDeregister.
+	// They suit dependencies that can't send heartbeats, like a managed database.
+	Static bool
 
-	// Cancel is signalled when deregistering, so the timer and goroutine can be deallocated.
-	Cancel chan int
+	Registered    time.Time
+	LastHeartbeat time.Time
 
-	// Reset is signalled when a heartbeat is received, to reset the timer.
-	Reset chan int
+	// Load is the load last reported with a heartbeat, at LoadReported.
+	Load         Load
+	LoadReported time.Time
 }
 
-func NewServiceEntry(name string, address string) *service_entry {
-	id := uuid.NewString()
-	entry := service_entry{ID: id,
-		Name:    name,
-		Address: address,
+// Registration is the outcome of registering one instance of a batch.
+type Registration struct {
+	ID     string
+	Result RegisterResult
+	Err    error
+}
 
-		// Cancel has a buffer so that it can be signalled from Deregister
-		// without blocking, when Deregister is called due to timeout.
-		Cancel: make(chan int, 1),
-		Reset:  make(chan int),
-	}
-	return &entry
+// Beat is one heartbeat of a batch. Load may be nil.
+type Beat struct {
+	ID   string
+	Load *Load
+}
+
+// service_entry is the runtime state of a registered instance, which is kept in the Store.
+type service_entry struct {
+	// drainUntil is when a draining entry is removed, emitting drainEvent.
+	drainUntil time.Time
+	drainEvent EventType
+
+	// timer expires the entry, unless heartbeats reset it. Static entries have none.
+	timer Timer
 }
 
-type service_registry struct {
-	mutex          sync.Mutex
-	store          map[string]*service_entry
-	nameStore      map[string][]*service_entry
+var _ Registry = (*ServiceRegistry)(nil)
+
+func newServiceEntry() *service_entry {
+	return &service_entry{}
+}
+
+// ServiceRegistry is the Registry of srsr. It is safe for concurrent use.
+// Make one with New.
+type ServiceRegistry struct {
+	mutex sync.Mutex
+	clock Clock
+	store Store
+	// entries maps the ID of each stored instance to its runtime state.
+	entries        map[string]*service_entry
 	serviceTimeout time.Duration
+	policies       map[string]Policy
+	defaultPolicy  Policy
+
+	strategies      map[string]Strategy
+	defaultStrategy Strategy
+
+	windowsByName  map[string]Windows
+	defaultWindows Windows
+
+	fallbacks       map[string]Fallback
+	defaultFallback Fallback
+
+	traffic map[string]TrafficPolicy
+
+	// waiters are woken by any change to an instance of their name.
+	waiters map[string][]chan struct{}
+
+	maxInstances int
+	maxPerName   int
+
+	hooks []func(Event)
 }
 
-func NewServiceRegistry() *service_registry {
-	sr := service_registry{}
-	// map ID to entry
-	sr.store = make(map[string]*service_entry)
-	// map name to entries
-	sr.nameStore = make(map[string][]*service_entry)
+// NewServiceRegistry returns a registry with the default options,
+// which keeps its instances in memory.
+func NewServiceRegistry() *ServiceRegistry {
+	// Without WithStore, New can't fail.
+	sr, _ := New()
+	return sr
+}
+
+// New returns a registry configured by opts. It fails only if the Store
+// given with WithStore fails as its instances are loaded.
+func New(opts ...Option) (*ServiceRegistry, error) {
+	sr := ServiceRegistry{}
+	sr.clock = SystemClock{}
+	sr.entries = make(map[string]*service_entry)
 	sr.serviceTimeout = defaultTimeout
-	return &sr
+	sr.policies = make(map[string]Policy)
+	sr.defaultPolicy = PolicyAllow
+	sr.strategies = make(map[string]Strategy)
+	sr.defaultStrategy = StrategyRandom
+	sr.windowsByName = make(map[string]Windows)
+	sr.fallbacks = make(map[string]Fallback)
+	sr.defaultFallback = FallbackAny
+	sr.traffic = make(map[string]TrafficPolicy)
+	sr.waiters = make(map[string][]chan struct{})
+	for _, opt := range opts {
+		opt(&sr)
+	}
+	if sr.store == nil {
+		sr.store = NewMemoryStore()
+	}
+	if err := sr.load(); err != nil {
+		return nil, err
+	}
+	return &sr, nil
 }
 
-func (s *service_registry) Register(name string, address string) (string, error) {
-	// Do nothing if the address isn't a valid absolute URI
-	_, err := url.ParseRequestURI(address)
+// load starts watching the instances already in the store.
+func (s *ServiceRegistry) load() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.clock.Now()
+	for _, instance := range s.store.All() {
+		if instance.Status == StatusDraining {
+			if err := s.store.Delete(instance.ID); err != nil {
+				return storageError(err)
+			}
+			continue
+		}
+		if instance.Status == StatusWarming {
+			instance.Status = StatusUp
+		}
+		instance.LastHeartbeat = now
+		if err := s.store.Put(instance); err != nil {
+			return storageError(err)
+		}
+		entry := newServiceEntry()
+		s.entries[instance.ID] = entry
+		if !instance.Static {
+			s.watch(instance.ID, entry, s.serviceTimeout)
+		}
+	}
+	return nil
+}
+
+func (s *ServiceRegistry) Register(name string, address string) (string, error) {
+	id, _, err := s.RegisterInstance(Instance{Name: name, Address: address})
+	return id, err
+}
+
+func (s *ServiceRegistry) RegisterInstance(instance Instance) (string, RegisterResult, error) {
+	id, err := validate(&instance)
 	if err != nil {
-		return "", err
+		return "", ResultRejected, err
 	}
 
-	entry := NewServiceEntry(name, address)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.register(instance, id)
+}
+
+func (s *ServiceRegistry) RegisterBatch(instances []Instance) []Registration {
+	// Copied, since validation normalizes the addresses.
+	instances = append([]Instance(nil), instances...)
+	ids := make([]string, len(instances))
+	registrations := make([]Registration, len(instances))
+	for i := range instances {
+		ids[i], registrations[i].Err = validate(&instances[i])
+		if registrations[i].Err != nil {
+			registrations[i].Result = ResultRejected
+		}
+	}
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	for i, instance := range instances {
+		if registrations[i].Err == nil {
+			r := &registrations[i]
+			r.ID, r.Result, r.Err = s.register(instance, ids[i])
+		}
+	}
+	return registrations
+}
 
-	s.store[entry.ID] = entry
-	_, ok := s.nameStore[name]
-	if !ok {
-		s.nameStore[name] = make([]*service_entry, 0, 1)
+// validate checks the instance's address and ID, normalizing the address,
+// and returns the ID to register, which is empty unless the client chose one.
+func validate(instance *Instance) (string, error) {
+	parsed, err := ParseAddress(instance.Address)
+	if err != nil {
+		return "", err
 	}
-	s.nameStore[name] = append(s.nameStore[name], entry)
+	instance.Address = parsed.String()
+	instance.Parsed = parsed
 
-	// Goroutine to handle automatic deregistration, in the absence of heartbeats
-	go func() {
-		var keepGoing = true
-		timer := time.NewTimer(s.serviceTimeout)
+	if instance.ID == "" {
+		return "", nil
+	}
+	if !validInstanceID.MatchString(instance.ID) {
+		return "", ErrInvalidID
+	}
+	return InstanceID(instance.Name, instance.ID), nil
+}
 
-		for keepGoing {
-			select {
-			case <-timer.C:
-				s.Deregister(entry.ID)
-				keepGoing = false
+// register must be called with the mutex held, after validate.
+func (s *ServiceRegistry) register(instance Instance, id string) (string, RegisterResult, error) {
+	name := instance.Name
 
-			case <-entry.Reset:
-				timer.Reset(s.serviceTimeout)
+	if existing, ok := s.store.Get(id); ok {
+		return s.update(existing, instance)
+	}
 
-			case <-entry.Cancel:
-				keepGoing = false
-				timer.Stop()
+	result, err := s.resolveConflicts(name, instance.Address, "")
+	if err != nil {
+		return "", result, err
+	}
+	// Checked after resolving conflicts, so that a replacement is not refused.
+	if err := s.checkLimits(name); err != nil {
+		return "", ResultRejected, err
+	}
+
+	if id == "" {
+		id = uuid.NewString()
+	}
+	now := s.clock.Now()
+	registered := Instance{
+		ID:            id,
+		Name:          name,
+		Address:       instance.Address,
+		Parsed:        instance.Parsed,
+		Tags:          copyTags(instance.Tags),
+		Locality:      instance.Locality,
+		Static:        instance.Static,
+		Registered:    now,
+		LastHeartbeat: now,
+	}
+	entry := newServiceEntry()
+	s.startWarmup(&registered, entry)
+
+	if err := s.store.Put(registered); err != nil {
+		return "", ResultRejected, storageError(err)
+	}
+	s.entries[id] = entry
+	s.emit(EventRegistered, registered)
+	if !registered.Static {
+		s.watch(id, entry, s.serviceTimeout)
+	}
+
+	return id, result, nil
+}
+
+// watch starts a timer to deregister the entry automatically, in the absence of heartbeats.
+// The entry expires after timeout, unless it is reset. It must be called with the mutex held.
+func (s *ServiceRegistry) watch(id string, entry *service_entry, timeout time.Duration) {
+	entry.timer = s.clock.AfterFunc(timeout, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if remaining := s.expire(id, entry); remaining > 0 {
+			entry.timer.Reset(remaining)
+		}
+	})
+}
+
+// update re-registers an existing instance with a client-chosen ID.
+// It must be called with the mutex held.
+func (s *ServiceRegistry) update(existing Instance, instance Instance) (string, RegisterResult, error) {
+	if existing.Static != instance.Static {
+		return "", ResultRejected, ErrStatic
+	}
+	result, err := s.resolveConflicts(existing.Name, instance.Address, existing.ID)
+	if err != nil {
+		return "", result, err
+	}
+	entry := s.entries[existing.ID]
+	existing.Address = instance.Address
+	existing.Parsed = instance.Parsed
+	existing.Tags = copyTags(instance.Tags)
+	existing.Locality = instance.Locality
+	existing.LastHeartbeat = s.clock.Now()
+	if existing.Status == StatusDraining {
+		// Registered again before it was removed, as by a restart.
+		s.startWarmup(&existing, entry)
+	}
+	if err := s.store.Put(existing); err != nil {
+		return "", ResultRejected, storageError(err)
+	}
+	s.reset(entry)
+	s.emit(EventUpdated, existing)
+	return existing.ID, ResultUpdated, nil
+}
+
+// reset resets the entry's timeout. It must be called with the mutex held,
+// after saving the instance's LastHeartbeat.
+func (s *ServiceRegistry) reset(entry *service_entry) {
+	if entry.timer != nil {
+		entry.timer.Reset(s.serviceTimeout)
+	}
+}
+
+// retryStorage is how long to wait before expiring an instance again,
+// if the Store failed to save its expiry.
+const retryStorage = time.Second
+
+// expire drains the entry if it has gone without a heartbeat for the timeout,
+// and removes it once it has drained. Otherwise, it returns the time remaining.
+// It must be called with the mutex held.
+func (s *ServiceRegistry) expire(id string, entry *service_entry) time.Duration {
+	instance, ok := s.store.Get(id)
+	if !ok || s.entries[id] != entry {
+		return 0
+	}
+	if instance.Status == StatusDraining {
+		remaining := entry.drainUntil.Sub(s.clock.Now())
+		if remaining <= 0 {
+			if s.remove(id) != nil {
+				return retryStorage
 			}
+			s.emit(entry.drainEvent, instance)
+		}
+		return remaining
+	}
+	remaining := s.serviceTimeout - s.clock.Now().Sub(instance.LastHeartbeat)
+	if remaining <= 0 {
+		if s.drain(instance, EventExpired) != nil {
+			return retryStorage
 		}
-	}()
+		if drained, ok := s.store.Get(id); ok && drained.Status == StatusDraining {
+			return entry.drainUntil.Sub(s.clock.Now())
+		}
+	}
+	return remaining
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
 
-	return entry.ID, nil
+func (s *ServiceRegistry) Lookup(name string) string {
+	instance, _ := s.LookupInstance(name, nil)
+	return instance.Address
 }
 
-func (s *service_registry) Lookup(name string) string {
+func (s *ServiceRegistry) LookupInstance(name string, skip func(Instance) bool) (Instance, bool) {
+	return s.LookupNear(name, Locality{}, skip)
+}
+
+func (s *ServiceRegistry) LookupNear(name string, near Locality, skip func(Instance) bool) (Instance, bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	entries, ok := s.nameStore[name]
-	if ok {
-		return entries[rand.Intn(len(entries))].Address
+	return s.lookup(name, near, skip)
+}
+
+// lookup must be called with the mutex held.
+func (s *ServiceRegistry) lookup(name string, near Locality, skip func(Instance) bool) (Instance, bool) {
+	instances := s.store.Name(name)
+	candidates := make([]Instance, 0, len(instances))
+	for _, instance := range instances {
+		if instance.Status != StatusUp {
+			continue
+		}
+		if skip == nil || !skip(instance) {
+			candidates = append(candidates, instance)
+		}
+	}
+	candidates = s.split(name, nearest(candidates, near, s.fallback(name)))
+	if len(candidates) == 0 {
+		return Instance{}, false
 	}
-	return ""
+	return choose(s.strategy(name), candidates), true
 }
 
-func (s *service_registry) Deregister(id string) error {
+func (s *ServiceRegistry) Deregister(id string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	idEntry, ok := s.store[id]
+	instance, ok := s.store.Get(id)
 	if ok {
-		idEntry.Cancel <- 1
-		delete(s.store, id)
-		delete(s.nameStore, idEntry.Name)
-		return nil
+		if instance.Static {
+			return ErrStatic
+		}
+		return s.drain(instance, EventDeregistered)
 	}
 	return errors.New("Deregister - no match for ID")
 }
 
-func (s *service_registry) Heartbeat(id string) bool {
+func (s *ServiceRegistry) ForceDeregister(id string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	entry, ok := s.store[id]
+	instance, ok := s.store.Get(id)
 	if ok {
-		entry.Reset <- 1
-		return true
+		if err := s.remove(id); err != nil {
+			return err
+		}
+		s.emit(EventDeregistered, instance)
+		return nil
+	}
+	return errors.New("ForceDeregister - no match for ID")
+}
+
+func (s *ServiceRegistry) Instances() []Instance {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.instances()
+}
+
+// instances must be called with the mutex held.
+func (s *ServiceRegistry) instances() []Instance {
+	instances := s.store.All()
+	sort.SliceStable(instances, func(i, j int) bool {
+		if instances[i].Name != instances[j].Name {
+			return instances[i].Name < instances[j].Name
+		}
+		return instances[i].Registered.Before(instances[j].Registered)
+	})
+	return instances
+}
+
+func (s *ServiceRegistry) Instance(id string) (Instance, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Get(id)
+}
+
+func (s *ServiceRegistry) SetMaintenance(id string, maintenance bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	instance, ok := s.store.Get(id)
+	if !ok {
+		return errors.New("SetMaintenance - no match for ID")
+	}
+	if instance.Status == StatusDraining {
+		return errors.New("SetMaintenance - instance is draining")
+	}
+	status := StatusUp
+	if maintenance {
+		status = StatusMaintenance
+	}
+	if instance.Status != status {
+		instance.Status = status
+		if err := s.store.Put(instance); err != nil {
+			return storageError(err)
+		}
+		s.emit(EventStatus, instance)
+	}
+	return nil
+}
+
+// remove deletes the instance from the store, and stops its timer.
+// It must be called with the mutex held.
+func (s *ServiceRegistry) remove(id string) error {
+	if err := s.store.Delete(id); err != nil {
+		return storageError(err)
+	}
+	if entry, ok := s.entries[id]; ok {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		delete(s.entries, id)
+	}
+	return nil
+}
+
+func (s *ServiceRegistry) Heartbeat(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.beat(id, nil)
+}
+
+func (s *ServiceRegistry) HeartbeatBatch(beats []Beat) []bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	known := make([]bool, len(beats))
+	for i, b := range beats {
+		known[i] = s.beat(b.ID, b.Load)
 	}
-	return false
+	return known
 }
 
-func (s *service_registry) SetTimeout(duration time.Duration) {
+// beat resets the timeout of the instance with the ID, ends its warmup,
+// and records the load if it is not nil. It reports false if the ID is unknown,
+// or the heartbeat could not be saved. It must be called with the mutex held.
+func (s *ServiceRegistry) beat(id string, load *Load) bool {
+	instance, ok := s.store.Get(id)
+	if !ok || instance.Status == StatusDraining {
+		return false
+	}
+	now := s.clock.Now()
+	warmed := instance.Status == StatusWarming
+	if warmed {
+		instance.Status = StatusUp
+	}
+	instance.LastHeartbeat = now
+	if load != nil {
+		instance.Load = *load
+		instance.LoadReported = now
+	}
+	if s.store.Put(instance) != nil {
+		return false
+	}
+	s.reset(s.entries[id])
+	if warmed {
+		s.emit(EventStatus, instance)
+	}
+	return true
+}
+
+func (s *ServiceRegistry) SetTimeout(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.serviceTimeout = duration
 }
+
+func (s *ServiceRegistry) Timeout() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.serviceTimeout
+}
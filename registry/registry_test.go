@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/clocktest"
 )
 
 var _ = Describe("Registry", func() {
@@ -59,6 +60,86 @@ var _ = Describe("Registry", func() {
 		})
 	})
 
+	Describe("RegisterBatch", func() {
+		It("returns a result for each instance, in order", func() {
+			registrations := reg.RegisterBatch([]registry.Instance{
+				{Name: "flardmaster", Address: "http://1.1.1.1:1"},
+				{Name: "flardmaster", Address: "not a URI"},
+				{Name: "dungen", Address: "http://2.2.2.2:2", ID: "host-1"},
+			})
+			Expect(registrations).To(HaveLen(3))
+			Expect(registrations[0].Err).To(BeNil())
+			Expect(registrations[0].Result).To(Equal(registry.ResultCreated))
+			Expect(registrations[1].Err).NotTo(BeNil())
+			Expect(registrations[1].Result).To(Equal(registry.ResultRejected))
+			Expect(registrations[2].ID).To(Equal("dungen/host-1"))
+			Expect(reg.Instances()).To(HaveLen(2))
+		})
+		It("applies policies between instances of the batch", func() {
+			reg.SetPolicy("flardmaster", registry.PolicySingleton)
+			registrations := reg.RegisterBatch([]registry.Instance{
+				{Name: "flardmaster", Address: "http://1.1.1.1:1"},
+				{Name: "flardmaster", Address: "http://2.2.2.2:2"},
+			})
+			Expect(registrations[0].Err).To(BeNil())
+			Expect(registrations[1].Err).To(MatchError(registry.ErrConflict))
+		})
+	})
+
+	Describe("SetLimits", func() {
+		BeforeEach(func() {
+			reg.SetLimits(3, 2)
+		})
+
+		It("limits instances per name", func() {
+			reg.Register("flardmaster", "http://1.1.1.1:1")
+			reg.Register("flardmaster", "http://2.2.2.2:2")
+			_, err := reg.Register("flardmaster", "http://3.3.3.3:3")
+			Expect(err).To(MatchError(registry.ErrLimit))
+		})
+		It("limits instances in total", func() {
+			reg.Register("a", "http://1.1.1.1:1")
+			reg.Register("b", "http://1.1.1.1:1")
+			reg.Register("c", "http://1.1.1.1:1")
+			_, err := reg.Register("d", "http://1.1.1.1:1")
+			Expect(err).To(MatchError(registry.ErrLimit))
+		})
+		It("allows registering again after deregistering", func() {
+			id, _ := reg.Register("flardmaster", "http://1.1.1.1:1")
+			reg.Register("flardmaster", "http://2.2.2.2:2")
+			reg.Deregister(id)
+			_, err := reg.Register("flardmaster", "http://3.3.3.3:3")
+			Expect(err).To(BeNil())
+		})
+		It("doesn't count draining instances", func() {
+			reg.SetDefaultWindows(registry.Windows{Drain: time.Minute})
+			reg.SetLimits(2, 1)
+			id, _ := reg.Register("flardmaster", "http://1.1.1.1:1")
+			reg.Deregister(id)
+			_, err := reg.Register("flardmaster", "http://2.2.2.2:2")
+			Expect(err).To(BeNil())
+			id, _ = reg.Register("dungen", "http://1.1.1.1:1")
+			reg.Deregister(id)
+			_, err = reg.Register("flard", "http://3.3.3.3:3")
+			Expect(err).To(BeNil())
+		})
+		It("allows replacing at the limit", func() {
+			reg.SetPolicy("flardmaster", registry.PolicyReplace)
+			reg.Register("flardmaster", "http://1.1.1.1:1")
+			reg.Register("flardmaster", "http://2.2.2.2:2")
+			_, result, err := reg.RegisterInstance(registry.Instance{Name: "flardmaster", Address: "http://2.2.2.2:2"})
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultReplaced))
+		})
+		It("allows updating at the limit", func() {
+			reg.RegisterInstance(registry.Instance{Name: "flardmaster", Address: "http://1.1.1.1:1", ID: "one"})
+			reg.Register("flardmaster", "http://2.2.2.2:2")
+			_, result, err := reg.RegisterInstance(registry.Instance{Name: "flardmaster", Address: "http://3.3.3.3:3", ID: "one"})
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultUpdated))
+		})
+	})
+
 	Describe("Deregister", func() {
 		var err error
 		var id string
@@ -140,12 +221,121 @@ var _ = Describe("Registry", func() {
 				Expect(lookup_address).To(Equal(reg_address))
 			})
 		})
+
+		Context("when one of several instances is deregistered", func() {
+			var other_address string
+
+			BeforeEach(func() {
+				other_address = "http://129.129.129.129:129"
+				id, _ := reg.Register(lookup_name, reg_address)
+				reg.Register(lookup_name, other_address)
+				reg.Deregister(id)
+			})
+			It("should return the remaining instance", func() {
+				Expect(reg.Lookup(lookup_name)).To(Equal(other_address))
+			})
+		})
+	})
+
+	Describe("LookupInstance", func() {
+		var name string
+		var first_id string
+		var second_id string
+
+		BeforeEach(func() {
+			name = "flardmaster"
+			first_id, _ = reg.Register(name, "http://128.128.128.128:128")
+			second_id, _ = reg.Register(name, "http://129.129.129.129:129")
+		})
+
+		It("should return a registered instance", func() {
+			instance, ok := reg.LookupInstance(name, nil)
+			Expect(ok).To(BeTrue())
+			Expect(instance.Name).To(Equal(name))
+			Expect(instance.ID).To(BeElementOf(first_id, second_id))
+		})
+		It("should not return skipped instances", func() {
+			for i := 0; i < 10; i++ {
+				instance, ok := reg.LookupInstance(name, func(i registry.Instance) bool {
+					return i.ID == first_id
+				})
+				Expect(ok).To(BeTrue())
+				Expect(instance.ID).To(Equal(second_id))
+			}
+		})
+		It("should fail when every instance is skipped", func() {
+			_, ok := reg.LookupInstance(name, func(registry.Instance) bool {
+				return true
+			})
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("Instances", func() {
+		It("should be empty when nothing is registered", func() {
+			Expect(reg.Instances()).To(BeEmpty())
+		})
+		It("should list instances ordered by name", func() {
+			reg.Register("zeta", "http://128.128.128.128:128")
+			reg.RegisterInstance(registry.Instance{
+				Name:    "alpha",
+				Address: "http://129.129.129.129:129",
+				Tags:    map[string]string{"version": "2"},
+			})
+			instances := reg.Instances()
+			Expect(instances).To(HaveLen(2))
+			Expect(instances[0].Name).To(Equal("alpha"))
+			Expect(instances[0].Tags).To(HaveKeyWithValue("version", "2"))
+			Expect(instances[0].Status).To(Equal(registry.StatusUp))
+			Expect(instances[1].Name).To(Equal("zeta"))
+		})
+	})
+
+	Describe("Instance", func() {
+		It("should return a registered instance", func() {
+			id, _ := reg.Register("zeta", "http://128.128.128.128:128")
+			instance, ok := reg.Instance(id)
+			Expect(ok).To(BeTrue())
+			Expect(instance.Address).To(Equal("http://128.128.128.128:128"))
+		})
+		It("should report an unknown ID", func() {
+			_, ok := reg.Instance("nope")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("SetMaintenance", func() {
+		var id string
+
+		BeforeEach(func() {
+			id, _ = reg.Register("flardmaster", "http://128.128.128.128:128")
+		})
+		It("should hide the instance from Lookup", func() {
+			Expect(reg.SetMaintenance(id, true)).To(Succeed())
+			Expect(reg.Lookup("flardmaster")).To(BeEmpty())
+			Expect(reg.Instances()[0].Status).To(Equal(registry.StatusMaintenance))
+		})
+		It("should restore the instance when ended", func() {
+			reg.SetMaintenance(id, true)
+			Expect(reg.SetMaintenance(id, false)).To(Succeed())
+			Expect(reg.Lookup("flardmaster")).NotTo(BeEmpty())
+		})
+		It("should return an error for an unknown ID", func() {
+			Expect(reg.SetMaintenance("nope", true)).NotTo(Succeed())
+		})
 	})
 
 	Describe("Timeouts and Heartbeats", func() {
+		const timeout = 5 * time.Second
 		var reg_name string
 		var reg_address string
 		var id string
+		var clock *clocktest.Clock
+
+		BeforeEach(func() {
+			clock = clocktest.New(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+			reg, _ = registry.New(registry.WithClock(clock), registry.WithTimeout(timeout))
+		})
 
 		Context("not registered", func() {
 			It("returns unsuccessful", func() {
@@ -157,13 +347,22 @@ var _ = Describe("Registry", func() {
 			BeforeEach(func() {
 				reg_name = "flardmaster"
 				reg_address = "http://127.721.217.555:4343"
-				reg.SetTimeout(5 * time.Millisecond)
 				id, _ = reg.Register(reg_name, reg_address)
 			})
 
 			Context("without heartbeats", func() {
 				It("gets deregistered", func() {
-					<-time.After(7 * time.Millisecond)
+					clock.Advance(timeout)
+					Expect(reg.Lookup(reg_name)).To(BeEmpty())
+					Expect(reg.Instances()).To(BeEmpty())
+				})
+				It("stays registered until the timeout", func() {
+					clock.Advance(timeout - time.Nanosecond)
+					Expect(reg.Lookup(reg_name)).To(Equal(reg_address))
+				})
+				It("refuses heartbeats once deregistered", func() {
+					clock.Advance(timeout)
+					Expect(reg.Heartbeat(id)).To(BeFalse())
 					Expect(reg.Lookup(reg_name)).To(BeEmpty())
 				})
 			})
@@ -172,13 +371,109 @@ var _ = Describe("Registry", func() {
 					Expect(reg.Heartbeat(id)).To(BeTrue())
 				})
 
+				It("records the heartbeat time", func() {
+					clock.Advance(time.Second)
+					reg.Heartbeat(id)
+					Expect(reg.Instances()[0].LastHeartbeat).To(Equal(clock.Now()))
+				})
+
 				It("remains registered", func() {
 					for i := 0; i < 7; i++ {
-						<-time.After(1 * time.Millisecond)
+						clock.Advance(time.Second)
 						reg.Heartbeat(id)
 					}
 					Expect(reg.Lookup(reg_name)).To(Equal(reg_address))
 				})
+
+				It("expires a timeout after the last heartbeat", func() {
+					clock.Advance(3 * time.Second)
+					reg.Heartbeat(id)
+					clock.Advance(timeout - time.Nanosecond)
+					Expect(reg.Lookup(reg_name)).To(Equal(reg_address))
+					clock.Advance(time.Nanosecond)
+					Expect(reg.Lookup(reg_name)).To(BeEmpty())
+				})
+
+				It("extends the deadline by a heartbeat just before it", func() {
+					clock.Advance(timeout - time.Nanosecond)
+					Expect(reg.Heartbeat(id)).To(BeTrue())
+					clock.Advance(timeout - time.Nanosecond)
+					Expect(reg.Lookup(reg_name)).To(Equal(reg_address))
+					clock.Advance(time.Nanosecond)
+					Expect(reg.Lookup(reg_name)).To(BeEmpty())
+				})
+
+				It("extends the deadline by registering again with the same ID", func() {
+					chosen := registry.Instance{ID: "pod-1", Name: reg_name, Address: reg_address}
+					original, _, _ := reg.RegisterInstance(chosen)
+					clock.Advance(4 * time.Second)
+					again, result, err := reg.RegisterInstance(chosen)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result).To(Equal(registry.ResultUpdated))
+					Expect(again).To(Equal(original))
+					clock.Advance(4 * time.Second)
+					_, ok := reg.Instance(original)
+					Expect(ok).To(BeTrue())
+					clock.Advance(time.Second)
+					_, ok = reg.Instance(original)
+					Expect(ok).To(BeFalse())
+				})
+
+				It("applies a shorter timeout from the next heartbeat", func() {
+					reg.SetTimeout(2 * time.Second)
+					reg.Heartbeat(id)
+					clock.Advance(2 * time.Second)
+					Expect(reg.Lookup(reg_name)).To(BeEmpty())
+				})
+
+				It("applies a longer timeout without another heartbeat", func() {
+					reg.SetTimeout(2 * timeout)
+					clock.Advance(timeout)
+					Expect(reg.Lookup(reg_name)).To(Equal(reg_address))
+					clock.Advance(timeout)
+					Expect(reg.Lookup(reg_name)).To(BeEmpty())
+				})
+
+				It("stops its timer when deregistered", func() {
+					Expect(clock.Pending()).To(Equal(1))
+					reg.Deregister(id)
+					Expect(clock.Pending()).To(BeZero())
+				})
+			})
+			Context("with batched heartbeats", func() {
+				It("reports each ID, and records loads", func() {
+					load := registry.Load{InFlight: 2}
+					known := reg.HeartbeatBatch([]registry.Beat{{ID: id, Load: &load}, {ID: "nope"}})
+					Expect(known).To(Equal([]bool{true, false}))
+					Expect(reg.Instances()[0].Load).To(Equal(load))
+				})
+
+				It("remains registered", func() {
+					for i := 0; i < 7; i++ {
+						clock.Advance(time.Second)
+						reg.HeartbeatBatch([]registry.Beat{{ID: id}})
+					}
+					Expect(reg.Lookup(reg_name)).To(Equal(reg_address))
+				})
+
+				It("extends the deadline of each instance separately", func() {
+					other, _ := reg.Register(reg_name, "http://127.0.0.1:4344")
+					clock.Advance(timeout - time.Second)
+					reg.HeartbeatBatch([]registry.Beat{{ID: other}})
+					clock.Advance(time.Second)
+					_, ok := reg.Instance(id)
+					Expect(ok).To(BeFalse())
+					Expect(reg.Lookup(reg_name)).To(Equal("http://127.0.0.1:4344"))
+				})
+			})
+		})
+
+		Context("a static instance", func() {
+			It("never expires", func() {
+				_, _, err := reg.RegisterInstance(registry.Instance{Name: "flardmaster", Address: "http://127.0.0.1:4343", Static: true})
+				Expect(err).NotTo(HaveOccurred())
+				clock.Advance(100 * timeout)
+				Expect(reg.Lookup("flardmaster")).NotTo(BeEmpty())
 			})
 		})
 	})
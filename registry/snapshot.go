@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Snapshot is the state of a registry, for backup and migration.
+type Snapshot struct {
+	Instances []Instance
+	// Policies, Strategies, Windows, Fallbacks and Traffic are those set for individual names.
+	Policies   map[string]Policy
+	Strategies map[string]Strategy
+	Windows    map[string]Windows
+	Fallbacks  map[string]Fallback
+	Traffic    map[string]TrafficPolicy
+	// Timeout is the registry's timeout. If it is zero, Restore keeps the timeout it has.
+	Timeout time.Duration
+}
+
+// RestoreMode decides what happens to the existing state when a snapshot is restored.
+type RestoreMode string
+
+const (
+	// RestoreMerge keeps existing instances, unless the snapshot has one with the same ID.
+	RestoreMerge RestoreMode = "merge"
+	// RestoreReplace removes existing instances, and the settings of names, not in the snapshot.
+	RestoreReplace RestoreMode = "replace"
+)
+
+func ParseRestoreMode(s string) (RestoreMode, error) {
+	switch m := RestoreMode(s); m {
+	case RestoreMerge, RestoreReplace:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown restore mode %q", s)
+}
+
+// Snapshot leaves out draining instances, which are on their way out.
+// It is taken at one point in time.
+func (s *ServiceRegistry) Snapshot() Snapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot := Snapshot{
+		Instances:  []Instance{},
+		Policies:   make(map[string]Policy),
+		Strategies: make(map[string]Strategy),
+		Windows:    make(map[string]Windows),
+		Fallbacks:  make(map[string]Fallback),
+		Traffic:    make(map[string]TrafficPolicy),
+		Timeout:    s.serviceTimeout,
+	}
+	for _, instance := range s.instances() {
+		if instance.Status != StatusDraining {
+			snapshot.Instances = append(snapshot.Instances, instance)
+		}
+	}
+	for name, p := range s.policies {
+		snapshot.Policies[name] = p
+	}
+	for name, st := range s.strategies {
+		snapshot.Strategies[name] = st
+	}
+	for name, w := range s.windowsByName {
+		snapshot.Windows[name] = w
+	}
+	for name, f := range s.fallbacks {
+		snapshot.Fallbacks[name] = f
+	}
+	for name, p := range s.traffic {
+		snapshot.Traffic[name] = TrafficPolicy{Tag: p.Tag, Weights: copyWeights(p.Weights)}
+	}
+	return snapshot
+}
+
+// Restore registers the snapshot's instances with their IDs, registration times and statuses,
+// bypassing policies and limits. Unless resetDeadlines is set, each instance expires
+// when it would have without the snapshot, which may be at once. With the snapshot's Timeout,
+// that is when it would have in the registry the snapshot was taken from.
+// If any instance or traffic policy is invalid, nothing is restored. If the Store fails, the restore stops there.
+func (s *ServiceRegistry) Restore(snapshot Snapshot, mode RestoreMode, resetDeadlines bool) error {
+	ids := make(map[string]bool, len(snapshot.Instances))
+	parsed := make([]Address, len(snapshot.Instances))
+	for i, instance := range snapshot.Instances {
+		if instance.Name == "" {
+			return fmt.Errorf("instance %d has no name", i)
+		}
+		var err error
+		if parsed[i], err = ParseAddress(instance.Address); err != nil {
+			return fmt.Errorf("instance %d: %w", i, err)
+		}
+		if instance.ID != "" && ids[instance.ID] {
+			return errors.New("duplicate ID " + instance.ID)
+		}
+		ids[instance.ID] = true
+	}
+	for name, policy := range snapshot.Traffic {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("traffic of %s: %w", name, err)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if mode == RestoreReplace {
+		for _, instance := range s.store.All() {
+			if !ids[instance.ID] {
+				if err := s.remove(instance.ID); err != nil {
+					return err
+				}
+				s.emit(EventDeregistered, instance)
+			}
+		}
+		s.policies = make(map[string]Policy)
+		s.strategies = make(map[string]Strategy)
+		s.windowsByName = make(map[string]Windows)
+		s.fallbacks = make(map[string]Fallback)
+		s.traffic = make(map[string]TrafficPolicy)
+	}
+	for name, p := range snapshot.Policies {
+		s.policies[name] = p
+	}
+	for name, st := range snapshot.Strategies {
+		s.strategies[name] = st
+	}
+	for name, w := range snapshot.Windows {
+		s.windowsByName[name] = w
+	}
+	for name, f := range snapshot.Fallbacks {
+		s.fallbacks[name] = f
+	}
+	for name, p := range snapshot.Traffic {
+		s.traffic[name] = TrafficPolicy{Tag: p.Tag, Weights: copyWeights(p.Weights)}
+	}
+	if snapshot.Timeout > 0 {
+		s.serviceTimeout = snapshot.Timeout
+	}
+
+	now := s.clock.Now()
+	for i, instance := range snapshot.Instances {
+		event := EventRegistered
+		if _, ok := s.store.Get(instance.ID); ok {
+			// Replaced whole, in case the name has changed.
+			if err := s.remove(instance.ID); err != nil {
+				return err
+			}
+			event = EventUpdated
+		}
+
+		restored := Instance{
+			ID:            instance.ID,
+			Name:          instance.Name,
+			Address:       parsed[i].String(),
+			Parsed:        parsed[i],
+			Tags:          copyTags(instance.Tags),
+			Status:        StatusUp,
+			Static:        instance.Static,
+			Locality:      instance.Locality,
+			Registered:    now,
+			LastHeartbeat: now,
+			Load:          instance.Load,
+			LoadReported:  instance.LoadReported,
+		}
+		if restored.ID == "" {
+			restored.ID = uuid.NewString()
+		}
+		if instance.Status == StatusMaintenance {
+			restored.Status = StatusMaintenance
+		}
+		if !instance.Registered.IsZero() {
+			restored.Registered = instance.Registered
+		}
+		if !resetDeadlines && !instance.LastHeartbeat.IsZero() {
+			restored.LastHeartbeat = instance.LastHeartbeat
+		}
+
+		if err := s.store.Put(restored); err != nil {
+			return storageError(err)
+		}
+		entry := newServiceEntry()
+		s.entries[restored.ID] = entry
+		s.emit(event, restored)
+		if !restored.Static {
+			s.watch(restored.ID, entry, s.serviceTimeout-now.Sub(restored.LastHeartbeat))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/clocktest"
+)
+
+var _ = Describe("Snapshot", func() {
+	const name = "flardmaster"
+
+	var reg registry.Registry
+	var other registry.Registry
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		other = registry.NewServiceRegistry()
+	})
+
+	It("includes instances and the settings of names", func() {
+		id, _ := reg.Register(name, "http://1.1.1.1:1")
+		reg.SetPolicy(name, registry.PolicyReplace)
+		reg.SetStrategy(name, registry.StrategyLeastLoaded)
+		reg.SetWindows(name, registry.Windows{Warmup: time.Second, Drain: time.Minute})
+		reg.SetFallback(name, registry.FallbackNone)
+		reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 90, "2": 10}})
+		snapshot := reg.Snapshot()
+		Expect(snapshot.Instances).To(HaveLen(1))
+		Expect(snapshot.Instances[0].ID).To(Equal(id))
+		Expect(snapshot.Policies).To(HaveKeyWithValue(name, registry.PolicyReplace))
+		Expect(snapshot.Strategies).To(HaveKeyWithValue(name, registry.StrategyLeastLoaded))
+		Expect(snapshot.Windows).To(HaveKeyWithValue(name, registry.Windows{Warmup: time.Second, Drain: time.Minute}))
+		Expect(snapshot.Fallbacks).To(HaveKeyWithValue(name, registry.FallbackNone))
+		Expect(snapshot.Traffic).To(HaveKeyWithValue(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 90, "2": 10}}))
+	})
+
+	Describe("Restore", func() {
+		var id string
+
+		BeforeEach(func() {
+			id, _ = reg.Register(name, "http://1.1.1.1:1")
+			reg.SetMaintenance(id, true)
+			reg.SetPolicy(name, registry.PolicyReject)
+			reg.SetWindows(name, registry.Windows{Warmup: time.Minute})
+			reg.SetFallback(name, registry.FallbackRegion)
+			reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"2": 1}})
+		})
+
+		It("keeps IDs, statuses and registration times", func() {
+			Expect(other.Restore(reg.Snapshot(), registry.RestoreMerge, false)).To(Succeed())
+			restored, ok := other.Instance(id)
+			Expect(ok).To(BeTrue())
+			original, _ := reg.Instance(id)
+			Expect(restored.Status).To(Equal(registry.StatusMaintenance))
+			Expect(restored.Registered).To(BeTemporally("==", original.Registered))
+			Expect(other.Heartbeat(id)).To(BeTrue())
+			Expect(other.Snapshot().Policies).To(HaveKeyWithValue(name, registry.PolicyReject))
+		})
+		It("restores the settings of names", func() {
+			Expect(other.Restore(reg.Snapshot(), registry.RestoreMerge, false)).To(Succeed())
+			snapshot := other.Snapshot()
+			Expect(snapshot.Windows).To(HaveKeyWithValue(name, registry.Windows{Warmup: time.Minute}))
+			Expect(snapshot.Fallbacks).To(HaveKeyWithValue(name, registry.FallbackRegion))
+			Expect(other.Traffic()).To(HaveKeyWithValue(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"2": 1}}))
+		})
+		It("merges with existing instances", func() {
+			kept, _ := other.Register("other", "http://2.2.2.2:2")
+			Expect(other.Restore(reg.Snapshot(), registry.RestoreMerge, false)).To(Succeed())
+			Expect(other.Instances()).To(HaveLen(2))
+			_, ok := other.Instance(kept)
+			Expect(ok).To(BeTrue())
+		})
+		It("replaces instances with the same ID", func() {
+			other.Restore(reg.Snapshot(), registry.RestoreMerge, false)
+			snapshot := reg.Snapshot()
+			snapshot.Instances[0].Address = "http://3.3.3.3:3"
+			Expect(other.Restore(snapshot, registry.RestoreMerge, false)).To(Succeed())
+			Expect(other.Instances()).To(HaveLen(1))
+			restored, _ := other.Instance(id)
+			Expect(restored.Address).To(Equal("http://3.3.3.3:3"))
+		})
+		It("replaces existing state", func() {
+			other.Register("other", "http://2.2.2.2:2")
+			other.SetPolicy("other", registry.PolicySingleton)
+			other.SetWindows("other", registry.Windows{Warmup: time.Second})
+			other.SetFallback("other", registry.FallbackNone)
+			other.SetTraffic("other", registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 1}})
+			Expect(other.Restore(reg.Snapshot(), registry.RestoreReplace, false)).To(Succeed())
+			instances := other.Instances()
+			Expect(instances).To(HaveLen(1))
+			Expect(instances[0].ID).To(Equal(id))
+			snapshot := other.Snapshot()
+			Expect(snapshot.Policies).NotTo(HaveKey("other"))
+			Expect(snapshot.Windows).NotTo(HaveKey("other"))
+			Expect(snapshot.Fallbacks).NotTo(HaveKey("other"))
+			Expect(snapshot.Traffic).NotTo(HaveKey("other"))
+		})
+		It("bypasses policies and limits", func() {
+			other.SetLimits(1, 1)
+			other.Register(name, "http://1.1.1.1:1")
+			Expect(other.Restore(reg.Snapshot(), registry.RestoreMerge, false)).To(Succeed())
+			Expect(other.Instances()).To(HaveLen(2))
+		})
+		It("restores nothing if an instance is invalid", func() {
+			snapshot := reg.Snapshot()
+			snapshot.Instances = append(snapshot.Instances, registry.Instance{Name: name, Address: "nope"})
+			Expect(other.Restore(snapshot, registry.RestoreMerge, false)).NotTo(Succeed())
+			Expect(other.Instances()).To(BeEmpty())
+		})
+		It("restores nothing if a traffic policy is invalid", func() {
+			snapshot := reg.Snapshot()
+			snapshot.Traffic["other"] = registry.TrafficPolicy{Tag: "version"}
+			err := other.Restore(snapshot, registry.RestoreMerge, false)
+			Expect(errors.Is(err, registry.ErrTraffic)).To(BeTrue())
+			Expect(other.Instances()).To(BeEmpty())
+			Expect(other.Traffic()).To(BeEmpty())
+		})
+		It("refuses duplicate IDs", func() {
+			snapshot := reg.Snapshot()
+			snapshot.Instances = append(snapshot.Instances, snapshot.Instances[0])
+			Expect(other.Restore(snapshot, registry.RestoreMerge, false)).NotTo(Succeed())
+		})
+		It("restores the timeout", func() {
+			reg.SetTimeout(90 * time.Second)
+			Expect(other.Restore(reg.Snapshot(), registry.RestoreMerge, false)).To(Succeed())
+			Expect(other.Timeout()).To(Equal(90 * time.Second))
+		})
+		It("keeps its timeout if the snapshot has none", func() {
+			other.SetTimeout(time.Minute)
+			snapshot := reg.Snapshot()
+			snapshot.Timeout = 0
+			Expect(other.Restore(snapshot, registry.RestoreMerge, false)).To(Succeed())
+			Expect(other.Timeout()).To(Equal(time.Minute))
+		})
+
+		Context("with old heartbeats", func() {
+			const timeout = 5 * time.Second
+
+			var clock *clocktest.Clock
+			var snapshot registry.Snapshot
+
+			BeforeEach(func() {
+				clock = clocktest.New(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+				other, _ = registry.New(registry.WithClock(clock), registry.WithTimeout(timeout))
+				snapshot = reg.Snapshot()
+				snapshot.Timeout = 0
+				snapshot.Instances[0].LastHeartbeat = clock.Now().Add(-time.Minute)
+			})
+
+			It("expires them", func() {
+				Expect(other.Restore(snapshot, registry.RestoreMerge, false)).To(Succeed())
+				clock.Advance(0)
+				Expect(other.Instances()).To(BeEmpty())
+			})
+			It("resets deadlines if asked", func() {
+				Expect(other.Restore(snapshot, registry.RestoreMerge, true)).To(Succeed())
+				clock.Advance(timeout - time.Nanosecond)
+				Expect(other.Instances()).To(HaveLen(1))
+				clock.Advance(time.Nanosecond)
+				Expect(other.Instances()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("ParseRestoreMode", func() {
+		It("accepts known modes", func() {
+			Expect(registry.ParseRestoreMode("replace")).To(Equal(registry.RestoreReplace))
+		})
+		It("rejects unknown modes", func() {
+			_, err := registry.ParseRestoreMode("overwrite")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
@@ -0,0 +1,125 @@
+// Package sqlitestore keeps the instances of a registry in an SQLite database,
+// so they survive restarts. It is a package of its own, so that only programs
+// that use it depend on SQLite.
+package sqlitestore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+// schema keeps each instance as JSON. seq orders the instances as they were added.
+const schema = `CREATE TABLE IF NOT EXISTS instances (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	id TEXT NOT NULL UNIQUE,
+	data TEXT NOT NULL
+)`
+
+// Store is a registry.Store in an SQLite database. Like a registry.FileStore,
+// it keeps a copy of its instances in memory to read from.
+//
+// The database is in WAL mode, and not synced after every change, so changes survive
+// the process crashing, but may be lost if the operating system does.
+type Store struct {
+	*registry.MemoryStore
+	db *sql.DB
+}
+
+// Open opens the database at path, creating it if it doesn't exist.
+func Open(path string) (*Store, error) {
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() +
+		"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// The registry calls its Store with its lock held, so one connection is enough.
+	db.SetMaxOpenConns(1)
+	s := &Store{MemoryStore: registry.NewMemoryStore(), db: db}
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// load creates the table if needed, and reads the instances in the order they were added.
+func (s *Store) load() error {
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+	rows, err := s.db.Query("SELECT id, data FROM instances ORDER BY seq")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		var instance registry.Instance
+		if err := json.Unmarshal([]byte(data), &instance); err != nil {
+			return fmt.Errorf("instance %s: %w", id, err)
+		}
+		s.MemoryStore.Put(instance)
+	}
+	return rows.Err()
+}
+
+func (s *Store) Put(instance registry.Instance) error {
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	if existing, ok := s.Get(instance.ID); ok && existing.Name == instance.Name {
+		// The instance keeps its place.
+		_, err = s.db.Exec("UPDATE instances SET data = ? WHERE id = ?", string(data), instance.ID)
+	} else {
+		// A new or renamed instance goes last.
+		err = s.replace(instance.ID, string(data))
+	}
+	if err != nil {
+		return err
+	}
+	s.MemoryStore.Put(instance)
+	return nil
+}
+
+// replace deletes the row of the ID, if any, and inserts the data at the end.
+func (s *Store) replace(id string, data string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM instances WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO instances (id, data) VALUES (?, ?)", id, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) Delete(id string) error {
+	if _, ok := s.Get(id); !ok {
+		return nil
+	}
+	if _, err := s.db.Exec("DELETE FROM instances WHERE id = ?", id); err != nil {
+		return err
+	}
+	s.MemoryStore.Delete(id)
+	return nil
+}
+
+// Close closes the database. The store must not be used after.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,71 @@
+package sqlitestore_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"os"
+	"path/filepath"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/sqlitestore"
+	"github.com/ifIMust/srsr/registry/storetest"
+)
+
+var _ = Describe("Store", func() {
+	var path string
+
+	open := func() *sqlitestore.Store {
+		store, err := sqlitestore.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(store.Close)
+		return store
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "registry.sqlite")
+	})
+
+	storetest.DescribeStore(func() registry.Store {
+		return open()
+	})
+
+	It("keeps instances when reopened", func() {
+		reg, err := registry.New(registry.WithStore(open()))
+		Expect(err).NotTo(HaveOccurred())
+		id, _ := reg.Register("dungen", "http://localhost:5000")
+		reg.Register("flard", "http://localhost:5001")
+		gone, _ := reg.Register("flard", "http://localhost:5002")
+		reg.ForceDeregister(gone)
+		reg.SetMaintenance(id, true)
+
+		reg, err = registry.New(registry.WithStore(open()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reg.Instances()).To(HaveLen(2))
+		instance, ok := reg.Instance(id)
+		Expect(ok).To(BeTrue())
+		Expect(instance.Address).To(Equal("http://localhost:5000"))
+		Expect(instance.Parsed.Port).To(Equal("5000"))
+		Expect(instance.Status).To(Equal(registry.StatusMaintenance))
+	})
+	It("keeps the order of instances when reopened", func() {
+		store := open()
+		for _, id := range []string{"1", "2", "3"} {
+			Expect(store.Put(registry.Instance{ID: id, Name: "dungen"})).To(Succeed())
+		}
+		Expect(store.Put(registry.Instance{ID: "1", Name: "dungen", Status: registry.StatusMaintenance})).To(Succeed())
+		Expect(store.Put(registry.Instance{ID: "2", Name: "flard"})).To(Succeed())
+		Expect(store.Put(registry.Instance{ID: "2", Name: "dungen"})).To(Succeed())
+
+		var ids []string
+		for _, instance := range open().Name("dungen") {
+			ids = append(ids, instance.ID)
+		}
+		Expect(ids).To(Equal([]string{"1", "3", "2"}))
+	})
+	It("refuses a file that isn't a database", func() {
+		Expect(os.WriteFile(path, []byte("nonsense, and more nonsense than a header"), 0o600)).To(Succeed())
+		_, err := sqlitestore.Open(path)
+		Expect(err).To(HaveOccurred())
+	})
+})
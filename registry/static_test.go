@@ -0,0 +1,69 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/clocktest"
+)
+
+var _ = Describe("Static", func() {
+	const name = "orders-db"
+	const address = "postgres://db.internal:5432"
+	const timeout = 5 * time.Second
+
+	var reg registry.Registry
+	var clock *clocktest.Clock
+	var id string
+
+	BeforeEach(func() {
+		clock = clocktest.New(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+		reg, _ = registry.New(registry.WithClock(clock), registry.WithTimeout(timeout))
+		id, _, _ = reg.RegisterInstance(registry.Instance{Name: name, Address: address, ID: "primary", Static: true})
+	})
+
+	It("never expires", func() {
+		clock.Advance(time.Hour)
+		Expect(reg.Lookup(name)).To(Equal(address))
+	})
+	It("is marked", func() {
+		instance, _ := reg.LookupInstance(name, nil)
+		Expect(instance.Static).To(BeTrue())
+	})
+	It("is not removed by Deregister", func() {
+		Expect(reg.Deregister(id)).To(MatchError(registry.ErrStatic))
+		Expect(reg.Lookup(name)).To(Equal(address))
+	})
+	It("is removed by ForceDeregister", func() {
+		Expect(reg.ForceDeregister(id)).To(Succeed())
+		Expect(reg.Lookup(name)).To(BeEmpty())
+	})
+	It("may be updated as a static instance", func() {
+		_, result, err := reg.RegisterInstance(registry.Instance{Name: name, Address: "postgres://db2.internal", ID: "primary", Static: true})
+		Expect(err).To(BeNil())
+		Expect(result).To(Equal(registry.ResultUpdated))
+	})
+	It("is not updated by a dynamic registration", func() {
+		_, _, err := reg.RegisterInstance(registry.Instance{Name: name, Address: address, ID: "primary"})
+		Expect(err).To(MatchError(registry.ErrStatic))
+		instance, _ := reg.Instance(id)
+		Expect(instance.Static).To(BeTrue())
+	})
+	It("is not replaced by a policy", func() {
+		reg.SetPolicy(name, registry.PolicyReplace)
+		_, _, err := reg.RegisterInstance(registry.Instance{Name: name, Address: address})
+		Expect(err).To(MatchError(registry.ErrStatic))
+		_, ok := reg.Instance(id)
+		Expect(ok).To(BeTrue())
+	})
+	It("is restored as static", func() {
+		other, _ := registry.New(registry.WithClock(clock), registry.WithTimeout(timeout))
+		Expect(other.Restore(reg.Snapshot(), registry.RestoreMerge, false)).To(Succeed())
+		clock.Advance(time.Hour)
+		Expect(other.Lookup(name)).To(Equal(address))
+		Expect(other.Deregister(id)).To(MatchError(registry.ErrStatic))
+	})
+})
@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrStorage is returned when the registry's Store fails to save a change.
+var ErrStorage = errors.New("storage failed")
+
+// Store keeps the instances of a registry. The registry keeps only what it needs at runtime,
+// like expiry timers, itself. It calls its Store with its own lock held, so a Store
+// needn't be safe for concurrent use, and must not call the registry.
+//
+// Reads can't fail, so a Store that writes elsewhere, like to a file, should keep
+// a copy of its instances in memory to read from. Instances are values: changing one
+// that was returned, including its Tags, must not change what is stored.
+// The storetest package has tests that every Store should pass.
+type Store interface {
+	// Get returns the instance with the ID.
+	Get(id string) (Instance, bool)
+	// Name returns the instances of a name, in the order they were added.
+	Name(name string) []Instance
+	// All returns every instance, grouped by name, in the order they were added.
+	All() []Instance
+	// Len returns the number of instances.
+	Len() int
+
+	// Put adds an instance, or replaces the one with the same ID.
+	// A replaced instance keeps its place in the order, unless its name changes.
+	Put(instance Instance) error
+	// Delete removes the instance with the ID. Deleting an unknown ID is not an error.
+	Delete(id string) error
+}
+
+// storageError wraps an error from the Store.
+func storageError(err error) error {
+	return fmt.Errorf("%w: %w", ErrStorage, err)
+}
+
+// MemoryStore keeps instances in memory, so they are lost when the process exits.
+// It is the Store of NewServiceRegistry.
+type MemoryStore struct {
+	instances map[string]Instance
+	// names maps each name to the IDs of its instances, in order.
+	names map[string][]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		instances: make(map[string]Instance),
+		names:     make(map[string][]string),
+	}
+}
+
+// stored returns a copy of the instance that shares nothing with it.
+func stored(instance Instance) Instance {
+	instance.Tags = copyTags(instance.Tags)
+	return instance
+}
+
+func (m *MemoryStore) Get(id string) (Instance, bool) {
+	instance, ok := m.instances[id]
+	return stored(instance), ok
+}
+
+func (m *MemoryStore) Name(name string) []Instance {
+	ids := m.names[name]
+	instances := make([]Instance, len(ids))
+	for i, id := range ids {
+		instances[i] = stored(m.instances[id])
+	}
+	return instances
+}
+
+func (m *MemoryStore) All() []Instance {
+	instances := make([]Instance, 0, len(m.instances))
+	for _, ids := range m.names {
+		for _, id := range ids {
+			instances = append(instances, stored(m.instances[id]))
+		}
+	}
+	return instances
+}
+
+func (m *MemoryStore) Len() int {
+	return len(m.instances)
+}
+
+func (m *MemoryStore) Put(instance Instance) error {
+	if existing, ok := m.instances[instance.ID]; !ok || existing.Name != instance.Name {
+		if ok {
+			m.unname(existing)
+		}
+		m.names[instance.Name] = append(m.names[instance.Name], instance.ID)
+	}
+	m.instances[instance.ID] = stored(instance)
+	return nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	if existing, ok := m.instances[id]; ok {
+		m.unname(existing)
+		delete(m.instances, id)
+	}
+	return nil
+}
+
+// unname removes the instance from the IDs of its name.
+func (m *MemoryStore) unname(instance Instance) {
+	ids := m.names[instance.Name]
+	for i, id := range ids {
+		if id == instance.ID {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(m.names, instance.Name)
+	} else {
+		m.names[instance.Name] = ids
+	}
+}
@@ -0,0 +1,117 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/storetest"
+)
+
+var _ = Describe("MemoryStore", func() {
+	storetest.DescribeStore(func() registry.Store {
+		return registry.NewMemoryStore()
+	})
+})
+
+var _ = Describe("FileStore", func() {
+	var path string
+
+	open := func() *registry.FileStore {
+		store, err := registry.OpenFileStore(path)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(store.Close)
+		return store
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "registry.db")
+	})
+
+	storetest.DescribeStore(func() registry.Store {
+		return open()
+	})
+
+	It("keeps instances when reopened", func() {
+		reg, err := registry.New(registry.WithStore(open()))
+		Expect(err).NotTo(HaveOccurred())
+		id, _ := reg.Register("dungen", "http://localhost:5000")
+		reg.Register("flard", "http://localhost:5001")
+		gone, _ := reg.Register("flard", "http://localhost:5002")
+		reg.ForceDeregister(gone)
+
+		reg, err = registry.New(registry.WithStore(open()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reg.Instances()).To(HaveLen(2))
+		instance, ok := reg.Instance(id)
+		Expect(ok).To(BeTrue())
+		Expect(instance.Address).To(Equal("http://localhost:5000"))
+		Expect(instance.Parsed.Port).To(Equal("5000"))
+		Expect(reg.Heartbeat(id)).To(BeTrue())
+	})
+	It("ignores a record cut short by a crash", func() {
+		store, _ := registry.OpenFileStore(path)
+		reg, _ := registry.New(registry.WithStore(store))
+		reg.Register("dungen", "http://localhost:5000")
+		store.Close()
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		file.WriteString(`{"Instance":{"ID":"half`)
+		file.Close()
+
+		store = open()
+		Expect(store.Len()).To(Equal(1))
+		reg, _ = registry.New(registry.WithStore(store))
+		reg.Register("flard", "http://localhost:5001")
+		Expect(open().Len()).To(Equal(2))
+	})
+	It("starts a new line after a record without one", func() {
+		store, _ := registry.OpenFileStore(path)
+		reg, _ := registry.New(registry.WithStore(store))
+		reg.Register("dungen", "http://localhost:5000")
+		store.Close()
+		data, _ := os.ReadFile(path)
+		Expect(os.WriteFile(path, bytes.TrimSuffix(data, []byte("\n")), 0o600)).To(Succeed())
+
+		store = open()
+		Expect(store.Len()).To(Equal(1))
+		reg, _ = registry.New(registry.WithStore(store))
+		reg.Register("flard", "http://localhost:5001")
+		Expect(open().Len()).To(Equal(2))
+	})
+	It("refuses a corrupt file", func() {
+		Expect(os.WriteFile(path, []byte("nonsense\n{}\n"), 0o600)).To(Succeed())
+		_, err := registry.OpenFileStore(path)
+		Expect(err).To(MatchError(ContainSubstring("line 1")))
+	})
+	It("compacts the file", func() {
+		store := open()
+		reg, _ := registry.New(registry.WithStore(store))
+		id, _ := reg.Register("dungen", "http://localhost:5000")
+		for i := 0; i < 1500; i++ {
+			reg.Heartbeat(id)
+		}
+		reg.Register("flard", "http://localhost:5001")
+		data, _ := os.ReadFile(path)
+		Expect(bytes.Count(data, []byte("\n"))).To(BeNumerically("<", 1000))
+		Expect(open().Len()).To(Equal(2))
+	})
+	It("removes draining instances when reopened", func() {
+		store := open()
+		reg, _ := registry.New(registry.WithStore(store))
+		reg.SetDefaultWindows(registry.Windows{Drain: time.Hour})
+		for i := 0; i < 3; i++ {
+			reg.Register("dungen", "http://localhost:500"+strconv.Itoa(i))
+		}
+		reg.Deregister(reg.Instances()[0].ID)
+
+		reg, err := registry.New(registry.WithStore(open()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reg.Instances()).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,162 @@
+// Package storetest has the tests that every registry.Store should pass,
+// for use in the Ginkgo suite of a Store:
+//
+//	var _ = Describe("MyStore", func() {
+//		storetest.DescribeStore(func() registry.Store { return NewMyStore() })
+//	})
+package storetest
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+// DescribeStore describes the behaviour of a Store. newStore is called before each spec,
+// and must return an empty store.
+func DescribeStore(newStore func() registry.Store) bool {
+	return Describe("as a registry.Store", func() {
+		var store registry.Store
+
+		// Times are without monotonic readings, which a Store may not keep.
+		registered := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+		instance := func(id string, name string) registry.Instance {
+			address, _ := registry.ParseAddress("http://10.0.0.1:80")
+			return registry.Instance{
+				ID:            id,
+				Name:          name,
+				Address:       address.String(),
+				Parsed:        address,
+				Tags:          map[string]string{"version": "1"},
+				Status:        registry.StatusUp,
+				Locality:      registry.Locality{Zone: "a", Region: "r"},
+				Registered:    registered,
+				LastHeartbeat: registered.Add(time.Second),
+				Load:          registry.Load{InFlight: 3, Capacity: 10},
+				LoadReported:  registered.Add(time.Second),
+			}
+		}
+		ids := func(instances []registry.Instance) []string {
+			ids := []string{}
+			for _, i := range instances {
+				ids = append(ids, i.ID)
+			}
+			return ids
+		}
+		put := func(instances ...registry.Instance) {
+			for _, i := range instances {
+				Expect(store.Put(i)).To(Succeed())
+			}
+		}
+
+		BeforeEach(func() {
+			store = newStore()
+		})
+
+		It("starts empty", func() {
+			_, ok := store.Get("1")
+			Expect(ok).To(BeFalse())
+			Expect(store.Name("dungen")).To(BeEmpty())
+			Expect(store.All()).To(BeEmpty())
+			Expect(store.Len()).To(Equal(0))
+		})
+		It("gets what was put", func() {
+			put(instance("1", "dungen"))
+			got, ok := store.Get("1")
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(instance("1", "dungen")))
+			Expect(store.Len()).To(Equal(1))
+		})
+		It("keeps the instances of a name in order", func() {
+			put(instance("1", "dungen"), instance("2", "flard"), instance("3", "dungen"), instance("4", "dungen"))
+			Expect(ids(store.Name("dungen"))).To(Equal([]string{"1", "3", "4"}))
+			Expect(ids(store.Name("flard"))).To(Equal([]string{"2"}))
+			Expect(store.Name("nope")).To(BeEmpty())
+		})
+		It("groups all instances by name", func() {
+			put(instance("1", "dungen"), instance("2", "flard"), instance("3", "dungen"))
+			all := ids(store.All())
+			Expect(all).To(ConsistOf("1", "2", "3"))
+			Expect(all).To(Or(Equal([]string{"1", "3", "2"}), Equal([]string{"2", "1", "3"})))
+		})
+		It("replaces an instance in place", func() {
+			put(instance("1", "dungen"), instance("2", "dungen"))
+			changed := instance("1", "dungen")
+			changed.Status = registry.StatusMaintenance
+			put(changed)
+			Expect(ids(store.Name("dungen"))).To(Equal([]string{"1", "2"}))
+			Expect(store.Name("dungen")[0].Status).To(Equal(registry.StatusMaintenance))
+			Expect(store.Len()).To(Equal(2))
+		})
+		It("moves an instance whose name changes", func() {
+			put(instance("1", "dungen"), instance("2", "dungen"))
+			put(instance("1", "flard"))
+			Expect(ids(store.Name("dungen"))).To(Equal([]string{"2"}))
+			Expect(ids(store.Name("flard"))).To(Equal([]string{"1"}))
+		})
+		It("deletes instances", func() {
+			put(instance("1", "dungen"), instance("2", "dungen"))
+			Expect(store.Delete("1")).To(Succeed())
+			_, ok := store.Get("1")
+			Expect(ok).To(BeFalse())
+			Expect(ids(store.Name("dungen"))).To(Equal([]string{"2"}))
+			Expect(store.Delete("2")).To(Succeed())
+			Expect(store.Name("dungen")).To(BeEmpty())
+			Expect(store.Len()).To(Equal(0))
+		})
+		It("ignores deleting unknown IDs", func() {
+			Expect(store.Delete("nope")).To(Succeed())
+		})
+		It("keeps copies", func() {
+			i := instance("1", "dungen")
+			put(i)
+			i.Tags["version"] = "2"
+			got, _ := store.Get("1")
+			got.Tags["version"] = "3"
+			store.Name("dungen")[0].Tags["version"] = "4"
+			store.All()[0].Tags["version"] = "5"
+			got, _ = store.Get("1")
+			Expect(got.Tags).To(Equal(map[string]string{"version": "1"}))
+		})
+
+		Context("backing a registry", func() {
+			var reg registry.Registry
+
+			BeforeEach(func() {
+				var err error
+				reg, err = registry.New(registry.WithStore(store))
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("registers, looks up and deregisters", func() {
+				id, err := reg.Register("dungen", "http://localhost:5000")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(store.Len()).To(Equal(1))
+				Expect(reg.Lookup("dungen")).To(Equal("http://localhost:5000"))
+				Expect(reg.Heartbeat(id)).To(BeTrue())
+				Expect(reg.Deregister(id)).To(Succeed())
+				Expect(reg.Lookup("dungen")).To(BeEmpty())
+				Expect(store.Len()).To(Equal(0))
+			})
+			It("saves changes to instances", func() {
+				id, _ := reg.Register("dungen", "http://localhost:5000")
+				Expect(reg.SetMaintenance(id, true)).To(Succeed())
+				stored, _ := store.Get(id)
+				Expect(stored.Status).To(Equal(registry.StatusMaintenance))
+
+				reg.HeartbeatLoad(id, registry.Load{InFlight: 7})
+				stored, _ = store.Get(id)
+				Expect(stored.Load.InFlight).To(Equal(7))
+			})
+			It("expires instances", func() {
+				reg.SetTimeout(10 * time.Millisecond)
+				reg.Register("dungen", "http://localhost:5000")
+				// The store is only read through the registry while it may be changing.
+				Eventually(reg.Instances).Should(BeEmpty())
+				Expect(store.Len()).To(Equal(0))
+			})
+		})
+	})
+}
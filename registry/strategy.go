@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Strategy decides which instance of a service a lookup returns.
+type Strategy string
+
+const (
+	// StrategyRandom picks any instance, with equal chance.
+	StrategyRandom Strategy = "random"
+	// StrategyLeastLoaded picks the less loaded of two random instances, using the
+	// load reported with heartbeats. Comparing two, rather than all, keeps every lookup
+	// between heartbeats from going to the same instance.
+	StrategyLeastLoaded Strategy = "least-loaded"
+)
+
+// Load is reported by an instance with its heartbeats. Every field is optional.
+type Load struct {
+	// InFlight is the number of requests being handled.
+	InFlight int
+	// CPU is the CPU utilization, from 0 to 1.
+	CPU float64
+	// QueueDepth is the number of requests waiting to be handled.
+	QueueDepth int
+	// Capacity is the number of requests the instance can handle at once.
+	Capacity int
+}
+
+// Score estimates how busy an instance is, where 1 is fully loaded.
+// It is the greater of the CPU utilization and the requests per unit of capacity.
+// Without a capacity, each request counts as 1.
+func (l Load) Score() float64 {
+	requests := float64(l.InFlight + l.QueueDepth)
+	if l.Capacity > 0 {
+		requests /= float64(l.Capacity)
+	}
+	return max(requests, l.CPU)
+}
+
+// ParseStrategy parses a strategy name, as used in flags.
+func ParseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case StrategyRandom, StrategyLeastLoaded:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown strategy %q", s)
+}
+
+// choose picks one of the candidates, which must not be empty.
+func choose(strategy Strategy, candidates []Instance) Instance {
+	first := candidates[rand.Intn(len(candidates))]
+	if strategy != StrategyLeastLoaded || len(candidates) == 1 {
+		return first
+	}
+	second := candidates[rand.Intn(len(candidates)-1)]
+	if second.ID == first.ID {
+		// Pick from the others, so the two are distinct.
+		second = candidates[len(candidates)-1]
+	}
+	if second.Load.Score() < first.Load.Score() {
+		return second
+	}
+	return first
+}
+
+// strategy must be called with the mutex held.
+func (s *ServiceRegistry) strategy(name string) Strategy {
+	if st, ok := s.strategies[name]; ok {
+		return st
+	}
+	return s.defaultStrategy
+}
+
+func (s *ServiceRegistry) SetStrategy(name string, strategy Strategy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.strategies[name] = strategy
+}
+
+func (s *ServiceRegistry) SetDefaultStrategy(strategy Strategy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultStrategy = strategy
+}
+
+func (s *ServiceRegistry) HeartbeatLoad(id string, load Load) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.beat(id, &load)
+}
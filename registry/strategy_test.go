@@ -0,0 +1,93 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+var _ = Describe("Strategy", func() {
+	const name = "flardmaster"
+
+	var reg registry.Registry
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+	})
+
+	Describe("ParseStrategy", func() {
+		It("accepts known strategies", func() {
+			st, err := registry.ParseStrategy("least-loaded")
+			Expect(err).To(BeNil())
+			Expect(st).To(Equal(registry.StrategyLeastLoaded))
+		})
+		It("rejects unknown strategies", func() {
+			_, err := registry.ParseStrategy("round-robin")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	Describe("Load.Score", func() {
+		It("divides requests by capacity", func() {
+			Expect(registry.Load{InFlight: 3, QueueDepth: 2, Capacity: 10}.Score()).To(Equal(0.5))
+		})
+		It("uses CPU when it is greater", func() {
+			Expect(registry.Load{InFlight: 1, Capacity: 10, CPU: 0.9}.Score()).To(Equal(0.9))
+		})
+		It("counts requests without a capacity", func() {
+			Expect(registry.Load{InFlight: 4}.Score()).To(Equal(4.0))
+		})
+	})
+
+	Describe("HeartbeatLoad", func() {
+		It("records the load", func() {
+			id, _ := reg.Register(name, "http://1.1.1.1:1")
+			Expect(reg.HeartbeatLoad(id, registry.Load{InFlight: 7})).To(BeTrue())
+			instances := reg.Instances()
+			Expect(instances[0].Load.InFlight).To(Equal(7))
+			Expect(instances[0].LoadReported).NotTo(BeZero())
+		})
+		It("fails for unknown IDs", func() {
+			Expect(reg.HeartbeatLoad("nope", registry.Load{})).To(BeFalse())
+		})
+	})
+
+	When("least loaded", func() {
+		BeforeEach(func() {
+			reg.SetStrategy(name, registry.StrategyLeastLoaded)
+		})
+
+		It("never returns the busier of two instances", func() {
+			idle, _ := reg.Register(name, "http://1.1.1.1:1")
+			busy, _ := reg.Register(name, "http://2.2.2.2:2")
+			reg.HeartbeatLoad(idle, registry.Load{InFlight: 1, Capacity: 10})
+			reg.HeartbeatLoad(busy, registry.Load{InFlight: 9, Capacity: 10})
+			for i := 0; i < 50; i++ {
+				address := reg.Lookup(name)
+				Expect(address).To(Equal("http://1.1.1.1:1"))
+			}
+		})
+
+		It("never returns the busiest of several instances", func() {
+			ids := make([]string, 4)
+			for i := range ids {
+				var err error
+				ids[i], err = reg.Register(name, "http://"+string(rune('a'+i))+":1")
+				Expect(err).NotTo(HaveOccurred())
+				reg.HeartbeatLoad(ids[i], registry.Load{CPU: float64(i) / 4})
+			}
+			for i := 0; i < 100; i++ {
+				address := reg.Lookup(name)
+				Expect(address).NotTo(BeEmpty())
+				Expect(address).NotTo(Equal("http://d:1"))
+			}
+		})
+
+		It("leaves other services random", func() {
+			reg.Register("other", "http://1.1.1.1:1")
+			address := reg.Lookup("other")
+			Expect(address).To(Equal("http://1.1.1.1:1"))
+		})
+	})
+})
@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+var ErrTraffic = errors.New("invalid traffic policy")
+
+// TrafficPolicy splits the lookups of a service between groups of instances,
+// by the value of a tag, for canary releases. For example, with Tag "version" and
+// Weights {"1": 90, "2": 10}, 90% of lookups return instances tagged version=1,
+// and 10% return instances tagged version=2.
+//
+// Weights are relative to the groups that have a candidate, so if no version=2 instance
+// is healthy, every lookup returns version=1. Instances in no weighted group are only
+// returned if no weighted group has a candidate.
+type TrafficPolicy struct {
+	Tag     string
+	Weights map[string]int
+}
+
+func (p TrafficPolicy) validate() error {
+	if p.Tag == "" {
+		return fmt.Errorf("%w: tag is required", ErrTraffic)
+	}
+	total := 0
+	for _, w := range p.Weights {
+		if w < 0 {
+			return fmt.Errorf("%w: weights may not be negative", ErrTraffic)
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("%w: at least one weight must be positive", ErrTraffic)
+	}
+	return nil
+}
+
+func copyWeights(weights map[string]int) map[string]int {
+	c := make(map[string]int, len(weights))
+	for k, v := range weights {
+		c[k] = v
+	}
+	return c
+}
+
+func (s *ServiceRegistry) SetTraffic(name string, policy TrafficPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.traffic[name] = TrafficPolicy{Tag: policy.Tag, Weights: copyWeights(policy.Weights)}
+	return nil
+}
+
+func (s *ServiceRegistry) ClearTraffic(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.traffic, name)
+}
+
+func (s *ServiceRegistry) Traffic() map[string]TrafficPolicy {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	traffic := make(map[string]TrafficPolicy, len(s.traffic))
+	for name, p := range s.traffic {
+		traffic[name] = TrafficPolicy{Tag: p.Tag, Weights: copyWeights(p.Weights)}
+	}
+	return traffic
+}
+
+// split returns the candidates in one group of the name's traffic policy, chosen by weight.
+// Without a policy, or if no weighted group has a candidate, it returns every candidate.
+// It must be called with the mutex held.
+func (s *ServiceRegistry) split(name string, candidates []Instance) []Instance {
+	policy, ok := s.traffic[name]
+	if !ok {
+		return candidates
+	}
+	groups := make(map[string][]Instance)
+	total := 0
+	for _, instance := range candidates {
+		value, tagged := instance.Tags[policy.Tag]
+		if !tagged || policy.Weights[value] <= 0 {
+			continue
+		}
+		if len(groups[value]) == 0 {
+			total += policy.Weights[value]
+		}
+		groups[value] = append(groups[value], instance)
+	}
+	if total == 0 {
+		return candidates
+	}
+	n := rand.Intn(total)
+	for value, group := range groups {
+		n -= policy.Weights[value]
+		if n < 0 {
+			return group
+		}
+	}
+	// Unreachable, as the weights of the groups sum to total.
+	return candidates
+}
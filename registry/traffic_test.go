@@ -0,0 +1,82 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+var _ = Describe("Traffic", func() {
+	const name = "flardmaster"
+
+	var reg registry.Registry
+
+	register := func(address string, version string) string {
+		id, _, err := reg.RegisterInstance(registry.Instance{
+			Name:    name,
+			Address: address,
+			Tags:    map[string]string{"version": version},
+		})
+		Expect(err).To(BeNil())
+		return id
+	}
+	// versions counts the versions returned by n lookups.
+	versions := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			instance, ok := reg.LookupInstance(name, nil)
+			Expect(ok).To(BeTrue())
+			counts[instance.Tags["version"]]++
+		}
+		return counts
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		register("http://1.1.1.1:1", "1")
+		register("http://1.1.1.2:1", "1")
+		register("http://2.2.2.2:2", "2")
+	})
+
+	It("splits lookups by weight", func() {
+		Expect(reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 90, "2": 10}})).To(Succeed())
+		counts := versions(2000)
+		Expect(counts["2"]).To(BeNumerically("~", 200, 80))
+		Expect(counts["1"]).To(BeNumerically("~", 1800, 80))
+	})
+	It("sends nothing to a group without weight", func() {
+		reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 0, "2": 1}})
+		Expect(versions(100)).To(Equal(map[string]int{"2": 100}))
+	})
+	It("shares the weight of a group without candidates", func() {
+		reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 1, "3": 99}})
+		Expect(versions(100)).To(Equal(map[string]int{"1": 100}))
+	})
+	It("uses every instance when no weighted group has a candidate", func() {
+		reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"3": 1}})
+		Expect(versions(200)).To(HaveLen(2))
+	})
+	It("applies after skipping unhealthy instances", func() {
+		reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 1, "2": 99}})
+		skip := func(i registry.Instance) bool { return i.Tags["version"] == "2" }
+		for i := 0; i < 20; i++ {
+			instance, ok := reg.LookupInstance(name, skip)
+			Expect(ok).To(BeTrue())
+			Expect(instance.Tags["version"]).To(Equal("1"))
+		}
+	})
+	It("can be cleared and inspected", func() {
+		reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"2": 1}})
+		Expect(reg.Traffic()).To(HaveKeyWithValue(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"2": 1}}))
+		reg.ClearTraffic(name)
+		Expect(reg.Traffic()).To(BeEmpty())
+		Expect(versions(200)).To(HaveLen(2))
+	})
+	It("refuses invalid policies", func() {
+		Expect(reg.SetTraffic(name, registry.TrafficPolicy{Weights: map[string]int{"1": 1}})).To(MatchError(registry.ErrTraffic))
+		Expect(reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": -1, "2": 5}})).To(MatchError(registry.ErrTraffic))
+		Expect(reg.SetTraffic(name, registry.TrafficPolicy{Tag: "version"})).To(MatchError(registry.ErrTraffic))
+		Expect(reg.Traffic()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,49 @@
+package registry
+
+import "context"
+
+func (s *ServiceRegistry) LookupWait(ctx context.Context, name string, near Locality, skip func(Instance) bool) (Instance, bool) {
+	for {
+		s.mutex.Lock()
+		if instance, ok := s.lookup(name, near, skip); ok {
+			s.mutex.Unlock()
+			return instance, true
+		}
+		woken := make(chan struct{})
+		s.waiters[name] = append(s.waiters[name], woken)
+		s.mutex.Unlock()
+
+		select {
+		case <-woken:
+			// Something changed, which may not have made an instance available.
+		case <-ctx.Done():
+			s.mutex.Lock()
+			s.unwait(name, woken)
+			s.mutex.Unlock()
+			return Instance{}, false
+		}
+	}
+}
+
+// wake wakes every waiter for the name. It must be called with the mutex held.
+func (s *ServiceRegistry) wake(name string) {
+	for _, woken := range s.waiters[name] {
+		close(woken)
+	}
+	delete(s.waiters, name)
+}
+
+// unwait removes a waiter that gave up, if it hasn't been woken.
+// It must be called with the mutex held.
+func (s *ServiceRegistry) unwait(name string, woken chan struct{}) {
+	waiters := s.waiters[name]
+	for i, w := range waiters {
+		if w == woken {
+			s.waiters[name] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(s.waiters[name]) == 0 {
+		delete(s.waiters, name)
+	}
+}
@@ -0,0 +1,61 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+var _ = Describe("LookupWait", func() {
+	var reg registry.Registry
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+	})
+
+	It("returns at once if an instance is registered", func() {
+		reg.Register("dungen", "http://localhost:5000")
+		instance, ok := reg.LookupWait(context.Background(), "dungen", registry.Locality{}, nil)
+		Expect(ok).To(BeTrue())
+		Expect(instance.Address).To(Equal("http://localhost:5000"))
+	})
+	It("waits for an instance to register", func() {
+		found := make(chan string)
+		go func() {
+			defer GinkgoRecover()
+			instance, ok := reg.LookupWait(context.Background(), "dungen", registry.Locality{}, nil)
+			Expect(ok).To(BeTrue())
+			found <- instance.Address
+		}()
+		Consistently(found, 50*time.Millisecond).ShouldNot(Receive())
+		reg.Register("flard", "http://localhost:5001")
+		Consistently(found, 50*time.Millisecond).ShouldNot(Receive())
+		reg.Register("dungen", "http://localhost:5000")
+		Eventually(found).Should(Receive(Equal("http://localhost:5000")))
+	})
+	It("waits for an instance it may return", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		reg.Register("dungen", "http://localhost:5000")
+		skip := func(registry.Instance) bool { return true }
+		_, ok := reg.LookupWait(ctx, "dungen", registry.Locality{}, skip)
+		Expect(ok).To(BeFalse())
+	})
+	It("gives up when the context is done", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, ok := reg.LookupWait(ctx, "dungen", registry.Locality{}, nil)
+		Expect(ok).To(BeFalse())
+		Expect(time.Since(start)).To(BeNumerically(">=", 20*time.Millisecond))
+
+		// Registering after giving up doesn't block on the abandoned waiter.
+		reg.Register("dungen", "http://localhost:5000")
+		_, ok = reg.LookupWait(context.Background(), "dungen", registry.Locality{}, nil)
+		Expect(ok).To(BeTrue())
+	})
+})
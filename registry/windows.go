@@ -0,0 +1,97 @@
+package registry
+
+import "time"
+
+// Windows delay an instance's entry into, and removal from, lookups.
+type Windows struct {
+	// Warmup keeps a new instance out of lookups until its first heartbeat,
+	// or until Warmup has passed, whichever is first.
+	Warmup time.Duration
+	// Drain keeps a deregistered or expired instance registered, as draining,
+	// for Drain before it is removed, so that callers that just looked it up
+	// aren't sent to a removed instance. Draining instances are not returned by lookups.
+	Drain time.Duration
+}
+
+// windows must be called with the mutex held.
+func (s *ServiceRegistry) windows(name string) Windows {
+	if w, ok := s.windowsByName[name]; ok {
+		return w
+	}
+	return s.defaultWindows
+}
+
+func (s *ServiceRegistry) SetWindows(name string, windows Windows) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.windowsByName[name] = windows
+}
+
+func (s *ServiceRegistry) SetDefaultWindows(windows Windows) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultWindows = windows
+}
+
+// startWarmup puts a new or revived instance into warmup, if its service has a warmup window,
+// setting its status for the caller to save. It must be called with the mutex held.
+func (s *ServiceRegistry) startWarmup(instance *Instance, entry *service_entry) {
+	warmup := s.windows(instance.Name).Warmup
+	if warmup <= 0 {
+		instance.Status = StatusUp
+		return
+	}
+	instance.Status = StatusWarming
+	id := instance.ID
+	s.clock.AfterFunc(warmup, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.entries[id] == entry {
+			s.warm(id)
+		}
+	})
+}
+
+// warm ends an instance's warmup. It must be called with the mutex held.
+// If the Store fails, the instance stays warm until its next heartbeat.
+func (s *ServiceRegistry) warm(id string) {
+	instance, ok := s.store.Get(id)
+	if !ok || instance.Status != StatusWarming {
+		return
+	}
+	instance.Status = StatusUp
+	if s.store.Put(instance) == nil {
+		s.emit(EventStatus, instance)
+	}
+}
+
+// drain removes the instance, after its service's drain window if it has one.
+// event is emitted on removal. It must be called with the mutex held.
+func (s *ServiceRegistry) drain(instance Instance, event EventType) error {
+	window := s.windows(instance.Name).Drain
+	if window <= 0 {
+		if err := s.remove(instance.ID); err != nil {
+			return err
+		}
+		s.emit(event, instance)
+		return nil
+	}
+	if instance.Status == StatusDraining {
+		return nil
+	}
+	instance.Status = StatusDraining
+	if err := s.store.Put(instance); err != nil {
+		return storageError(err)
+	}
+	entry := s.entries[instance.ID]
+	entry.drainUntil = s.clock.Now().Add(window)
+	entry.drainEvent = event
+	s.emit(EventStatus, instance)
+	// Static entries have no expiry timer to remove them.
+	s.clock.AfterFunc(window, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.expire(instance.ID, entry)
+	})
+	return nil
+}
@@ -0,0 +1,141 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/registry/clocktest"
+)
+
+var _ = Describe("Windows", func() {
+	const name = "flardmaster"
+	const address = "http://128.128.128.128:128"
+	const timeout = 30 * time.Second
+
+	var reg registry.Registry
+	var clock *clocktest.Clock
+
+	status := func(id string) func() string {
+		return func() string {
+			instance, _ := reg.Instance(id)
+			return instance.Status
+		}
+	}
+
+	present := func(id string) bool {
+		_, ok := reg.Instance(id)
+		return ok
+	}
+
+	BeforeEach(func() {
+		clock = clocktest.New(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+		reg, _ = registry.New(registry.WithClock(clock), registry.WithTimeout(timeout))
+	})
+
+	Describe("warmup", func() {
+		var id string
+
+		const warmup = 5 * time.Second
+
+		BeforeEach(func() {
+			reg.SetWindows(name, registry.Windows{Warmup: warmup})
+			id, _ = reg.Register(name, address)
+		})
+
+		It("keeps new instances out of lookups", func() {
+			Expect(status(id)()).To(Equal(registry.StatusWarming))
+			Expect(reg.Lookup(name)).To(BeEmpty())
+		})
+		It("ends at the first heartbeat", func() {
+			reg.Heartbeat(id)
+			Expect(status(id)()).To(Equal(registry.StatusUp))
+			Expect(reg.Lookup(name)).To(Equal(address))
+		})
+		It("ends after the window", func() {
+			clock.Advance(warmup - time.Millisecond)
+			Expect(status(id)()).To(Equal(registry.StatusWarming))
+			clock.Advance(time.Millisecond)
+			Expect(status(id)()).To(Equal(registry.StatusUp))
+			Expect(reg.Lookup(name)).To(Equal(address))
+		})
+		It("applies only to its service", func() {
+			reg.Register("other", address)
+			Expect(reg.Lookup("other")).To(Equal(address))
+		})
+	})
+
+	Describe("drain", func() {
+		var id string
+
+		const drain = 10 * time.Second
+
+		BeforeEach(func() {
+			reg.SetDefaultWindows(registry.Windows{Drain: drain})
+			id, _ = reg.Register(name, address)
+		})
+
+		It("keeps deregistered instances as draining, then removes them", func() {
+			Expect(reg.Deregister(id)).To(Succeed())
+			Expect(status(id)()).To(Equal(registry.StatusDraining))
+			Expect(reg.Lookup(name)).To(BeEmpty())
+			clock.Advance(drain - time.Millisecond)
+			Expect(present(id)).To(BeTrue())
+			clock.Advance(time.Millisecond)
+			Expect(present(id)).To(BeFalse())
+		})
+		It("drains expired instances", func() {
+			clock.Advance(timeout)
+			Expect(status(id)()).To(Equal(registry.StatusDraining))
+			clock.Advance(drain)
+			Expect(present(id)).To(BeFalse())
+		})
+		It("refuses heartbeats while draining", func() {
+			reg.Deregister(id)
+			Expect(reg.Heartbeat(id)).To(BeFalse())
+		})
+		It("is not removed sooner by deregistering again", func() {
+			reg.Deregister(id)
+			Expect(reg.Deregister(id)).To(Succeed())
+			Expect(status(id)()).To(Equal(registry.StatusDraining))
+		})
+		It("is ended by ForceDeregister", func() {
+			reg.Deregister(id)
+			Expect(reg.ForceDeregister(id)).To(Succeed())
+			_, ok := reg.Instance(id)
+			Expect(ok).To(BeFalse())
+		})
+		It("is revived by registering again with the same ID", func() {
+			id, _, _ = reg.RegisterInstance(registry.Instance{Name: name, Address: address, ID: "one"})
+			reg.Deregister(id)
+			_, result, err := reg.RegisterInstance(registry.Instance{Name: name, Address: address, ID: "one"})
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(registry.ResultUpdated))
+			Expect(status(id)()).To(Equal(registry.StatusUp))
+			clock.Advance(drain)
+			Expect(status(id)()).To(Equal(registry.StatusUp))
+		})
+		It("does not conflict with new instances", func() {
+			reg.SetPolicy(name, registry.PolicySingleton)
+			reg.Deregister(id)
+			_, _, err := reg.RegisterInstance(registry.Instance{Name: name, Address: "http://129.129.129.129:129"})
+			Expect(err).To(BeNil())
+		})
+		It("is left out of snapshots", func() {
+			reg.Deregister(id)
+			Expect(reg.Snapshot().Instances).To(BeEmpty())
+		})
+		It("reports removal after draining", func() {
+			var events []registry.EventType
+			reg.AddHook(func(e registry.Event) {
+				events = append(events, e.Type)
+			})
+			reg.Deregister(id)
+			clock.Advance(drain)
+			Expect(reg.Instances()).To(BeEmpty())
+			Expect(events).To(Equal([]registry.EventType{registry.EventStatus, registry.EventDeregistered}))
+		})
+	})
+})
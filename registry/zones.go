@@ -0,0 +1,89 @@
+package registry
+
+import "fmt"
+
+// Locality is where an instance, or a caller, runs. Either field may be empty.
+type Locality struct {
+	// Zone is a failure domain, such as a rack or an availability zone, like "eu-west-1a".
+	Zone string
+	// Region contains zones, like "eu-west-1".
+	Region string
+}
+
+// Fallback decides which instances a lookup may return when none are healthy
+// in the caller's zone.
+type Fallback string
+
+const (
+	// FallbackAny tries the caller's region, then any instance.
+	FallbackAny Fallback = "any"
+	// FallbackRegion tries the caller's region, but no further.
+	FallbackRegion Fallback = "region"
+	// FallbackNone only returns instances in the caller's zone.
+	FallbackNone Fallback = "none"
+)
+
+// ParseFallback parses a fallback name, as used in flags.
+func ParseFallback(s string) (Fallback, error) {
+	switch f := Fallback(s); f {
+	case FallbackAny, FallbackRegion, FallbackNone:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown fallback %q", s)
+}
+
+// fallback must be called with the mutex held.
+func (s *ServiceRegistry) fallback(name string) Fallback {
+	if f, ok := s.fallbacks[name]; ok {
+		return f
+	}
+	return s.defaultFallback
+}
+
+func (s *ServiceRegistry) SetFallback(name string, fallback Fallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fallbacks[name] = fallback
+}
+
+func (s *ServiceRegistry) SetDefaultFallback(fallback Fallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultFallback = fallback
+}
+
+// nearest returns the candidates closest to near: those in its zone if there are any,
+// otherwise as far as the fallback allows. A caller without a zone starts at its region,
+// and a caller without either has no preference.
+func nearest(candidates []Instance, near Locality, fallback Fallback) []Instance {
+	if near.Zone != "" {
+		if local := filter(candidates, func(i Instance) bool { return i.Zone == near.Zone }); len(local) > 0 {
+			return local
+		}
+		if fallback == FallbackNone {
+			return nil
+		}
+	}
+	if near.Region != "" {
+		if regional := filter(candidates, func(i Instance) bool { return i.Region == near.Region }); len(regional) > 0 {
+			return regional
+		}
+		if fallback != FallbackAny {
+			return nil
+		}
+	} else if near.Zone != "" && fallback == FallbackRegion {
+		// The caller's region is unknown, so no other zone is known to be in it.
+		return nil
+	}
+	return candidates
+}
+
+func filter(instances []Instance, keep func(Instance) bool) []Instance {
+	var kept []Instance
+	for _, instance := range instances {
+		if keep(instance) {
+			kept = append(kept, instance)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,95 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+var _ = Describe("Zones", func() {
+	const name = "flardmaster"
+
+	var reg registry.Registry
+
+	register := func(address string, zone string, region string) string {
+		id, _, err := reg.RegisterInstance(registry.Instance{
+			Name:     name,
+			Address:  address,
+			Locality: registry.Locality{Zone: zone, Region: region},
+		})
+		Expect(err).To(BeNil())
+		return id
+	}
+	// lookups returns the addresses found by repeated lookups from near.
+	lookups := func(near registry.Locality) map[string]bool {
+		found := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			if instance, ok := reg.LookupNear(name, near, nil); ok {
+				found[instance.Address] = true
+			}
+		}
+		return found
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		register("http://1.1.1.1:1", "eu-west-1a", "eu-west-1")
+		register("http://2.2.2.2:2", "eu-west-1b", "eu-west-1")
+		register("http://3.3.3.3:3", "us-east-1a", "us-east-1")
+	})
+
+	Describe("ParseFallback", func() {
+		It("accepts known fallbacks", func() {
+			f, err := registry.ParseFallback("region")
+			Expect(err).To(BeNil())
+			Expect(f).To(Equal(registry.FallbackRegion))
+		})
+		It("rejects unknown fallbacks", func() {
+			_, err := registry.ParseFallback("nearest")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	It("records the locality of instances", func() {
+		instance, _ := reg.LookupNear(name, registry.Locality{Zone: "us-east-1a"}, nil)
+		Expect(instance.Locality).To(Equal(registry.Locality{Zone: "us-east-1a", Region: "us-east-1"}))
+	})
+	It("prefers the caller's zone", func() {
+		Expect(lookups(registry.Locality{Zone: "eu-west-1a", Region: "eu-west-1"})).To(Equal(map[string]bool{"http://1.1.1.1:1": true}))
+	})
+	It("has no preference without a locality", func() {
+		Expect(lookups(registry.Locality{})).To(HaveLen(3))
+	})
+	It("prefers the caller's region without a zone", func() {
+		Expect(lookups(registry.Locality{Region: "eu-west-1"})).To(HaveLen(2))
+	})
+	It("falls back when the caller's zone has no healthy instance", func() {
+		skip := func(i registry.Instance) bool { return i.Zone == "eu-west-1a" }
+		instance, ok := reg.LookupNear(name, registry.Locality{Zone: "eu-west-1a", Region: "eu-west-1"}, skip)
+		Expect(ok).To(BeTrue())
+		Expect(instance.Address).To(Equal("http://2.2.2.2:2"))
+	})
+
+	Context("with an empty zone", func() {
+		near := registry.Locality{Zone: "eu-west-1c", Region: "eu-west-1"}
+
+		It("falls back to the region, then any instance", func() {
+			Expect(lookups(near)).To(HaveLen(2))
+			Expect(lookups(registry.Locality{Zone: "ap-south-1a", Region: "ap-south-1"})).To(HaveLen(3))
+		})
+		It("falls back only to the region with FallbackRegion", func() {
+			reg.SetFallback(name, registry.FallbackRegion)
+			Expect(lookups(near)).To(HaveLen(2))
+			_, ok := reg.LookupNear(name, registry.Locality{Zone: "ap-south-1a", Region: "ap-south-1"}, nil)
+			Expect(ok).To(BeFalse())
+			_, ok = reg.LookupNear(name, registry.Locality{Zone: "eu-west-1c"}, nil)
+			Expect(ok).To(BeFalse())
+		})
+		It("doesn't fall back with FallbackNone", func() {
+			reg.SetDefaultFallback(registry.FallbackNone)
+			_, ok := reg.LookupNear(name, near, nil)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
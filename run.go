@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ifIMust/srsr/sidecar"
+)
+
+const runUsage = "Usage: srsr run -name NAME [-id ID] [-zone ZONE] [-region REGION] [-address ADDRESS] [-port PORT] [-s SERVER[,SERVER...]] [-health-url URL] -- COMMAND [ARGS]"
+
+// run registers a child process for as long as it lives, and exits with its exit code.
+func run(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), runUsage)
+		fs.PrintDefaults()
+	}
+	var cfg sidecar.Config
+	fs.StringVar(&cfg.Name, "name", "", "Service name to register.")
+	fs.StringVar(&cfg.Address, "address", "", "Address to register. If empty, the server deduces it.")
+	fs.StringVar(&cfg.Port, "port", "", "Port to register.")
+	fs.StringVar(&cfg.InstanceID, "id", "", "Stable instance ID to register, such as the host name. Random if empty.")
+	fs.StringVar(&cfg.Zone, "zone", "", "Zone to register, for zone-aware lookups.")
+	fs.StringVar(&cfg.Region, "region", "", "Region to register, for zone-aware lookups.")
+	servers := fs.String("s", "http://localhost:4214", "Registry server addresses, separated by commas.")
+	fs.StringVar(&cfg.HealthURL, "health-url", "", "Only register while this URL responds with a 2xx status.")
+	fs.DurationVar(&cfg.HealthInterval, "health-interval", 5*time.Second, "How often to check the health URL.")
+	fs.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", 20*time.Second, "How often to send heartbeats. Must be shorter than the server's timeout.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg.Command = fs.Args()
+	if cfg.Name == "" || len(cfg.Command) == 0 {
+		fs.Usage()
+		return 2
+	}
+	cfg.Servers = strings.Split(*servers, ",")
+	cfg.Logger = log.New(os.Stderr, "srsr run: ", log.LstdFlags)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	cfg.Signals = signals
+
+	code, err := sidecar.Run(cfg)
+	if err != nil {
+		cfg.Logger.Println(err)
+		return 1
+	}
+	return code
+}
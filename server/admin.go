@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+)
+
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// adminAuth accepts the token as a bearer token, or as the password of basic auth,
+// so that browsers can prompt for it.
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var presented string
+		// The identity is the basic auth user name, if any, for the audit log.
+		identity := "admin"
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			presented = bearer
+		} else if user, password, ok := c.Request.BasicAuth(); ok {
+			presented = password
+			if user != "" {
+				identity = user
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="srsr admin"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin authorization required"})
+			return
+		}
+		c.Set(identityKey, identity)
+		c.Next()
+	}
+}
+
+// rejectForgery refuses changes that a browser could have been tricked into sending
+// by another site, with basic auth credentials it remembers. Such a request says it is
+// from another site, in Sec-Fetch-Site, or its body isn't JSON, since a page can't
+// send JSON to another origin without its permission, which the admin API doesn't give.
+func rejectForgery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if site := c.GetHeader("Sec-Fetch-Site"); site == "cross-site" || site == "same-site" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin requests from other sites are refused"})
+			return
+		}
+		if c.ContentType() != "application/json" {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "admin requests must have Content-Type application/json"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func instanceInfo(instance registry.Instance, ttl time.Duration, now time.Time) message.InstanceInfo {
+	age := now.Sub(instance.LastHeartbeat)
+	if instance.Static {
+		ttl = 0
+		age = 0
+	}
+	var load *message.Load
+	if !instance.LoadReported.IsZero() {
+		l := message.Load(instance.Load)
+		load = &l
+	}
+	return message.InstanceInfo{
+		ID:            instance.ID,
+		Name:          instance.Name,
+		Address:       instance.Address,
+		Tags:          instance.Tags,
+		Status:        instance.Status,
+		Static:        instance.Static,
+		Zone:          instance.Zone,
+		Region:        instance.Region,
+		Registered:    instance.Registered,
+		LastHeartbeat: instance.LastHeartbeat,
+		HeartbeatAge:  age.Seconds(),
+		ExpiresIn:     max(ttl-age, 0).Seconds(),
+		TTL:           ttl.Seconds(),
+		Load:          load,
+	}
+}
+
+func instances(c *gin.Context, sr registry.Registry) {
+	now := time.Now()
+	ttl := sr.Timeout()
+	r := message.InstancesResponse{Success: true, Instances: []message.InstanceInfo{}}
+	for _, instance := range sr.Instances() {
+		r.Instances = append(r.Instances, instanceInfo(instance, ttl, now))
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+func maintenance(c *gin.Context, sr registry.Registry) {
+	var request message.MaintenanceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := sr.SetMaintenance(request.ID, request.Maintenance)
+	inst, _ := sr.Instance(request.ID)
+	audit(c, "maintenance", "name", inst.Name, "id", request.ID, "address", inst.Address,
+		"maintenance", request.Maintenance, "success", err == nil)
+	if errors.Is(err, registry.ErrStorage) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, message.MaintenanceResponse{Success: err == nil})
+}
+
+func policy(c *gin.Context, sr registry.Registry) {
+	var request message.PolicyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := registry.ParsePolicy(request.Policy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sr.SetPolicy(request.Name, p)
+	audit(c, "policy", "name", request.Name, "policy", string(p))
+	c.JSON(http.StatusOK, message.PolicyResponse{Success: true})
+}
+
+func windows(c *gin.Context, sr registry.Registry) {
+	var request message.WindowsRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.WarmupSeconds < 0 || request.DrainSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "windows may not be negative"})
+		return
+	}
+	w := registry.Windows{
+		Warmup: time.Duration(request.WarmupSeconds * float64(time.Second)),
+		Drain:  time.Duration(request.DrainSeconds * float64(time.Second)),
+	}
+	sr.SetWindows(request.Name, w)
+	audit(c, "windows", "name", request.Name, "warmup", w.Warmup, "drain", w.Drain)
+	c.JSON(http.StatusOK, message.WindowsResponse{Success: true})
+}
+
+func fallback(c *gin.Context, sr registry.Registry) {
+	var request message.FallbackRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := registry.ParseFallback(request.Fallback)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sr.SetFallback(request.Name, f)
+	audit(c, "fallback", "name", request.Name, "fallback", string(f))
+	c.JSON(http.StatusOK, message.FallbackResponse{Success: true})
+}
+
+// setupAdmin serves the admin routes. They are authenticated before their bodies are limited,
+// so that only admins may send larger snapshots.
+func setupAdmin(admin *gin.RouterGroup, sr registry.Registry, hooks *dispatcher, maxBodyBytes int64) {
+	limit := limitBody(maxBodyBytes)
+	admin.GET("/", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+	})
+	admin.GET("/api/instances", func(c *gin.Context) {
+		instances(c, sr)
+	})
+	// Force-deregister uses the same request and response as /deregister,
+	// and may remove static instances.
+	admin.POST("/api/deregister", limit, func(c *gin.Context) {
+		deregister(c, sr, true, false)
+	})
+	admin.POST("/api/static", limit, func(c *gin.Context) {
+		registerStatic(c, sr)
+	})
+	admin.POST("/api/maintenance", limit, func(c *gin.Context) {
+		maintenance(c, sr)
+	})
+	admin.POST("/api/policy", limit, func(c *gin.Context) {
+		policy(c, sr)
+	})
+	admin.POST("/api/windows", limit, func(c *gin.Context) {
+		windows(c, sr)
+	})
+	admin.POST("/api/fallback", limit, func(c *gin.Context) {
+		fallback(c, sr)
+	})
+	admin.GET("/api/traffic", func(c *gin.Context) {
+		traffic(c, sr)
+	})
+	admin.POST("/api/traffic", limit, func(c *gin.Context) {
+		setTraffic(c, sr)
+	})
+	admin.GET("/api/webhooks/dead-letters", func(c *gin.Context) {
+		deadLetters(c, hooks)
+	})
+	admin.GET("/snapshot", func(c *gin.Context) {
+		getSnapshot(c, sr)
+	})
+	admin.POST("/snapshot", limitBody(maxSnapshotBytes), func(c *gin.Context) {
+		restoreSnapshot(c, sr)
+	})
+}
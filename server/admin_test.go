@@ -0,0 +1,334 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("Admin", func() {
+	const token = "sekrit"
+
+	var reg registry.Registry
+	var router *gin.Engine
+	var responseRecorder *httptest.ResponseRecorder
+	var id string
+
+	send := func(method string, path string, body string, auth func(*http.Request)) {
+		responseRecorder = httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			reqHTTP.Header.Set("Content-Type", "application/json")
+		}
+		if auth != nil {
+			auth(reqHTTP)
+		}
+		router.ServeHTTP(responseRecorder, reqHTTP)
+	}
+	bearer := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		router = server.SetupRouter(reg, server.WithAdminToken(token))
+		id, _, _ = reg.RegisterInstance(registry.Instance{
+			Name:    "dungen",
+			Address: "http://localhost:5000",
+			Tags:    map[string]string{"version": "2"},
+		})
+	})
+
+	Context("authorization", func() {
+		It("is not served without a token", func() {
+			router = server.SetupRouter(reg)
+			send("GET", "/admin/api/instances", "", bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+		})
+		It("rejects a missing token", func() {
+			send("GET", "/admin/api/instances", "", nil)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.Header().Get("WWW-Authenticate")).To(ContainSubstring("Basic"))
+		})
+		It("rejects a wrong token", func() {
+			send("GET", "/admin/api/instances", "", func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer nope")
+			})
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+		})
+		It("accepts a bearer token", func() {
+			send("GET", "/admin/api/instances", "", bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		})
+		It("accepts the token as basic auth password", func() {
+			send("GET", "/admin/api/instances", "", func(r *http.Request) {
+				r.SetBasicAuth("admin", token)
+			})
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("refuses changes that aren't JSON, as a form from another site would be", func() {
+			responseRecorder = httptest.NewRecorder()
+			reqHTTP, _ := http.NewRequest("POST", "/admin/api/deregister", strings.NewReader(`{"id": "`+id+`"}`))
+			reqHTTP.Header.Set("Content-Type", "text/plain")
+			reqHTTP.SetBasicAuth("admin", token)
+			router.ServeHTTP(responseRecorder, reqHTTP)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+			Expect(reg.Lookup("dungen")).NotTo(BeEmpty())
+		})
+		It("refuses changes from other sites", func() {
+			send("POST", "/admin/api/deregister", `{"id": "`+id+`"}`, func(r *http.Request) {
+				r.SetBasicAuth("admin", token)
+				r.Header.Set("Sec-Fetch-Site", "cross-site")
+			})
+			Expect(responseRecorder.Code).To(Equal(http.StatusForbidden))
+			Expect(reg.Lookup("dungen")).NotTo(BeEmpty())
+		})
+		It("accepts changes from the dashboard", func() {
+			send("POST", "/admin/api/deregister", `{"id": "`+id+`"}`, func(r *http.Request) {
+				r.SetBasicAuth("admin", token)
+				r.Header.Set("Sec-Fetch-Site", "same-origin")
+			})
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(reg.Lookup("dungen")).To(BeEmpty())
+		})
+	})
+
+	Context("dashboard", func() {
+		It("serves HTML", func() {
+			send("GET", "/admin/", "", bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Header().Get("Content-Type")).To(HavePrefix("text/html"))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("srsr"))
+		})
+	})
+
+	Context("instances", func() {
+		It("lists registered instances", func() {
+			send("GET", "/admin/api/instances", "", bearer)
+			r := message.InstancesResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Success).To(BeTrue())
+			Expect(r.Instances).To(HaveLen(1))
+			instance := r.Instances[0]
+			Expect(instance.ID).To(Equal(id))
+			Expect(instance.Name).To(Equal("dungen"))
+			Expect(instance.Address).To(Equal("http://localhost:5000"))
+			Expect(instance.Tags).To(HaveKeyWithValue("version", "2"))
+			Expect(instance.Status).To(Equal(registry.StatusUp))
+			Expect(instance.TTL).To(Equal(reg.Timeout().Seconds()))
+			Expect(instance.ExpiresIn).To(BeNumerically("<=", instance.TTL))
+		})
+	})
+
+	Context("actions", func() {
+		It("force-deregisters", func() {
+			send("POST", "/admin/api/deregister", `{"id": "`+id+`"}`, bearer)
+			r := message.DeregisterResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Success).To(BeTrue())
+			Expect(reg.Lookup("dungen")).To(BeEmpty())
+		})
+		It("puts an instance into maintenance and back", func() {
+			send("POST", "/admin/api/maintenance", `{"id": "`+id+`", "maintenance": true}`, bearer)
+			r := message.MaintenanceResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Success).To(BeTrue())
+			Expect(reg.Lookup("dungen")).To(BeEmpty())
+
+			send("POST", "/admin/api/maintenance", `{"id": "`+id+`", "maintenance": false}`, bearer)
+			Expect(reg.Lookup("dungen")).To(Equal("http://localhost:5000"))
+		})
+		It("sets a registration policy", func() {
+			send("POST", "/admin/api/policy", `{"name": "dungen", "policy": "reject"}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			_, _, err := reg.RegisterInstance(registry.Instance{Name: "dungen", Address: "http://localhost:5000"})
+			Expect(err).To(MatchError(registry.ErrConflict))
+		})
+		It("sets warmup and drain windows", func() {
+			send("POST", "/admin/api/windows", `{"name": "dungen", "warmup_seconds": 60, "drain_seconds": 60}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			newID, _ := reg.Register("dungen", "http://localhost:5001")
+			instance, _ := reg.Instance(newID)
+			Expect(instance.Status).To(Equal(registry.StatusWarming))
+			reg.Deregister(id)
+			instance, _ = reg.Instance(id)
+			Expect(instance.Status).To(Equal(registry.StatusDraining))
+		})
+		It("rejects negative windows", func() {
+			send("POST", "/admin/api/windows", `{"name": "dungen", "drain_seconds": -1}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("sets a zone fallback", func() {
+			send("POST", "/admin/api/fallback", `{"name": "dungen", "fallback": "none"}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			_, ok := reg.LookupNear("dungen", registry.Locality{Zone: "eu-west-1a"}, nil)
+			Expect(ok).To(BeFalse())
+		})
+		It("rejects an unknown fallback", func() {
+			send("POST", "/admin/api/fallback", `{"name": "dungen", "fallback": "nearest"}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("sets, shows and clears a traffic policy", func() {
+			reg.RegisterInstance(registry.Instance{Name: "dungen", Address: "http://localhost:5001", Tags: map[string]string{"version": "3"}})
+			send("POST", "/admin/api/traffic", `{"name": "dungen", "tag": "version", "weights": {"2": 90, "3": 10, "4": 5}}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+
+			send("GET", "/admin/api/traffic", "", bearer)
+			r := message.TrafficPoliciesResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Policies).To(HaveLen(1))
+			p := r.Policies[0]
+			Expect(p.Name).To(Equal("dungen"))
+			Expect(p.Tag).To(Equal("version"))
+			Expect(p.Instances).To(Equal(map[string]int{"2": 1, "3": 1}))
+			Expect(p.Share).To(Equal(map[string]float64{"2": 0.9, "3": 0.1, "4": 0}))
+
+			send("POST", "/admin/api/traffic", `{"name": "dungen"}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(reg.Traffic()).To(BeEmpty())
+		})
+		It("rejects an invalid traffic policy", func() {
+			send("POST", "/admin/api/traffic", `{"name": "dungen", "tag": "version", "weights": {"2": -1}}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("negative"))
+		})
+		It("rejects an unknown policy", func() {
+			send("POST", "/admin/api/policy", `{"name": "dungen", "policy": "anarchy"}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("rejects actions without a token", func() {
+			send("POST", "/admin/api/deregister", `{"id": "`+id+`"}`, nil)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(reg.Lookup("dungen")).NotTo(BeEmpty())
+		})
+	})
+
+	Context("snapshot", func() {
+		var snapshot string
+
+		BeforeEach(func() {
+			reg.SetPolicy("dungen", registry.PolicyReplace)
+			reg.SetWindows("dungen", registry.Windows{Warmup: 2 * time.Second, Drain: 5 * time.Second})
+			reg.SetFallback("dungen", registry.FallbackRegion)
+			reg.SetTraffic("dungen", registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 90, "2": 10}})
+			send("GET", "/admin/snapshot", "", bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			snapshot = responseRecorder.Body.String()
+		})
+
+		It("describes the registry", func() {
+			r := message.Snapshot{}
+			json.Unmarshal([]byte(snapshot), &r)
+			Expect(r.Version).To(Equal(message.SnapshotVersion))
+			Expect(r.TimeoutSeconds).To(Equal(30.0))
+			Expect(r.Policies).To(HaveKeyWithValue("dungen", "replace"))
+			Expect(r.Windows).To(HaveKeyWithValue("dungen", message.Windows{WarmupSeconds: 2, DrainSeconds: 5}))
+			Expect(r.Fallbacks).To(HaveKeyWithValue("dungen", "region"))
+			Expect(r.Traffic).To(HaveKeyWithValue("dungen", message.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 90, "2": 10}}))
+			Expect(r.Instances).To(HaveLen(1))
+			Expect(r.Instances[0].ID).To(Equal(id))
+			Expect(r.Instances[0].TTL).To(Equal(30.0))
+		})
+		It("restores into another server", func() {
+			other := registry.NewServiceRegistry()
+			other.Register("other", "http://localhost:6000")
+			router = server.SetupRouter(other, server.WithAdminToken(token))
+			send("POST", "/admin/snapshot?mode=replace&reset_deadlines=true", snapshot, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			r := message.RestoreResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Success).To(BeTrue())
+			Expect(r.Restored).To(Equal(1))
+
+			instances := other.Instances()
+			Expect(instances).To(HaveLen(1))
+			Expect(instances[0].ID).To(Equal(id))
+			Expect(instances[0].Tags).To(HaveKeyWithValue("version", "2"))
+
+			restored := other.Snapshot()
+			Expect(restored.Policies).To(HaveKeyWithValue("dungen", registry.PolicyReplace))
+			Expect(restored.Windows).To(HaveKeyWithValue("dungen", registry.Windows{Warmup: 2 * time.Second, Drain: 5 * time.Second}))
+			Expect(restored.Fallbacks).To(HaveKeyWithValue("dungen", registry.FallbackRegion))
+			Expect(restored.Traffic).To(HaveKeyWithValue("dungen", registry.TrafficPolicy{Tag: "version", Weights: map[string]int{"1": 90, "2": 10}}))
+		})
+		It("keeps static instances static", func() {
+			reg.RegisterInstance(registry.Instance{Name: "db", Address: "postgres://db.internal:5432", Static: true})
+			send("GET", "/admin/snapshot", "", bearer)
+			snapshot = responseRecorder.Body.String()
+
+			other := registry.NewServiceRegistry()
+			router = server.SetupRouter(other, server.WithAdminToken(token))
+			send("POST", "/admin/snapshot", snapshot, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			instance, _ := other.LookupInstance("db", nil)
+			Expect(instance.Static).To(BeTrue())
+		})
+		It("merges by default", func() {
+			other := registry.NewServiceRegistry()
+			other.Register("other", "http://localhost:6000")
+			router = server.SetupRouter(other, server.WithAdminToken(token))
+			send("POST", "/admin/snapshot", snapshot, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(other.Instances()).To(HaveLen(2))
+		})
+		It("restores the timeout if asked", func() {
+			reg.SetTimeout(90 * time.Second)
+			send("GET", "/admin/snapshot", "", bearer)
+			snapshot = responseRecorder.Body.String()
+
+			other := registry.NewServiceRegistry()
+			router = server.SetupRouter(other, server.WithAdminToken(token))
+			send("POST", "/admin/snapshot", snapshot, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(other.Timeout()).To(Equal(30 * time.Second))
+
+			send("POST", "/admin/snapshot?restore_timeout=true", snapshot, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(other.Timeout()).To(Equal(90 * time.Second))
+		})
+		It("rejects restoring a missing timeout", func() {
+			send("POST", "/admin/snapshot?restore_timeout=true", `{"version": 1, "instances": []}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("no timeout"))
+		})
+		It("rejects an unknown version", func() {
+			send("POST", "/admin/snapshot", `{"version": 2, "instances": []}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("version"))
+		})
+		It("rejects an unknown mode", func() {
+			send("POST", "/admin/snapshot?mode=overwrite", snapshot, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("rejects invalid settings", func() {
+			for _, doc := range []string{
+				`{"version": 1, "instances": [], "windows": {"x": {"warmup_seconds": -1}}}`,
+				`{"version": 1, "instances": [], "fallbacks": {"x": "nowhere"}}`,
+				`{"version": 1, "instances": [], "traffic": {"x": {"tag": "version", "weights": {}}}}`,
+			} {
+				send("POST", "/admin/snapshot", doc, bearer)
+				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest), doc)
+			}
+		})
+		It("rejects invalid instances", func() {
+			send("POST", "/admin/snapshot", `{"version": 1, "instances": [{"name": "x", "address": "nope"}]}`, bearer)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("requires the token", func() {
+			send("POST", "/admin/snapshot", snapshot, nil)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// AuditFile is a log file that is rotated once it reaches a size.
+// The previous files are kept as PATH.1, PATH.2 and so on, up to a number of them.
+type AuditFile struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+	closed   bool
+}
+
+// OpenAuditFile opens path for appending. It is rotated before a write would take it past maxBytes,
+// keeping up to keep previous files.
+func OpenAuditFile(path string, maxBytes int64, keep int) (*AuditFile, error) {
+	f := &AuditFile{path: path, maxBytes: maxBytes, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *AuditFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes p whole to one file, so that records are not split between files.
+// If rotating fails, p is written to the current file, and rotating is tried again on the next write,
+// since the callers of a log, like slog, discard its errors.
+func (f *AuditFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file != nil && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		f.rotate()
+	}
+	if f.file == nil {
+		// The rotation failed with no file open.
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate must be called with the mutex held. If it fails, the file may be left closed.
+func (f *AuditFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	if f.keep > 0 {
+		// Renaming over the oldest file removes it.
+		for i := f.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *AuditFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+var (
+	errAddressRequired = errors.New("address is required")
+	errSourceMismatch  = errors.New("address does not match the source IP")
+)
+
+// defaultTrustedProxies are trusted unless WithTrustedProxies is used.
+// The server listens on localhost, so a proxy in front of it is usually on the same host.
+var defaultTrustedProxies = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// WithTrustedProxies trusts the forwarded headers of requests from these networks.
+// The client IP found through them is used to deduce addresses, for rate limits,
+// and in audit records. With no networks, no proxy is trusted.
+// By default, only loopback proxies are trusted.
+func WithTrustedProxies(networks ...netip.Prefix) Option {
+	return func(c *config) {
+		c.trustedProxies = append([]netip.Prefix{}, networks...)
+	}
+}
+
+// WithForwardedHeaders sets the headers, in order of preference, that trusted proxies
+// use to forward the client IP. The default is X-Forwarded-For, then X-Real-IP.
+func WithForwardedHeaders(headers ...string) Option {
+	return func(c *config) {
+		c.forwardedHeaders = headers
+	}
+}
+
+// WithoutAddressDeduction refuses registrations without an address,
+// instead of deducing the address from the client IP.
+func WithoutAddressDeduction() Option {
+	return func(c *config) {
+		c.noDeduction = true
+	}
+}
+
+// WithSourceCheck refuses registrations whose address is not the client's own.
+// The host must be the client IP, or a name that resolves to it,
+// and a unix socket may only be registered from loopback.
+// An instance with a client-chosen ID may only be moved to another address, deregistered
+// or sent heartbeats by the client at its current address.
+// Static instances, registered by an admin, are not checked.
+func WithSourceCheck() Option {
+	return func(c *config) {
+		c.checkSource = true
+	}
+}
+
+// trustProxies applies the proxy settings to the router.
+func trustProxies(router *gin.Engine, cfg *config) {
+	proxies := make([]string, len(cfg.trustedProxies))
+	for i, network := range cfg.trustedProxies {
+		proxies[i] = network.String()
+	}
+	// Valid prefixes can't be refused.
+	router.SetTrustedProxies(proxies)
+	if cfg.forwardedHeaders != nil {
+		router.RemoteIPHeaders = cfg.forwardedHeaders
+	}
+}
+
+// checkMove returns errSourceMismatch if the registration would move an instance
+// with a client-chosen ID away from an address that doesn't belong to the client.
+// Otherwise, anyone who knows or guesses the ID could take over the instance's traffic.
+func checkMove(c *gin.Context, sr registry.Registry, inst registry.Instance) error {
+	if inst.ID == "" {
+		return nil
+	}
+	existing, ok := sr.Instance(registry.InstanceID(inst.Name, inst.ID))
+	if !ok || existing.Address == inst.Address {
+		return nil
+	}
+	return checkSource(c, existing.Parsed)
+}
+
+// checkOwner returns errSourceMismatch if the instance has a client-chosen ID,
+// and its address doesn't belong to the client. Generated IDs are known only to their client.
+func checkOwner(c *gin.Context, sr registry.Registry, id string) error {
+	if !registry.IsChosenID(id) {
+		return nil
+	}
+	existing, ok := sr.Instance(id)
+	if !ok || existing.Static {
+		return nil
+	}
+	return checkSource(c, existing.Parsed)
+}
+
+// checkSource returns errSourceMismatch unless the address belongs to the client.
+func checkSource(c *gin.Context, address registry.Address) error {
+	source, err := netip.ParseAddr(c.ClientIP())
+	if err != nil {
+		return errSourceMismatch
+	}
+	source = source.Unmap().WithZone("")
+
+	if address.Scheme == registry.SchemeUnix {
+		if source.IsLoopback() {
+			return nil
+		}
+		return errSourceMismatch
+	}
+	if ip, err := netip.ParseAddr(address.Host); err == nil {
+		if ip.Unmap().WithZone("") == source {
+			return nil
+		}
+		return errSourceMismatch
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(c.Request.Context(), "ip", address.Host)
+	if err != nil {
+		return errSourceMismatch
+	}
+	for _, ip := range ips {
+		if ip.Unmap().WithZone("") == source {
+			return nil
+		}
+	}
+	return errSourceMismatch
+}
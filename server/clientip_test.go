@@ -0,0 +1,147 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("Client IPs", func() {
+	var reg registry.Registry
+	var router *gin.Engine
+	var responseRecorder *httptest.ResponseRecorder
+
+	register := func(request message.RegisterRequest, from string, header string, forwarded string) int {
+		responseRecorder = httptest.NewRecorder()
+		reqJSON, _ := json.Marshal(request)
+		reqHTTP, _ := http.NewRequest("POST", "/register", strings.NewReader(string(reqJSON)))
+		reqHTTP.RemoteAddr = from + ":40000"
+		if forwarded != "" {
+			reqHTTP.Header.Set(header, forwarded)
+		}
+		router.ServeHTTP(responseRecorder, reqHTTP)
+		return responseRecorder.Code
+	}
+	send := func(path string, body string, from string) int {
+		responseRecorder = httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		reqHTTP.RemoteAddr = from + ":40000"
+		router.ServeHTTP(responseRecorder, reqHTTP)
+		return responseRecorder.Code
+	}
+	portOnly := message.RegisterRequest{Name: "dungen", Port: "1234"}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		router = server.SetupRouter(reg)
+	})
+
+	Context("deducing addresses", func() {
+		It("ignores forwarded headers from untrusted proxies", func() {
+			Expect(register(portOnly, "10.0.0.9", "X-Forwarded-For", "203.0.113.5")).To(Equal(http.StatusOK))
+			Expect(reg.Lookup("dungen")).To(Equal("http://10.0.0.9:1234"))
+		})
+		It("trusts loopback proxies by default", func() {
+			Expect(register(portOnly, "127.0.0.1", "X-Forwarded-For", "203.0.113.5")).To(Equal(http.StatusOK))
+			Expect(reg.Lookup("dungen")).To(Equal("http://203.0.113.5:1234"))
+		})
+		It("trusts the configured proxies instead", func() {
+			router = server.SetupRouter(reg, server.WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")))
+			register(portOnly, "10.0.0.9", "X-Forwarded-For", "203.0.113.5")
+			register(message.RegisterRequest{Name: "flard", Port: "1234"}, "127.0.0.1", "X-Forwarded-For", "203.0.113.6")
+			Expect(reg.Lookup("dungen")).To(Equal("http://203.0.113.5:1234"))
+			Expect(reg.Lookup("flard")).To(Equal("http://127.0.0.1:1234"))
+		})
+		It("uses the configured forwarded headers", func() {
+			router = server.SetupRouter(reg, server.WithForwardedHeaders("CF-Connecting-IP"))
+			register(portOnly, "127.0.0.1", "X-Forwarded-For", "203.0.113.5")
+			register(message.RegisterRequest{Name: "flard", Port: "1234"}, "127.0.0.1", "CF-Connecting-IP", "2001:db8::5")
+			Expect(reg.Lookup("dungen")).To(Equal("http://127.0.0.1:1234"))
+			Expect(reg.Lookup("flard")).To(Equal("http://[2001:db8::5]:1234"))
+		})
+		It("can be disabled", func() {
+			router = server.SetupRouter(reg, server.WithoutAddressDeduction())
+			Expect(register(portOnly, "10.0.0.9", "", "")).To(Equal(http.StatusBadRequest))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("address is required"))
+			Expect(register(message.RegisterRequest{Name: "dungen", Address: "http://10.0.0.9:1234"}, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("checking sources", func() {
+		BeforeEach(func() {
+			router = server.SetupRouter(reg, server.WithSourceCheck())
+		})
+		It("accepts the client's own address", func() {
+			request := message.RegisterRequest{Name: "dungen", Address: "grpc://10.0.0.9:9000"}
+			Expect(register(request, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+		})
+		It("refuses another address", func() {
+			request := message.RegisterRequest{Name: "dungen", Address: "http://10.0.0.8:1234"}
+			Expect(register(request, "10.0.0.9", "", "")).To(Equal(http.StatusForbidden))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("source IP"))
+			Expect(reg.Instances()).To(BeEmpty())
+		})
+		It("uses the forwarded client IP", func() {
+			request := message.RegisterRequest{Name: "dungen", Address: "http://203.0.113.5:1234"}
+			Expect(register(request, "127.0.0.1", "X-Forwarded-For", "203.0.113.5")).To(Equal(http.StatusOK))
+		})
+		It("accepts unix sockets only from loopback", func() {
+			request := message.RegisterRequest{Name: "dungen", Address: "unix:///run/dungen.sock"}
+			Expect(register(request, "10.0.0.9", "", "")).To(Equal(http.StatusForbidden))
+			Expect(register(request, "127.0.0.1", "", "")).To(Equal(http.StatusOK))
+		})
+		It("still deduces addresses", func() {
+			Expect(register(portOnly, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+		})
+		It("lets only the client at an instance's address move it", func() {
+			pod := message.RegisterRequest{Name: "dungen", Port: "1234", ID: "dungen-0"}
+			Expect(register(pod, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+			Expect(register(pod, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+
+			Expect(register(pod, "10.0.0.66", "", "")).To(Equal(http.StatusForbidden))
+			Expect(reg.Lookup("dungen")).To(Equal("http://10.0.0.9:1234"))
+
+			pod.Address, pod.Port = "http://10.0.0.9:4321", ""
+			Expect(register(pod, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+			Expect(reg.Lookup("dungen")).To(Equal("http://10.0.0.9:4321"))
+		})
+		It("lets only the client at an instance's address deregister it or send heartbeats", func() {
+			pod := message.RegisterRequest{Name: "dungen", Port: "1234", ID: "dungen-0"}
+			Expect(register(pod, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+			id := registry.InstanceID("dungen", "dungen-0")
+
+			Expect(send("/heartbeat", `{"id": "`+id+`"}`, "10.0.0.66")).To(Equal(http.StatusForbidden))
+			Expect(send("/heartbeat/batch", `{"heartbeats": [{"id": "`+id+`"}]}`, "10.0.0.66")).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring(`"success":false`))
+			Expect(send("/deregister", `{"id": "`+id+`"}`, "10.0.0.66")).To(Equal(http.StatusForbidden))
+			_, ok := reg.Instance(id)
+			Expect(ok).To(BeTrue())
+
+			Expect(send("/heartbeat/batch", `{"heartbeats": [{"id": "`+id+`"}]}`, "10.0.0.9")).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring(`"success":true`))
+			Expect(send("/heartbeat", `{"id": "`+id+`"}`, "10.0.0.9")).To(Equal(http.StatusOK))
+			Expect(send("/deregister", `{"id": "`+id+`"}`, "10.0.0.9")).To(Equal(http.StatusOK))
+			_, ok = reg.Instance(id)
+			Expect(ok).To(BeFalse())
+		})
+		It("doesn't check generated IDs", func() {
+			Expect(register(portOnly, "10.0.0.9", "", "")).To(Equal(http.StatusOK))
+			r := message.RegisterResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(send("/heartbeat", `{"id": "`+r.ID+`"}`, "10.0.0.66")).To(Equal(http.StatusOK))
+			Expect(send("/deregister", `{"id": "`+r.ID+`"}`, "10.0.0.66")).To(Equal(http.StatusOK))
+			Expect(reg.Instances()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultMaxBodyBytes limits request bodies, other than those proxied.
+const defaultMaxBodyBytes = 1 << 20
+
+// bucketIdle is how long a client's bucket is kept after it was last used.
+const bucketIdle = 10 * time.Minute
+
+// rateLimit allows rate requests per second, on average, with bursts of up to burst.
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// WithRateLimit limits each client IP to perSecond requests per second to path,
+// after an initial burst of up to burst requests. path is a route, such as "/register".
+// Requests over the limit receive status 429.
+func WithRateLimit(path string, perSecond float64, burst int) Option {
+	return func(c *config) {
+		if c.rateLimits == nil {
+			c.rateLimits = make(map[string]rateLimit)
+		}
+		c.rateLimits[path] = rateLimit{rate: perSecond, burst: burst}
+	}
+}
+
+// WithDefaultRateLimit limits requests to routes without their own WithRateLimit,
+// for each client IP.
+func WithDefaultRateLimit(perSecond float64, burst int) Option {
+	return func(c *config) {
+		c.defaultRateLimit = &rateLimit{rate: perSecond, burst: burst}
+	}
+}
+
+// WithMaxBodyBytes limits the size of request bodies, other than proxied requests.
+// Larger requests receive status 413. The default is 1 MiB.
+func WithMaxBodyBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBodyBytes = n
+	}
+}
+
+// bucket is a token bucket for one client of one route.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter holds the buckets of every client, for one route.
+type limiter struct {
+	rateLimit
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(l rateLimit) *limiter {
+	return &limiter{rateLimit: l, buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// allow takes a token from the client's bucket. If there is none,
+// it returns false, and how long until there will be.
+func (l *limiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.swept) > bucketIdle {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, bucketIdle
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets idle clients, so that the buckets don't grow without bound.
+// It must be called with the mutex held.
+func (l *limiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > bucketIdle {
+			delete(l.buckets, client)
+		}
+	}
+	l.swept = now
+}
+
+// limitRate applies the configured rate limits, keyed by route and client IP.
+func limitRate(cfg config) gin.HandlerFunc {
+	limiters := make(map[string]*limiter, len(cfg.rateLimits))
+	for path, l := range cfg.rateLimits {
+		limiters[path] = newLimiter(l)
+	}
+	// Each route without its own limit has its own buckets, at the default rate.
+	var defaults sync.Map
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			// Not found.
+			return
+		}
+		l, ok := limiters[route]
+		if !ok {
+			if cfg.defaultRateLimit == nil {
+				return
+			}
+			v, _ := defaults.LoadOrStore(route, newLimiter(*cfg.defaultRateLimit))
+			l = v.(*limiter)
+		}
+		if ok, wait := l.allow(c.ClientIP(), time.Now()); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+		}
+	}
+}
+
+// limitBody refuses bodies larger than max.
+func limitBody(max int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > max {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+			return
+		}
+		// Bodies without a length fail to bind if they grow too large.
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max)
+	}
+}
@@ -0,0 +1,111 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("Limits", func() {
+	var reg registry.Registry
+	var router *gin.Engine
+	var responseRecorder *httptest.ResponseRecorder
+
+	send := func(path string, body string, from string) int {
+		responseRecorder = httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		reqHTTP.RemoteAddr = from + ":40000"
+		router.ServeHTTP(responseRecorder, reqHTTP)
+		return responseRecorder.Code
+	}
+	lookup := func(from string) int {
+		return send("/lookup", `{"name": "dungen"}`, from)
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+	})
+
+	Describe("rate limits", func() {
+		BeforeEach(func() {
+			router = server.SetupRouter(reg,
+				server.WithRateLimit("/lookup", 50, 2),
+				server.WithDefaultRateLimit(1, 5))
+		})
+
+		It("allows a burst, then responds Too Many Requests", func() {
+			Expect(lookup("10.0.0.1")).To(Equal(http.StatusOK))
+			Expect(lookup("10.0.0.1")).To(Equal(http.StatusOK))
+			Expect(lookup("10.0.0.1")).To(Equal(http.StatusTooManyRequests))
+			Expect(responseRecorder.Header().Get("Retry-After")).To(Equal("1"))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("rate limit"))
+		})
+		It("refills over time", func() {
+			lookup("10.0.0.1")
+			lookup("10.0.0.1")
+			Eventually(func() int {
+				return lookup("10.0.0.1")
+			}, time.Second, 10*time.Millisecond).Should(Equal(http.StatusOK))
+		})
+		It("limits each client separately", func() {
+			lookup("10.0.0.1")
+			lookup("10.0.0.1")
+			Expect(lookup("10.0.0.1")).To(Equal(http.StatusTooManyRequests))
+			Expect(lookup("10.0.0.2")).To(Equal(http.StatusOK))
+		})
+		It("limits each route separately", func() {
+			lookup("10.0.0.1")
+			lookup("10.0.0.1")
+			Expect(send("/heartbeat", `{"id": "nope"}`, "10.0.0.1")).To(Equal(http.StatusOK))
+		})
+		It("applies the default to other routes", func() {
+			for i := 0; i < 5; i++ {
+				send("/heartbeat", `{"id": "nope"}`, "10.0.0.1")
+			}
+			Expect(send("/heartbeat", `{"id": "nope"}`, "10.0.0.1")).To(Equal(http.StatusTooManyRequests))
+		})
+	})
+
+	Describe("body limits", func() {
+		BeforeEach(func() {
+			router = server.SetupRouter(reg, server.WithMaxBodyBytes(64))
+		})
+
+		It("accepts small bodies", func() {
+			Expect(lookup("10.0.0.1")).To(Equal(http.StatusOK))
+		})
+		It("responds Request Entity Too Large", func() {
+			body := `{"name": "` + strings.Repeat("x", 64) + `"}`
+			Expect(send("/lookup", body, "10.0.0.1")).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+	})
+
+	Describe("instance limits", func() {
+		BeforeEach(func() {
+			reg.SetLimits(3, 2)
+			router = server.SetupRouter(reg)
+		})
+
+		It("responds Too Many Requests per name", func() {
+			Expect(send("/register", `{"name": "dungen", "address": "http://a"}`, "10.0.0.1")).To(Equal(http.StatusOK))
+			Expect(send("/register", `{"name": "dungen", "address": "http://b"}`, "10.0.0.1")).To(Equal(http.StatusOK))
+			Expect(send("/register", `{"name": "dungen", "address": "http://c"}`, "10.0.0.1")).To(Equal(http.StatusTooManyRequests))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("limit"))
+		})
+		It("responds Too Many Requests in total", func() {
+			send("/register", `{"name": "a", "address": "http://a"}`, "10.0.0.1")
+			send("/register", `{"name": "b", "address": "http://a"}`, "10.0.0.1")
+			send("/register", `{"name": "c", "address": "http://a"}`, "10.0.0.1")
+			Expect(send("/register", `{"name": "d", "address": "http://a"}`, "10.0.0.1")).To(Equal(http.StatusTooManyRequests))
+		})
+	})
+})
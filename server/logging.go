@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+// Keys of values set on the gin context.
+const (
+	auditKey    = "srsr.audit"
+	identityKey = "srsr.identity"
+)
+
+// WithLogger logs each request, and each change to the registry, to logger.
+// Without it, requests are logged by gin's default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithAuditLog records every registration, deregistration, expiry and admin action to w,
+// as lines of JSON, with the caller's IP and identity where there is one.
+// An *AuditFile may be used to rotate the log.
+func WithAuditLog(w io.Writer) Option {
+	return func(c *config) {
+		c.audit = slog.New(slog.NewJSONHandler(w, nil))
+	}
+}
+
+func logRequests(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		level := slog.LevelInfo
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(c.Request.Context(), level, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
+
+// logEvents logs changes to the registry, including those no request caused, like expiry.
+func logEvents(logger *slog.Logger) func(registry.Event) {
+	return func(e registry.Event) {
+		level := slog.LevelInfo
+		if e.Type == registry.EventUpdated || e.Type == registry.EventRegistered {
+			// The request is logged already.
+			level = slog.LevelDebug
+		}
+		logger.Log(context.Background(), level, "instance "+string(e.Type), instanceAttrs(e.Instance)...)
+	}
+}
+
+// auditEvents records the changes that no caller made.
+func auditEvents(logger *slog.Logger) func(registry.Event) {
+	return func(e registry.Event) {
+		if e.Type != registry.EventExpired && e.Type != registry.EventReplaced {
+			return
+		}
+		attrs := append([]any{"action", string(e.Type), "identity", "system"}, instanceAttrs(e.Instance)...)
+		logger.Info("audit", attrs...)
+	}
+}
+
+// registerAttrs describes a registration, for audit.
+func registerAttrs(instance registry.Instance, id string, result registry.RegisterResult, err error) []any {
+	attrs := []any{"name", instance.Name, "id", id, "address", instance.Address, "result", string(result)}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	return attrs
+}
+
+func instanceAttrs(instance registry.Instance) []any {
+	return []any{"name", instance.Name, "id", instance.ID, "address", instance.Address}
+}
+
+// audit records an action taken by the caller, if there is an audit log.
+func audit(c *gin.Context, action string, attrs ...any) {
+	v, ok := c.Get(auditKey)
+	if !ok {
+		return
+	}
+	identity := c.GetString(identityKey)
+	if identity == "" {
+		identity = "anonymous"
+	}
+	attrs = append([]any{"action", action, "caller_ip", c.ClientIP(), "identity", identity}, attrs...)
+	v.(*slog.Logger).Info("audit", attrs...)
+}
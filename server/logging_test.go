@@ -0,0 +1,195 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+// syncBuffer is written by request handlers and expiry goroutines.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// records parses each line as JSON.
+func (b *syncBuffer) records() []map[string]any {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	records := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]any{}
+		json.Unmarshal([]byte(line), &record)
+		records = append(records, record)
+	}
+	return records
+}
+
+var _ = Describe("Logging", func() {
+	const token = "sekrit"
+
+	var reg registry.Registry
+	var router *gin.Engine
+	var logs, auditLog *syncBuffer
+
+	send := func(path string, body string, user string) message.RegisterResponse {
+		responseRecorder := httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		reqHTTP.Header.Set("Content-Type", "application/json")
+		reqHTTP.RemoteAddr = "10.1.2.3:40000"
+		if user != "" {
+			reqHTTP.SetBasicAuth(user, token)
+		}
+		router.ServeHTTP(responseRecorder, reqHTTP)
+		r := message.RegisterResponse{}
+		json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+		return r
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		logs = &syncBuffer{}
+		auditLog = &syncBuffer{}
+		router = server.SetupRouter(reg,
+			server.WithAdminToken(token),
+			server.WithLogger(slog.New(slog.NewJSONHandler(logs, nil))),
+			server.WithAuditLog(auditLog))
+	})
+
+	It("logs requests", func() {
+		send("/lookup", `{"name": "dungen"}`, "")
+		Expect(logs.records()).To(ContainElement(And(
+			HaveKeyWithValue("msg", "request"),
+			HaveKeyWithValue("path", "/lookup"),
+			HaveKeyWithValue("status", BeNumerically("==", 200)),
+			HaveKeyWithValue("client_ip", "10.1.2.3"),
+		)))
+	})
+	It("logs expiry", func() {
+		reg.SetTimeout(5 * time.Millisecond)
+		reg.Register("dungen", "http://localhost:5000")
+		Eventually(logs.records, time.Second, time.Millisecond).Should(ContainElement(And(
+			HaveKeyWithValue("msg", "instance expired"),
+			HaveKeyWithValue("name", "dungen"),
+		)))
+	})
+
+	Describe("audit", func() {
+		It("records registration and deregistration by the caller", func() {
+			r := send("/register", `{"name": "dungen", "address": "http://localhost:5000"}`, "")
+			send("/deregister", `{"id": "`+r.ID+`"}`, "")
+			Expect(auditLog.records()).To(ConsistOf(
+				And(HaveKeyWithValue("action", "register"), HaveKeyWithValue("id", r.ID),
+					HaveKeyWithValue("caller_ip", "10.1.2.3"), HaveKeyWithValue("identity", "anonymous"),
+					HaveKeyWithValue("result", "created")),
+				And(HaveKeyWithValue("action", "deregister"), HaveKeyWithValue("id", r.ID),
+					HaveKeyWithValue("name", "dungen"), HaveKeyWithValue("address", "http://localhost:5000")),
+			))
+		})
+		It("records admin actions with the identity", func() {
+			r := send("/register", `{"name": "dungen", "address": "http://localhost:5000"}`, "")
+			send("/admin/api/deregister", `{"id": "`+r.ID+`"}`, "alice")
+			Expect(auditLog.records()).To(ContainElement(And(
+				HaveKeyWithValue("action", "deregister"),
+				HaveKeyWithValue("identity", "alice"),
+				HaveKeyWithValue("success", true),
+			)))
+		})
+		It("records expiry", func() {
+			reg.SetTimeout(5 * time.Millisecond)
+			reg.Register("dungen", "http://localhost:5000")
+			Eventually(auditLog.records, time.Second, time.Millisecond).Should(ContainElement(And(
+				HaveKeyWithValue("action", "expired"),
+				HaveKeyWithValue("identity", "system"),
+			)))
+		})
+		It("does not record lookups", func() {
+			send("/lookup", `{"name": "dungen"}`, "")
+			Expect(auditLog.records()).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("AuditFile", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "audit.log")
+	})
+
+	It("rotates, keeping the newest files", func() {
+		f, err := server.OpenAuditFile(path, 10, 2)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		for _, record := range []string{"one\n", "two\n", "three\n", "four\n"} {
+			_, err := f.Write([]byte(record))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		read := func(p string) string {
+			b, _ := os.ReadFile(p)
+			return string(b)
+		}
+		Expect(read(path)).To(Equal("four\n"))
+		Expect(read(path + ".1")).To(Equal("three\n"))
+		Expect(read(path + ".2")).To(Equal("one\ntwo\n"))
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+	})
+	It("keeps writing when it can't rotate", func() {
+		// A directory in the way of the rotated file.
+		Expect(os.MkdirAll(filepath.Join(path+".1", "full"), 0o700)).To(Succeed())
+		f, _ := server.OpenAuditFile(path, 10, 1)
+		defer f.Close()
+		for _, record := range []string{"one\n", "two\n", "three\n"} {
+			_, err := f.Write([]byte(record))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		b, _ := os.ReadFile(path)
+		Expect(string(b)).To(Equal("one\ntwo\nthree\n"))
+
+		Expect(os.RemoveAll(path + ".1")).To(Succeed())
+		f.Write([]byte("four\n"))
+		b, _ = os.ReadFile(path)
+		Expect(string(b)).To(Equal("four\n"))
+		b, _ = os.ReadFile(path + ".1")
+		Expect(string(b)).To(Equal("one\ntwo\nthree\n"))
+	})
+	It("refuses writes once closed", func() {
+		f, _ := server.OpenAuditFile(path, 100, 1)
+		f.Close()
+		_, err := f.Write([]byte("late\n"))
+		Expect(err).To(MatchError(os.ErrClosed))
+	})
+	It("appends to an existing file", func() {
+		os.WriteFile(path, []byte("old\n"), 0o600)
+		f, _ := server.OpenAuditFile(path, 100, 1)
+		f.Write([]byte("new\n"))
+		f.Close()
+		b, _ := os.ReadFile(path)
+		Expect(string(b)).To(Equal("old\nnew\n"))
+	})
+})
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/registry"
+)
+
+const (
+	// Attempts per proxied request, each to a different instance.
+	proxyAttempts = 3
+
+	// After this many consecutive failures, an instance is skipped by the proxy...
+	unhealthyThreshold = 3
+	// ...until this much time has passed, when it gets another chance.
+	unhealthyCooldown = 30 * time.Second
+
+	// Request bodies up to this size are kept, so they can be sent again to another instance.
+	// Larger ones are streamed to a single instance.
+	maxReplayBody = 1 << 20
+)
+
+var errNoInstance = errors.New("no healthy instance available")
+
+type proxyServiceKey struct{}
+
+// passiveHealth tracks proxy failures per instance ID.
+type passiveHealth struct {
+	mutex    sync.Mutex
+	failures map[string]int
+	until    map[string]time.Time
+}
+
+func newPassiveHealth() *passiveHealth {
+	return &passiveHealth{
+		failures: make(map[string]int),
+		until:    make(map[string]time.Time),
+	}
+}
+
+func (h *passiveHealth) unhealthy(id string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return time.Now().Before(h.until[id])
+}
+
+func (h *passiveHealth) failed(id string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.failures[id]++
+	if h.failures[id] >= unhealthyThreshold {
+		h.failures[id] = 0
+		h.until[id] = time.Now().Add(unhealthyCooldown)
+	}
+}
+
+func (h *passiveHealth) succeeded(id string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.forget(id)
+}
+
+// forget drops what is known of the instance. It must be called with the mutex held.
+func (h *passiveHealth) forget(id string) {
+	delete(h.failures, id)
+	delete(h.until, id)
+}
+
+// watch forgets instances as they are removed from the registry.
+func (h *passiveHealth) watch(sr registry.Registry) {
+	sr.AddHook(func(e registry.Event) {
+		switch e.Type {
+		case registry.EventDeregistered, registry.EventExpired, registry.EventReplaced:
+			h.mutex.Lock()
+			defer h.mutex.Unlock()
+			h.forget(e.Instance.ID)
+		}
+	})
+}
+
+// proxyTransport picks an instance of the service for each attempt,
+// so a connection failure can be retried against another instance.
+type proxyTransport struct {
+	registry registry.Registry
+	health   *passiveHealth
+	base     http.RoundTripper
+}
+
+// isConnectError reports whether the request failed before reaching the instance,
+// which makes it safe to retry whatever the method.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// proxiable reports whether the proxy can forward to the instance, which needs an http address.
+func proxiable(i registry.Instance) bool {
+	return i.Parsed.Scheme == registry.SchemeHTTP || i.Parsed.Scheme == registry.SchemeHTTPS
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name, _ := req.Context().Value(proxyServiceKey{}).(string)
+
+	body, stream, err := replayable(req)
+	if err != nil {
+		return nil, err
+	}
+	attempts := proxyAttempts
+	if stream != nil {
+		attempts = 1
+	}
+
+	tried := make(map[string]bool)
+	skip := func(i registry.Instance) bool {
+		return tried[i.ID] || !proxiable(i) || t.health.unhealthy(i.ID)
+	}
+	err = errNoInstance
+	for attempt := 0; attempt < attempts; attempt++ {
+		instance, ok := t.registry.LookupInstance(name, skip)
+		if !ok {
+			break
+		}
+		tried[instance.ID] = true
+
+		target := instance.Parsed
+		out := req.Clone(req.Context())
+		out.URL.Scheme = target.Scheme
+		out.URL.Host = target.HostPort()
+		out.URL.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+		out.URL.RawPath = ""
+		out.Host = ""
+		if stream != nil {
+			out.Body = stream
+		} else if body != nil {
+			out.Body = io.NopCloser(bytes.NewReader(body))
+			out.ContentLength = int64(len(body))
+		}
+
+		var resp *http.Response
+		resp, err = t.base.RoundTrip(out)
+		if err == nil {
+			t.health.succeeded(instance.ID)
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		t.health.failed(instance.ID)
+		if !isConnectError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// replayable reads the request's body, so that it can be sent again, unless it is larger
+// than maxReplayBody. Then, it returns a stream of the body instead, which can be sent only once.
+func replayable(req *http.Request) ([]byte, io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil, nil
+	}
+	if req.ContentLength > maxReplayBody {
+		return nil, req.Body, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxReplayBody+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, nil, err
+	}
+	if len(body) > maxReplayBody {
+		// The rest is still to be read, after what has been.
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}, nil
+	}
+	req.Body.Close()
+	return body, nil, nil
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, errNoInstance) {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(gin.H{"error": err.Error()})
+}
+
+func newProxy(sr registry.Registry) *httputil.ReverseProxy {
+	health := newPassiveHealth()
+	health.watch(sr)
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+		},
+		Transport: &proxyTransport{
+			registry: sr,
+			health:   health,
+			base:     http.DefaultTransport,
+		},
+		ErrorHandler: proxyErrorHandler,
+	}
+}
+
+// proxy forwards /proxy/:name/*path to an instance of the named service.
+func proxy(c *gin.Context, rp *httputil.ReverseProxy) {
+	req := c.Request.Clone(context.WithValue(c.Request.Context(), proxyServiceKey{}, c.Param("name")))
+	req.URL.Path = c.Param("path")
+	req.URL.RawPath = ""
+	rp.ServeHTTP(c.Writer, req)
+}
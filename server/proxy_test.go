@@ -0,0 +1,126 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("Proxy", func() {
+	var reg registry.Registry
+	var router *gin.Engine
+	var backend *httptest.Server
+	var response *http.Response
+	var responseBody string
+
+	// deadAddress belongs to a server that has been shut down.
+	var deadAddress string
+
+	// The proxy streams responses, which needs a real connection rather than a ResponseRecorder.
+	send := func(method string, path string, body string) {
+		frontend := httptest.NewServer(router)
+		defer frontend.Close()
+		reqHTTP, _ := http.NewRequest(method, frontend.URL+path, strings.NewReader(body))
+		var err error
+		response, err = http.DefaultClient.Do(reqHTTP)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		b, _ := io.ReadAll(response.Body)
+		responseBody = string(b)
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		router = server.SetupRouter(reg, server.WithProxy())
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		}))
+		dead := httptest.NewServer(http.NotFoundHandler())
+		deadAddress = dead.URL
+		dead.Close()
+	})
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	When("the proxy is not enabled", func() {
+		It("responds Not Found", func() {
+			router = server.SetupRouter(reg)
+			reg.Register("orders", backend.URL)
+			send("GET", "/proxy/orders/api", "")
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	When("the service has a live instance", func() {
+		BeforeEach(func() {
+			reg.Register("orders", backend.URL)
+		})
+		It("forwards the path and query", func() {
+			send("GET", "/proxy/orders/api/v1/foo?x=1", "")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(responseBody).To(Equal("GET /api/v1/foo?x=1 "))
+		})
+		It("forwards the method and body", func() {
+			send("POST", "/proxy/orders/submit", "flard")
+			Expect(responseBody).To(Equal("POST /submit flard"))
+		})
+		It("streams bodies too large to keep", func() {
+			body := strings.Repeat("flard", 500000)
+			send("POST", "/proxy/orders/submit", body)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(responseBody).To(Equal("POST /submit " + body))
+		})
+	})
+
+	When("the service is not registered", func() {
+		It("responds Service Unavailable", func() {
+			send("GET", "/proxy/orders/api", "")
+			Expect(response.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+	})
+
+	When("an instance refuses connections", func() {
+		It("retries another instance", func() {
+			reg.Register("orders", deadAddress)
+			reg.Register("orders", backend.URL)
+			for i := 0; i < 10; i++ {
+				send("GET", "/proxy/orders/api", "body")
+				Expect(response.StatusCode).To(Equal(http.StatusOK))
+			}
+		})
+		It("marks the instance unhealthy after repeated failures", func() {
+			reg.Register("orders", deadAddress)
+			for i := 0; i < 3; i++ {
+				send("GET", "/proxy/orders/api", "")
+				Expect(response.StatusCode).To(Equal(http.StatusBadGateway))
+			}
+			send("GET", "/proxy/orders/api", "")
+			Expect(response.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+		It("forgets the failures of removed instances", func() {
+			instance := registry.Instance{ID: "orders-pod-1", Name: "orders", Address: deadAddress}
+			id, _, err := reg.RegisterInstance(instance)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				send("GET", "/proxy/orders/api", "")
+			}
+			Expect(reg.Deregister(id)).To(Succeed())
+			instance.Address = backend.URL
+			_, _, err = reg.RegisterInstance(instance)
+			Expect(err).NotTo(HaveOccurred())
+			send("GET", "/proxy/orders/api", "")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+})
@@ -1,7 +1,16 @@
+// Package server serves the srsr HTTP API for a registry.
+// To embed it in another program, see New.
 package server
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -9,48 +18,183 @@ import (
 	"github.com/ifIMust/srsr/registry"
 )
 
-const defaultScheme = "http://"
+// maxBatch limits the number of items in a batch request.
+const maxBatch = 1000
 
-func register(c *gin.Context, sr registry.Registry) {
+// maxLookupWait caps the wait of a blocking lookup, to stay within the idle timeouts of most proxies.
+const maxLookupWait = time.Minute
+
+func register(c *gin.Context, sr registry.Registry, cfg *config) {
 	var request message.RegisterRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if request.Address == "" {
-		deducedIP := c.ClientIP()
-		if deducedIP != "" {
-			request.Address = defaultScheme + deducedIP
+	inst, err := instance(c, sr, request, cfg)
+	if err != nil {
+		r := message.RegisterResponse{Result: string(registry.ResultRejected), Error: err.Error()}
+		if errors.Is(err, errSourceMismatch) {
+			c.JSON(http.StatusForbidden, r)
 		} else {
-			// No address provided, and failed to deduce one.
-			// Unit tests don't have this value set.
-			request.Address = defaultScheme + "127.0.0.1"
+			c.JSON(http.StatusBadRequest, r)
 		}
+		return
 	}
-
-	if request.Port != "" {
-		request.Address = request.Address + ":" + request.Port
+	id, result, reg_err := sr.RegisterInstance(inst)
+	audit(c, "register", registerAttrs(inst, id, result, reg_err)...)
+	if errors.Is(reg_err, registry.ErrConflict) || errors.Is(reg_err, registry.ErrStatic) {
+		r := message.RegisterResponse{Result: string(result), Error: reg_err.Error()}
+		c.JSON(http.StatusConflict, r)
+		return
+	}
+	if errors.Is(reg_err, registry.ErrLimit) {
+		r := message.RegisterResponse{Result: string(result), Error: reg_err.Error()}
+		c.JSON(http.StatusTooManyRequests, r)
+		return
+	}
+	if errors.Is(reg_err, registry.ErrStorage) {
+		r := message.RegisterResponse{Result: string(result), Error: reg_err.Error()}
+		c.JSON(http.StatusInternalServerError, r)
+		return
 	}
-
-	id, reg_err := sr.Register(request.Name, request.Address)
 	if reg_err != nil {
 		c.AbortWithError(http.StatusBadRequest, reg_err)
 		return
 	}
 
-	r := message.RegisterResponse{ID: id, Success: true}
+	r := message.RegisterResponse{ID: id, Success: true, Result: string(result)}
+	c.JSON(http.StatusOK, r)
+}
+
+func registerBatch(c *gin.Context, sr registry.Registry, cfg *config) {
+	var request message.RegisterBatchRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Registrations) > maxBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many registrations"})
+		return
+	}
+
+	// Items without a name are rejected here, as binding would reject a single registration.
+	r := message.RegisterBatchResponse{Success: true, Results: make([]message.RegisterResponse, len(request.Registrations))}
+	instances := make([]registry.Instance, 0, len(request.Registrations))
+	indexes := make([]int, 0, len(request.Registrations))
+	for i, item := range request.Registrations {
+		if item.Name == "" {
+			r.Results[i] = message.RegisterResponse{Result: string(registry.ResultRejected), Error: "name is required"}
+			r.Success = false
+			continue
+		}
+		inst, err := instance(c, sr, item, cfg)
+		if err != nil {
+			r.Results[i] = message.RegisterResponse{Result: string(registry.ResultRejected), Error: err.Error()}
+			r.Success = false
+			continue
+		}
+		instances = append(instances, inst)
+		indexes = append(indexes, i)
+	}
+
+	for i, reg := range sr.RegisterBatch(instances) {
+		audit(c, "register", registerAttrs(instances[i], reg.ID, reg.Result, reg.Err)...)
+		result := &r.Results[indexes[i]]
+		result.Result = string(reg.Result)
+		if reg.Err != nil {
+			result.Error = reg.Err.Error()
+			r.Success = false
+		} else {
+			result.ID = reg.ID
+			result.Success = true
+		}
+	}
 	c.JSON(http.StatusOK, r)
 }
 
-func deregister(c *gin.Context, sr registry.Registry) {
+// registeredAddress parses the address of a registration. As older servers accepted it,
+// a host and port without a scheme, like "localhost:5000", is taken to be http.
+func registeredAddress(address string) (registry.Address, error) {
+	if !strings.Contains(address, "://") && !strings.HasPrefix(strings.ToLower(address), registry.SchemeUnix+":") {
+		if _, _, err := net.SplitHostPort(address); err == nil {
+			address = registry.SchemeHTTP + "://" + address
+		}
+	}
+	return registry.ParseAddress(address)
+}
+
+// instance returns the instance to register for a request, deducing its address if needed.
+// The port, if given, is added to the address, and must agree with any port it already has.
+func instance(c *gin.Context, sr registry.Registry, request message.RegisterRequest, cfg *config) (registry.Instance, error) {
+	var address registry.Address
+	if request.Address != "" {
+		var err error
+		if address, err = registeredAddress(request.Address); err != nil {
+			return registry.Instance{}, err
+		}
+		if cfg.checkSource {
+			if err := checkSource(c, address); err != nil {
+				return registry.Instance{}, err
+			}
+		}
+	} else if cfg.noDeduction {
+		return registry.Instance{}, errAddressRequired
+	} else {
+		address = registry.Address{Scheme: registry.SchemeHTTP, Host: c.ClientIP()}
+		if address.Host == "" {
+			// No address provided, and failed to deduce one.
+			// Unit tests don't have this value set.
+			address.Host = "127.0.0.1"
+		}
+	}
+
+	address, err := address.WithPort(request.Port)
+	if err != nil {
+		return registry.Instance{}, err
+	}
+	inst := registry.Instance{
+		Name:     request.Name,
+		Address:  address.String(),
+		Tags:     request.Tags,
+		ID:       request.ID,
+		Locality: registry.Locality{Zone: request.Zone, Region: request.Region},
+	}
+	if cfg.checkSource {
+		if err := checkMove(c, sr, inst); err != nil {
+			return registry.Instance{}, err
+		}
+	}
+	return inst, nil
+}
+
+// deregister removes an instance. Only admins may force the removal of static instances.
+// checkSource is set to check that the client owns the instance.
+func deregister(c *gin.Context, sr registry.Registry, force bool, checkSource bool) {
 	var request message.DeregisterRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if checkSource {
+		if err := checkOwner(c, sr, request.ID); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
-	reg_err := sr.Deregister(request.ID)
+	inst, _ := sr.Instance(request.ID)
+	var reg_err error
+	if force {
+		reg_err = sr.ForceDeregister(request.ID)
+	} else {
+		reg_err = sr.Deregister(request.ID)
+	}
+	audit(c, "deregister", "name", inst.Name, "id", request.ID, "address", inst.Address, "success", reg_err == nil)
+	if errors.Is(reg_err, registry.ErrStorage) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": reg_err.Error()})
+		return
+	}
 	r := message.DeregisterResponse{}
 	if reg_err == nil {
 		r.Success = true
@@ -65,40 +209,263 @@ func lookup(c *gin.Context, sr registry.Registry) {
 		return
 	}
 
-	address := sr.Lookup(request.Name)
+	wait, err := lookupWait(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	near := registry.Locality{Zone: request.Zone, Region: request.Region}
+	var instance registry.Instance
+	var ok bool
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+		defer cancel()
+		instance, ok = sr.LookupWait(ctx, request.Name, near, nil)
+	} else {
+		instance, ok = sr.LookupNear(request.Name, near, nil)
+	}
 	r := message.LookupResponse{}
-	if len(address) > 0 {
+	if ok && len(instance.Address) > 0 {
 		r.Success = true
-		r.Address = address
+		r.Address = instance.Address
+		r.Static = instance.Static
+		r.Zone = instance.Zone
+		r.Region = instance.Region
+		if request.Components {
+			r.Components = components(instance.Parsed)
+		}
 	}
 	c.JSON(http.StatusOK, r)
 }
 
-func heartbeat(c *gin.Context, sr registry.Registry) {
+// lookupWait returns the wait query parameter of a lookup, such as "5s", capped at maxLookupWait.
+func lookupWait(c *gin.Context) (time.Duration, error) {
+	value := c.Query("wait")
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, errors.New("wait must be a duration, such as 5s")
+	}
+	return min(wait, maxLookupWait), nil
+}
+
+func components(a registry.Address) *message.AddressComponents {
+	return &message.AddressComponents{Scheme: a.Scheme, Host: a.Host, Port: a.Port, Path: a.Path}
+}
+
+func heartbeat(c *gin.Context, sr registry.Registry, cfg *config) {
 	var request message.HeartbeatRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	r := message.HeartbeatResponse{Success: sr.Heartbeat(request.ID)}
+	if cfg.checkSource {
+		if err := checkOwner(c, sr, request.ID); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	var ok bool
+	if request.Load != nil {
+		ok = sr.HeartbeatLoad(request.ID, registry.Load(*request.Load))
+	} else {
+		ok = sr.Heartbeat(request.ID)
+	}
+	r := message.HeartbeatResponse{Success: ok}
+	c.JSON(http.StatusOK, r)
+}
+
+// heartbeatBatch reports heartbeats refused by the source check as unknown.
+func heartbeatBatch(c *gin.Context, sr registry.Registry, cfg *config) {
+	var request message.HeartbeatBatchRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Heartbeats) > maxBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many heartbeats"})
+		return
+	}
+
+	beats := make([]registry.Beat, 0, len(request.Heartbeats))
+	indexes := make([]int, 0, len(request.Heartbeats))
+	for i, item := range request.Heartbeats {
+		if cfg.checkSource && checkOwner(c, sr, item.ID) != nil {
+			continue
+		}
+		beat := registry.Beat{ID: item.ID}
+		if item.Load != nil {
+			load := registry.Load(*item.Load)
+			beat.Load = &load
+		}
+		beats = append(beats, beat)
+		indexes = append(indexes, i)
+	}
+
+	r := message.HeartbeatBatchResponse{Success: true, Results: make([]message.HeartbeatResponse, len(request.Heartbeats))}
+	for i, ok := range sr.HeartbeatBatch(beats) {
+		r.Results[indexes[i]].Success = ok
+	}
+	for _, result := range r.Results {
+		r.Success = r.Success && result.Success
+	}
 	c.JSON(http.StatusOK, r)
 }
 
-func SetupRouter(registry registry.Registry) *gin.Engine {
+func status(c *gin.Context, sr registry.Registry) {
+	instances := sr.Instances()
+	names := make(map[string]bool)
+	for _, instance := range instances {
+		names[instance.Name] = true
+	}
+	r := message.StatusResponse{
+		Success:        true,
+		Services:       len(names),
+		Instances:      len(instances),
+		TimeoutSeconds: sr.Timeout().Seconds(),
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+type config struct {
+	proxy      bool
+	adminToken string
+
+	rateLimits       map[string]rateLimit
+	defaultRateLimit *rateLimit
+	maxBodyBytes     int64
+
+	logger *slog.Logger
+	audit  *slog.Logger
+
+	trustedProxies   []netip.Prefix
+	forwardedHeaders []string
+	noDeduction      bool
+	checkSource      bool
+
+	webhooks        []Webhook
+	webhookAttempts int
+	webhookBackoff  time.Duration
+
+	// registry is served by New.
+	registry registry.Registry
+}
+
+// Option enables optional server features.
+type Option func(*config)
+
+// WithProxy serves /proxy/NAME/PATH, forwarding each request to PATH
+// on an instance of the service NAME.
+func WithProxy() Option {
+	return func(c *config) {
+		c.proxy = true
+	}
+}
+
+// WithAdminToken serves the admin dashboard and API under /admin,
+// for clients presenting token as a bearer token or basic auth password.
+// Without a token, the admin routes are not served.
+func WithAdminToken(token string) Option {
+	return func(c *config) {
+		c.adminToken = token
+	}
+}
+
+// WithRegistry serves sr from New. Without it, New serves a new registry,
+// made by registry.NewServiceRegistry. SetupRouter ignores it.
+func WithRegistry(sr registry.Registry) Option {
+	return func(c *config) {
+		c.registry = sr
+	}
+}
+
+// New returns a handler serving the srsr API, for embedding srsr in another program:
+//
+//	sr, _ := registry.New(registry.WithTimeout(time.Minute))
+//	mux.Handle("/srsr/", http.StripPrefix("/srsr", server.New(server.WithRegistry(sr))))
+//
+// It is SetupRouter, for the registry given with WithRegistry.
+func New(opts ...Option) http.Handler {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	sr := cfg.registry
+	if sr == nil {
+		sr = registry.NewServiceRegistry()
+	}
+	return SetupRouter(sr, opts...)
+}
+
+// SetupRouter returns a router serving the srsr API for the registry.
+func SetupRouter(registry registry.Registry, opts ...Option) *gin.Engine {
+	cfg := config{
+		maxBodyBytes:    defaultMaxBodyBytes,
+		trustedProxies:  defaultTrustedProxies,
+		webhookAttempts: defaultWebhookAttempts,
+		webhookBackoff:  defaultWebhookBackoff,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 
-	router := gin.Default()
-	router.POST("/register", func(c *gin.Context) {
-		register(c, registry)
+	var router *gin.Engine
+	if cfg.logger != nil {
+		router = gin.New()
+		router.Use(gin.Recovery(), logRequests(cfg.logger))
+		registry.AddHook(logEvents(cfg.logger))
+	} else {
+		router = gin.Default()
+	}
+	trustProxies(router, &cfg)
+	if cfg.audit != nil {
+		router.Use(func(c *gin.Context) {
+			c.Set(auditKey, cfg.audit)
+		})
+		registry.AddHook(auditEvents(cfg.audit))
+	}
+	router.Use(limitRate(cfg))
+	var hooks *dispatcher
+	if len(cfg.webhooks) > 0 {
+		hooks = newDispatcher(registry, &cfg)
+	}
+
+	// Proxied requests are not subject to the body limit.
+	api := router.Group("/", limitBody(cfg.maxBodyBytes))
+	api.POST("/register", func(c *gin.Context) {
+		register(c, registry, &cfg)
 	})
-	router.POST("/deregister", func(c *gin.Context) {
-		deregister(c, registry)
+	api.POST("/register/batch", func(c *gin.Context) {
+		registerBatch(c, registry, &cfg)
 	})
-	router.POST("/lookup", func(c *gin.Context) {
+	api.POST("/deregister", func(c *gin.Context) {
+		deregister(c, registry, false, cfg.checkSource)
+	})
+	api.POST("/lookup", func(c *gin.Context) {
 		lookup(c, registry)
 	})
-	router.POST("/heartbeat", func(c *gin.Context) {
-		heartbeat(c, registry)
+	api.POST("/heartbeat", func(c *gin.Context) {
+		heartbeat(c, registry, &cfg)
+	})
+	api.POST("/heartbeat/batch", func(c *gin.Context) {
+		heartbeatBatch(c, registry, &cfg)
 	})
+	api.GET("/status", func(c *gin.Context) {
+		status(c, registry)
+	})
+	if cfg.adminToken != "" {
+		setupAdmin(router.Group("/admin", adminAuth(cfg.adminToken), rejectForgery()), registry, hooks, cfg.maxBodyBytes)
+	}
+	if cfg.proxy {
+		rp := newProxy(registry)
+		router.Any("/proxy/:name/*path", func(c *gin.Context) {
+			proxy(c, rp)
+		})
+	}
 	return router
 }
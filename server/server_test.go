@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -19,10 +20,11 @@ import (
 
 var _ = Describe("Server", func() {
 	var router *gin.Engine
+	var sr registry.Registry
 
 	BeforeEach(func() {
-		registry := registry.NewServiceRegistry()
-		router = server.SetupRouter(registry)
+		sr = registry.NewServiceRegistry()
+		router = server.SetupRouter(sr)
 	})
 	Context("Register", func() {
 		var responseRecorder *httptest.ResponseRecorder
@@ -47,6 +49,10 @@ var _ = Describe("Server", func() {
 				body, _ := io.ReadAll(responseRecorder.Body)
 				json.Unmarshal(body, &r)
 				Ω(len(r.ID)).Should(BeNumerically(">", 8))
+				Expect(r.Result).To(Equal("created"))
+			})
+			It("takes the address without a scheme to be http", func() {
+				Expect(sr.Lookup("dungen")).To(Equal("http://localhost:5000"))
 			})
 		})
 		When("the request is valid with empty address", func() {
@@ -83,6 +89,32 @@ var _ = Describe("Server", func() {
 				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
 			})
 		})
+		When("the request has a port as well as an address", func() {
+			send := func(address string, port string) {
+				request := message.RegisterRequest{Name: "dungen", Address: address, Port: port}
+				reqJSON, _ := json.Marshal(request)
+				reqHTTP, _ := http.NewRequest("POST", "/register", strings.NewReader(string(reqJSON)))
+				router.ServeHTTP(responseRecorder, reqHTTP)
+			}
+			It("adds the port", func() {
+				send("https://[::1]", "8443")
+				Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+				Expect(sr.Lookup("dungen")).To(Equal("https://[::1]:8443"))
+			})
+			It("accepts the same port twice", func() {
+				send("grpc://localhost:9000", "9000")
+				Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+				Expect(sr.Lookup("dungen")).To(Equal("grpc://localhost:9000"))
+			})
+			It("responds Bad Request for conflicting ports", func() {
+				send("http://localhost:80", "1234")
+				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+				r := message.RegisterResponse{}
+				json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+				Expect(r.Error).To(ContainSubstring("conflicting ports"))
+				Expect(sr.Instances()).To(BeEmpty())
+			})
+		})
 		When("the request is malformed", func() {
 			BeforeEach(func() {
 				reqJSON := "{'Desc: 'dungen', 'Adress': 'localhost:5000'}"
@@ -93,6 +125,63 @@ var _ = Describe("Server", func() {
 				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
 			})
 		})
+		When("the registration policy rejects a duplicate", func() {
+			BeforeEach(func() {
+				reg := registry.NewServiceRegistry()
+				reg.SetPolicy("dungen", registry.PolicyReject)
+				router = server.SetupRouter(reg)
+				request := message.RegisterRequest{
+					Name:    "dungen",
+					Address: "http://localhost:5000",
+				}
+				reqJSON, _ := json.Marshal(request)
+				reqHTTP, _ := http.NewRequest("POST", "/register", strings.NewReader(string(reqJSON)))
+				router.ServeHTTP(httptest.NewRecorder(), reqHTTP)
+				reqHTTP, _ = http.NewRequest("POST", "/register", strings.NewReader(string(reqJSON)))
+				router.ServeHTTP(responseRecorder, reqHTTP)
+			})
+			It("responds Conflict", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusConflict))
+			})
+			It("reports the rejection", func() {
+				r := message.RegisterResponse{}
+				json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+				Expect(r.Success).To(BeFalse())
+				Expect(r.Result).To(Equal("rejected"))
+			})
+		})
+		When("the request chooses an instance ID", func() {
+			var r message.RegisterResponse
+
+			send := func(id string) {
+				responseRecorder = httptest.NewRecorder()
+				request := message.RegisterRequest{
+					Name:    "dungen",
+					Address: "http://localhost:5000",
+					ID:      id,
+				}
+				reqJSON, _ := json.Marshal(request)
+				reqHTTP, _ := http.NewRequest("POST", "/register", strings.NewReader(string(reqJSON)))
+				router.ServeHTTP(responseRecorder, reqHTTP)
+				r = message.RegisterResponse{}
+				json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			}
+			It("responds with the namespaced ID", func() {
+				send("host-1")
+				Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+				Expect(r.ID).To(Equal("dungen/host-1"))
+			})
+			It("updates on registering again", func() {
+				send("host-1")
+				send("host-1")
+				Expect(r.ID).To(Equal("dungen/host-1"))
+				Expect(r.Result).To(Equal("updated"))
+			})
+			It("responds Bad Request for an invalid ID", func() {
+				send("host 1")
+				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
 		When("the request lacks required name field", func() {
 			BeforeEach(func() {
 				reqJSON := "{\"Address\": \"localhost:5000\"}"
@@ -238,8 +327,90 @@ var _ = Describe("Server", func() {
 			})
 
 		})
+		Context("with load", func() {
+			It("records the load", func() {
+				id, _ := sr.Register("dungen", "http://localhost:5000")
+				responseRecorder = httptest.NewRecorder()
+				request := message.HeartbeatRequest{
+					ID:   id,
+					Load: &message.Load{InFlight: 4, Capacity: 8},
+				}
+				reqJSON, _ := json.Marshal(request)
+				reqHTTP, _ = http.NewRequest("POST", "/heartbeat", strings.NewReader(string(reqJSON)))
+				router.ServeHTTP(responseRecorder, reqHTTP)
+
+				r := message.HeartbeatResponse{}
+				json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+				Expect(r.Success).To(BeTrue())
+				Expect(sr.Instances()[0].Load).To(Equal(registry.Load{InFlight: 4, Capacity: 8}))
+			})
+		})
 
 	})
+	Context("Batches", func() {
+		var responseRecorder *httptest.ResponseRecorder
+
+		post := func(path string, request any, response any) {
+			responseRecorder = httptest.NewRecorder()
+			reqJSON, _ := json.Marshal(request)
+			reqHTTP, _ := http.NewRequest("POST", path, strings.NewReader(string(reqJSON)))
+			router.ServeHTTP(responseRecorder, reqHTTP)
+			json.Unmarshal(responseRecorder.Body.Bytes(), response)
+		}
+
+		It("registers each item, with a result for each", func() {
+			r := message.RegisterBatchResponse{}
+			post("/register/batch", message.RegisterBatchRequest{Registrations: []message.RegisterRequest{
+				{Name: "dungen", Address: "http://localhost", Port: "5000"},
+				{Address: "http://localhost:5001"},
+				{Name: "dungen", Address: "http://localhost:5002", ID: "host-2"},
+			}}, &r)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(r.Success).To(BeFalse())
+			Expect(r.Results).To(HaveLen(3))
+			Expect(r.Results[0].Success).To(BeTrue())
+			Expect(r.Results[1].Success).To(BeFalse())
+			Expect(r.Results[1].Error).NotTo(BeEmpty())
+			Expect(r.Results[2].ID).To(Equal("dungen/host-2"))
+
+			addresses := []string{}
+			for _, instance := range sr.Instances() {
+				addresses = append(addresses, instance.Address)
+			}
+			Expect(addresses).To(ConsistOf("http://localhost:5000", "http://localhost:5002"))
+		})
+		It("reports conflicts per item", func() {
+			sr.SetPolicy("dungen", registry.PolicySingleton)
+			r := message.RegisterBatchResponse{}
+			post("/register/batch", message.RegisterBatchRequest{Registrations: []message.RegisterRequest{
+				{Name: "dungen", Address: "http://localhost:5000"},
+				{Name: "dungen", Address: "http://localhost:5001"},
+			}}, &r)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(r.Results[0].Success).To(BeTrue())
+			Expect(r.Results[1].Result).To(Equal("rejected"))
+		})
+		It("sends each heartbeat, with a result for each", func() {
+			id, _ := sr.Register("dungen", "http://localhost:5000")
+			r := message.HeartbeatBatchResponse{}
+			post("/heartbeat/batch", message.HeartbeatBatchRequest{Heartbeats: []message.HeartbeatRequest{
+				{ID: id, Load: &message.Load{InFlight: 5}},
+				{ID: "nope"},
+			}}, &r)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(r.Success).To(BeFalse())
+			Expect(r.Results).To(Equal([]message.HeartbeatResponse{{Success: true}, {Success: false}}))
+			Expect(sr.Instances()[0].Load.InFlight).To(Equal(5))
+		})
+		It("rejects a missing list", func() {
+			post("/heartbeat/batch", struct{}{}, &struct{}{})
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("rejects oversized batches", func() {
+			post("/heartbeat/batch", message.HeartbeatBatchRequest{Heartbeats: make([]message.HeartbeatRequest, 1001)}, &struct{}{})
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
 	Context("Lookup", func() {
 		var responseRecorder *httptest.ResponseRecorder
 		var reqHTTP *http.Request
@@ -250,7 +421,7 @@ var _ = Describe("Server", func() {
 			Context("address without port", func() {
 				BeforeEach(func() {
 					responseRecorder = httptest.NewRecorder()
-					address = "localhost:5000"
+					address = "http://localhost:5000"
 					regRequest := message.RegisterRequest{
 						Name:    "dungen",
 						Address: address,
@@ -321,6 +492,84 @@ var _ = Describe("Server", func() {
 					Expect(response.Address).To(Equal(address))
 				})
 			})
+			Context("from a zone", func() {
+				BeforeEach(func() {
+					for _, zone := range []string{"eu-west-1a", "eu-west-1b"} {
+						responseRecorder = httptest.NewRecorder()
+						reqJSON, _ := json.Marshal(message.RegisterRequest{Name: "dungen", Address: "http://" + zone + ":5000", Zone: zone, Region: "eu-west-1"})
+						registerHTTP, _ := http.NewRequest("POST", "/register", strings.NewReader(string(reqJSON)))
+						router.ServeHTTP(responseRecorder, registerHTTP)
+					}
+				})
+				It("responds with an instance in the zone", func() {
+					for i := 0; i < 10; i++ {
+						responseRecorder = httptest.NewRecorder()
+						reqJSON, _ := json.Marshal(message.LookupRequest{Name: "dungen", Zone: "eu-west-1b"})
+						reqHTTP, _ = http.NewRequest("POST", "/lookup", strings.NewReader(string(reqJSON)))
+						router.ServeHTTP(responseRecorder, reqHTTP)
+						response = message.LookupResponse{}
+						json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+						Expect(response.Address).To(Equal("http://eu-west-1b:5000"))
+						Expect(response.Zone).To(Equal("eu-west-1b"))
+						Expect(response.Region).To(Equal("eu-west-1"))
+					}
+				})
+			})
+			Context("requesting components", func() {
+				BeforeEach(func() {
+					sr.Register("dungen", "unix:///run/dungen.sock")
+					sr.Register("flard", "tcp://[fe80::1]:7000")
+					response = message.LookupResponse{}
+				})
+				lookupComponents := func(name string) {
+					responseRecorder = httptest.NewRecorder()
+					reqJSON, _ := json.Marshal(message.LookupRequest{Name: name, Components: true})
+					reqHTTP, _ = http.NewRequest("POST", "/lookup", strings.NewReader(string(reqJSON)))
+					router.ServeHTTP(responseRecorder, reqHTTP)
+					json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+				}
+				It("responds with the socket path of a unix address", func() {
+					lookupComponents("dungen")
+					Expect(response.Address).To(Equal("unix:///run/dungen.sock"))
+					Expect(*response.Components).To(Equal(message.AddressComponents{Scheme: "unix", Path: "/run/dungen.sock"}))
+				})
+				It("responds with an IPv6 host without brackets", func() {
+					lookupComponents("flard")
+					Expect(response.Address).To(Equal("tcp://[fe80::1]:7000"))
+					Expect(*response.Components).To(Equal(message.AddressComponents{Scheme: "tcp", Host: "fe80::1", Port: "7000"}))
+				})
+			})
+			Context("waiting", func() {
+				lookupWait := func(wait string) {
+					responseRecorder = httptest.NewRecorder()
+					reqJSON, _ := json.Marshal(message.LookupRequest{Name: "dungen"})
+					reqHTTP, _ = http.NewRequest("POST", "/lookup?wait="+wait, strings.NewReader(string(reqJSON)))
+					router.ServeHTTP(responseRecorder, reqHTTP)
+					response = message.LookupResponse{}
+					json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+				}
+				It("responds when an instance registers", func() {
+					go func() {
+						time.Sleep(20 * time.Millisecond)
+						sr.Register("dungen", "http://localhost:5000")
+					}()
+					lookupWait("10s")
+					Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+					Expect(response.Success).To(BeTrue())
+					Expect(response.Address).To(Equal("http://localhost:5000"))
+				})
+				It("responds unsuccessfully after the wait", func() {
+					start := time.Now()
+					lookupWait("30ms")
+					Expect(time.Since(start)).To(BeNumerically(">=", 30*time.Millisecond))
+					Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+					Expect(response.Success).To(BeFalse())
+				})
+				It("rejects an invalid wait", func() {
+					lookupWait("soon")
+					Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+				})
+			})
 		})
 		Context("with malformed request", func() {
 			BeforeEach(func() {
@@ -335,3 +584,32 @@ var _ = Describe("Server", func() {
 		})
 	})
 })
+
+var _ = Describe("New", func() {
+	lookup := func(handler http.Handler, path string) message.LookupResponse {
+		responseRecorder := httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest("POST", path, strings.NewReader(`{"name": "dungen"}`))
+		handler.ServeHTTP(responseRecorder, reqHTTP)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		response := message.LookupResponse{}
+		json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+		return response
+	}
+
+	It("serves the given registry", func() {
+		sr := registry.NewServiceRegistry()
+		sr.Register("dungen", "http://localhost:5000")
+		handler := server.New(server.WithRegistry(sr))
+		Expect(lookup(handler, "/lookup").Address).To(Equal("http://localhost:5000"))
+	})
+	It("serves a new registry without one", func() {
+		Expect(lookup(server.New(), "/lookup").Success).To(BeFalse())
+	})
+	It("can be mounted under a prefix", func() {
+		sr := registry.NewServiceRegistry()
+		sr.Register("dungen", "http://localhost:5000")
+		mux := http.NewServeMux()
+		mux.Handle("/srsr/", http.StripPrefix("/srsr", server.New(server.WithRegistry(sr))))
+		Expect(lookup(mux, "/srsr/lookup").Address).To(Equal("http://localhost:5000"))
+	})
+})
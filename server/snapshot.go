@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+)
+
+// maxSnapshotBytes limits the size of a snapshot to restore.
+// It is larger than other bodies, since it holds every instance.
+const maxSnapshotBytes = 64 << 20
+
+func getSnapshot(c *gin.Context, sr registry.Registry) {
+	now := time.Now()
+	snapshot := sr.Snapshot()
+	ttl := snapshot.Timeout
+	r := message.Snapshot{
+		Version:        message.SnapshotVersion,
+		Created:        now.UTC(),
+		TimeoutSeconds: ttl.Seconds(),
+		Policies:       make(map[string]string, len(snapshot.Policies)),
+		Strategies:     make(map[string]string, len(snapshot.Strategies)),
+		Windows:        make(map[string]message.Windows, len(snapshot.Windows)),
+		Fallbacks:      make(map[string]string, len(snapshot.Fallbacks)),
+		Traffic:        make(map[string]message.TrafficPolicy, len(snapshot.Traffic)),
+		Instances:      make([]message.InstanceInfo, 0, len(snapshot.Instances)),
+	}
+	for name, p := range snapshot.Policies {
+		r.Policies[name] = string(p)
+	}
+	for name, st := range snapshot.Strategies {
+		r.Strategies[name] = string(st)
+	}
+	for name, w := range snapshot.Windows {
+		r.Windows[name] = message.Windows{WarmupSeconds: w.Warmup.Seconds(), DrainSeconds: w.Drain.Seconds()}
+	}
+	for name, f := range snapshot.Fallbacks {
+		r.Fallbacks[name] = string(f)
+	}
+	for name, p := range snapshot.Traffic {
+		r.Traffic[name] = message.TrafficPolicy{Tag: p.Tag, Weights: p.Weights}
+	}
+	for _, instance := range snapshot.Instances {
+		r.Instances = append(r.Instances, instanceInfo(instance, ttl, now))
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// restoreSnapshot restores the snapshot in the body. The query may set mode to
+// "merge" (the default) or "replace", and reset_deadlines and restore_timeout to true.
+func restoreSnapshot(c *gin.Context, sr registry.Registry) {
+	fail := func(err error) {
+		c.JSON(http.StatusBadRequest, message.RestoreResponse{Error: err.Error()})
+	}
+
+	mode, err := registry.ParseRestoreMode(c.DefaultQuery("mode", string(registry.RestoreMerge)))
+	if err != nil {
+		fail(err)
+		return
+	}
+	reset, err := strconv.ParseBool(c.DefaultQuery("reset_deadlines", "false"))
+	if err != nil {
+		fail(err)
+		return
+	}
+	restoreTimeout, err := strconv.ParseBool(c.DefaultQuery("restore_timeout", "false"))
+	if err != nil {
+		fail(err)
+		return
+	}
+	var request message.Snapshot
+	if err := c.ShouldBindJSON(&request); err != nil {
+		fail(err)
+		return
+	}
+	if request.Version != message.SnapshotVersion {
+		c.JSON(http.StatusBadRequest, message.RestoreResponse{Error: "unsupported snapshot version " + strconv.Itoa(request.Version)})
+		return
+	}
+
+	snapshot := registry.Snapshot{
+		Instances:  make([]registry.Instance, 0, len(request.Instances)),
+		Policies:   make(map[string]registry.Policy, len(request.Policies)),
+		Strategies: make(map[string]registry.Strategy, len(request.Strategies)),
+		Windows:    make(map[string]registry.Windows, len(request.Windows)),
+		Fallbacks:  make(map[string]registry.Fallback, len(request.Fallbacks)),
+		Traffic:    make(map[string]registry.TrafficPolicy, len(request.Traffic)),
+	}
+	if restoreTimeout {
+		if request.TimeoutSeconds <= 0 {
+			fail(errors.New("the snapshot has no timeout to restore"))
+			return
+		}
+		snapshot.Timeout = time.Duration(request.TimeoutSeconds * float64(time.Second))
+	}
+	for name, p := range request.Policies {
+		if snapshot.Policies[name], err = registry.ParsePolicy(p); err != nil {
+			fail(err)
+			return
+		}
+	}
+	for name, st := range request.Strategies {
+		if snapshot.Strategies[name], err = registry.ParseStrategy(st); err != nil {
+			fail(err)
+			return
+		}
+	}
+	for name, w := range request.Windows {
+		if w.WarmupSeconds < 0 || w.DrainSeconds < 0 {
+			fail(errors.New("windows may not be negative"))
+			return
+		}
+		snapshot.Windows[name] = registry.Windows{
+			Warmup: time.Duration(w.WarmupSeconds * float64(time.Second)),
+			Drain:  time.Duration(w.DrainSeconds * float64(time.Second)),
+		}
+	}
+	for name, f := range request.Fallbacks {
+		if snapshot.Fallbacks[name], err = registry.ParseFallback(f); err != nil {
+			fail(err)
+			return
+		}
+	}
+	for name, p := range request.Traffic {
+		snapshot.Traffic[name] = registry.TrafficPolicy{Tag: p.Tag, Weights: p.Weights}
+	}
+	for _, info := range request.Instances {
+		instance := registry.Instance{
+			ID:            info.ID,
+			Name:          info.Name,
+			Address:       info.Address,
+			Tags:          info.Tags,
+			Status:        info.Status,
+			Static:        info.Static,
+			Locality:      registry.Locality{Zone: info.Zone, Region: info.Region},
+			Registered:    info.Registered,
+			LastHeartbeat: info.LastHeartbeat,
+		}
+		if info.Load != nil {
+			instance.Load = registry.Load(*info.Load)
+			instance.LoadReported = info.LastHeartbeat
+		}
+		snapshot.Instances = append(snapshot.Instances, instance)
+	}
+
+	if err := sr.Restore(snapshot, mode, reset); err != nil {
+		if errors.Is(err, registry.ErrStorage) {
+			c.JSON(http.StatusInternalServerError, message.RestoreResponse{Error: err.Error()})
+			return
+		}
+		fail(err)
+		return
+	}
+	audit(c, "restore", "mode", string(mode), "reset_deadlines", reset, "restore_timeout", restoreTimeout,
+		"instances", len(snapshot.Instances))
+	c.JSON(http.StatusOK, message.RestoreResponse{Success: true, Restored: len(snapshot.Instances)})
+}
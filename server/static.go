@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+)
+
+// staticFile is the format of the file read by LoadStaticFile.
+type staticFile struct {
+	Static []message.RegisterRequest `yaml:"static"`
+}
+
+// LoadStaticFile registers the static instances listed in a YAML (or JSON) file, like:
+//
+//	static:
+//	  - name: orders-db
+//	    address: postgres://db.internal
+//	    port: "5432"
+//	    id: primary
+//	    tags:
+//	      region: eu
+//
+// Instances already registered as static, with the same name and address, as when
+// the registry has a persistent Store, are left as they are.
+// It returns the number of instances registered, stopping at the first that fails.
+func LoadStaticFile(sr registry.Registry, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var file staticFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	existing := make(map[[2]string]bool)
+	for _, inst := range sr.Instances() {
+		if inst.Static {
+			existing[[2]string{inst.Name, inst.Address}] = true
+		}
+	}
+	registered := 0
+	for i, request := range file.Static {
+		if request.Name == "" || request.Address == "" {
+			return registered, fmt.Errorf("%s: static instance %d needs a name and address", path, i)
+		}
+		inst, err := staticInstance(request)
+		if err == nil && existing[[2]string{inst.Name, inst.Address}] {
+			continue
+		}
+		if err == nil {
+			_, _, err = sr.RegisterInstance(inst)
+		}
+		if err != nil {
+			return registered, fmt.Errorf("%s: static instance %s: %w", path, request.Name, err)
+		}
+		registered++
+	}
+	return registered, nil
+}
+
+// registerStatic registers an instance that never expires. Unlike /register,
+// the address is required, since the caller isn't the service.
+func registerStatic(c *gin.Context, sr registry.Registry) {
+	var request message.RegisterRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Address == "" {
+		c.JSON(http.StatusBadRequest, message.RegisterResponse{Error: "address is required"})
+		return
+	}
+	inst, err := staticInstance(request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, message.RegisterResponse{Result: string(registry.ResultRejected), Error: err.Error()})
+		return
+	}
+	id, result, err := sr.RegisterInstance(inst)
+	audit(c, "register static", registerAttrs(inst, id, result, err)...)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, registry.ErrConflict) || errors.Is(err, registry.ErrStatic) {
+			status = http.StatusConflict
+		} else if errors.Is(err, registry.ErrLimit) {
+			status = http.StatusTooManyRequests
+		} else if errors.Is(err, registry.ErrStorage) {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, message.RegisterResponse{Result: string(result), Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, message.RegisterResponse{ID: id, Success: true, Result: string(result)})
+}
+
+// staticInstance returns the static instance for a request, which must have an address.
+func staticInstance(request message.RegisterRequest) (registry.Instance, error) {
+	address, err := registry.ParseAddress(request.Address)
+	if err == nil {
+		address, err = address.WithPort(request.Port)
+	}
+	if err != nil {
+		return registry.Instance{}, err
+	}
+	return registry.Instance{
+		ID:       request.ID,
+		Name:     request.Name,
+		Address:  address.String(),
+		Tags:     request.Tags,
+		Static:   true,
+		Locality: registry.Locality{Zone: request.Zone, Region: request.Region},
+	}, nil
+}
@@ -0,0 +1,145 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("Static", func() {
+	const token = "sekrit"
+
+	var reg registry.Registry
+	var router *gin.Engine
+	var responseRecorder *httptest.ResponseRecorder
+
+	send := func(path string, body string, admin bool) {
+		responseRecorder = httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		reqHTTP.Header.Set("Content-Type", "application/json")
+		if admin {
+			reqHTTP.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(responseRecorder, reqHTTP)
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		router = server.SetupRouter(reg, server.WithAdminToken(token))
+	})
+
+	Context("registered by an admin", func() {
+		var id string
+
+		BeforeEach(func() {
+			send("/admin/api/static", `{"name": "orders-db", "address": "postgres://db.internal", "port": "5432", "id": "primary"}`, true)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			r := message.RegisterResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			id = r.ID
+		})
+
+		It("is marked in lookups", func() {
+			send("/lookup", `{"name": "orders-db"}`, false)
+			r := message.LookupResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Address).To(Equal("postgres://db.internal:5432"))
+			Expect(r.Static).To(BeTrue())
+		})
+		It("is marked in the instance list", func() {
+			responseRecorder = httptest.NewRecorder()
+			reqHTTP, _ := http.NewRequest("GET", "/admin/api/instances", nil)
+			reqHTTP.Header.Set("Authorization", "Bearer "+token)
+			router.ServeHTTP(responseRecorder, reqHTTP)
+			r := message.InstancesResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Instances[0].Static).To(BeTrue())
+			Expect(r.Instances[0].TTL).To(BeZero())
+		})
+		It("is not removed by /deregister", func() {
+			send("/deregister", `{"id": "`+id+`"}`, false)
+			r := message.DeregisterResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Success).To(BeFalse())
+			Expect(reg.Lookup("orders-db")).NotTo(BeEmpty())
+		})
+		It("is not updated by /register", func() {
+			send("/register", `{"name": "orders-db", "address": "http://elsewhere", "id": "primary"}`, false)
+			Expect(responseRecorder.Code).To(Equal(http.StatusConflict))
+		})
+		It("is removed by an admin", func() {
+			send("/admin/api/deregister", `{"id": "`+id+`"}`, true)
+			r := message.DeregisterResponse{}
+			json.Unmarshal(responseRecorder.Body.Bytes(), &r)
+			Expect(r.Success).To(BeTrue())
+			Expect(reg.Lookup("orders-db")).To(BeEmpty())
+		})
+	})
+
+	It("requires an address", func() {
+		send("/admin/api/static", `{"name": "orders-db"}`, true)
+		Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+	})
+	It("requires the admin token", func() {
+		send("/admin/api/static", `{"name": "orders-db", "address": "postgres://db.internal"}`, false)
+		Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	Describe("LoadStaticFile", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "static.yaml")
+		})
+
+		It("registers each instance", func() {
+			os.WriteFile(path, []byte(`
+static:
+  - name: orders-db
+    address: postgres://db.internal
+    port: "5432"
+    tags:
+      region: eu
+  - name: payments
+    address: https://api.payments.example
+`), 0o600)
+			n, err := server.LoadStaticFile(reg, path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2))
+			instance, ok := reg.LookupInstance("orders-db", nil)
+			Expect(ok).To(BeTrue())
+			Expect(instance.Address).To(Equal("postgres://db.internal:5432"))
+			Expect(instance.Static).To(BeTrue())
+			Expect(instance.Tags).To(HaveKeyWithValue("region", "eu"))
+		})
+		It("leaves instances already registered", func() {
+			os.WriteFile(path, []byte("static:\n  - name: orders-db\n    address: postgres://db.internal:5432\n"), 0o600)
+			server.LoadStaticFile(reg, path)
+			n, err := server.LoadStaticFile(reg, path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(0))
+			Expect(reg.Instances()).To(HaveLen(1))
+		})
+		It("requires addresses", func() {
+			os.WriteFile(path, []byte("static:\n  - name: orders-db\n"), 0o600)
+			_, err := server.LoadStaticFile(reg, path)
+			Expect(err).To(HaveOccurred())
+		})
+		It("reports a missing file", func() {
+			_, err := server.LoadStaticFile(reg, path)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
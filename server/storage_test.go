@@ -0,0 +1,94 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+// failingStore is a MemoryStore whose writes fail once broken is set.
+type failingStore struct {
+	*registry.MemoryStore
+	broken bool
+}
+
+func (s *failingStore) Put(instance registry.Instance) error {
+	if s.broken {
+		return errors.New("disk full")
+	}
+	return s.MemoryStore.Put(instance)
+}
+
+func (s *failingStore) Delete(id string) error {
+	if s.broken {
+		return errors.New("disk full")
+	}
+	return s.MemoryStore.Delete(id)
+}
+
+var _ = Describe("Storage failures", func() {
+	const token = "sekrit"
+
+	var store *failingStore
+	var reg registry.Registry
+	var router *gin.Engine
+	var responseRecorder *httptest.ResponseRecorder
+	var id string
+
+	send := func(path string, body string) {
+		responseRecorder = httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		reqHTTP.Header.Set("Content-Type", "application/json")
+		reqHTTP.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(responseRecorder, reqHTTP)
+	}
+
+	// expectError expects an Internal Server Error, explained by a JSON error.
+	expectError := func() {
+		Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+		var r map[string]any
+		Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &r)).To(Succeed())
+		Expect(r["error"]).To(ContainSubstring("disk full"))
+	}
+
+	BeforeEach(func() {
+		store = &failingStore{MemoryStore: registry.NewMemoryStore()}
+		var err error
+		reg, err = registry.New(registry.WithStore(store))
+		Expect(err).NotTo(HaveOccurred())
+		router = server.SetupRouter(reg, server.WithAdminToken(token))
+		id, _ = reg.Register("dungen", "http://localhost:5000")
+		store.broken = true
+	})
+
+	It("fails registrations", func() {
+		send("/register", `{"name": "flard", "address": "http://localhost:5001"}`)
+		expectError()
+	})
+	It("fails static registrations", func() {
+		send("/admin/api/static", `{"name": "orders-db", "address": "postgres://db.internal:5432"}`)
+		expectError()
+	})
+	It("fails deregistrations", func() {
+		send("/deregister", `{"id": "`+id+`"}`)
+		expectError()
+	})
+	It("fails maintenance", func() {
+		send("/admin/api/maintenance", `{"id": "`+id+`", "maintenance": true}`)
+		expectError()
+	})
+	It("fails restores", func() {
+		send("/admin/snapshot", `{"version": 1, "instances": [{"name": "flard", "address": "http://localhost:5001"}]}`)
+		expectError()
+	})
+})
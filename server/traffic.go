@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+)
+
+func setTraffic(c *gin.Context, sr registry.Registry) {
+	var request message.TrafficRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Tag == "" {
+		sr.ClearTraffic(request.Name)
+		audit(c, "traffic", "name", request.Name, "cleared", true)
+		c.JSON(http.StatusOK, message.TrafficResponse{Success: true})
+		return
+	}
+	err := sr.SetTraffic(request.Name, registry.TrafficPolicy{Tag: request.Tag, Weights: request.Weights})
+	audit(c, "traffic", "name", request.Name, "tag", request.Tag, "weights", request.Weights, "success", err == nil)
+	if errors.Is(err, registry.ErrTraffic) {
+		c.JSON(http.StatusBadRequest, message.TrafficResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, message.TrafficResponse{Success: true})
+}
+
+// traffic lists the traffic policies, ordered by name, with the share of lookups
+// each group currently receives.
+func traffic(c *gin.Context, sr registry.Registry) {
+	policies := sr.Traffic()
+	infos := make(map[string]*message.TrafficInfo, len(policies))
+	for name, p := range policies {
+		infos[name] = &message.TrafficInfo{
+			Name:      name,
+			Tag:       p.Tag,
+			Weights:   p.Weights,
+			Instances: make(map[string]int),
+			Share:     make(map[string]float64),
+		}
+	}
+	for _, instance := range sr.Instances() {
+		info, ok := infos[instance.Name]
+		if !ok || instance.Status != registry.StatusUp {
+			continue
+		}
+		value, tagged := instance.Tags[info.Tag]
+		if tagged && info.Weights[value] > 0 {
+			info.Instances[value]++
+		}
+	}
+
+	r := message.TrafficPoliciesResponse{Success: true, Policies: []message.TrafficInfo{}}
+	for _, info := range infos {
+		total := 0
+		for value := range info.Instances {
+			total += info.Weights[value]
+		}
+		for value := range info.Weights {
+			if info.Instances[value] > 0 {
+				info.Share[value] = float64(info.Weights[value]) / float64(total)
+			} else {
+				info.Share[value] = 0
+			}
+		}
+		r.Policies = append(r.Policies, *info)
+	}
+	sort.Slice(r.Policies, func(i, j int) bool {
+		return r.Policies[i].Name < r.Policies[j].Name
+	})
+	c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+)
+
+const (
+	// webhookQueue is the number of events waiting for each webhook.
+	// Beyond it, events are dead-lettered without being sent.
+	webhookQueue = 1000
+	// maxWebhookBackoff caps the pause between attempts to deliver an event.
+	maxWebhookBackoff = time.Minute
+	// maxDeadLetters is the number of dead letters kept. Older ones are dropped.
+	maxDeadLetters = 100
+
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = time.Second
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the body of a webhook request,
+// keyed by the webhook's secret, as "sha256=" and the hex digest.
+const SignatureHeader = "X-Srsr-Signature"
+
+// Webhook is an HTTP callback for changes to the registry. Each event is POSTed
+// to URL as a message.WebhookEvent.
+type Webhook struct {
+	URL string `yaml:"url"`
+	// Names and Events limit the events sent to those of these services, and of these types.
+	// If empty, events of every service, or of every type, are sent.
+	Names  []string             `yaml:"names"`
+	Events []registry.EventType `yaml:"events"`
+	// Secret, if not empty, signs each request in the SignatureHeader.
+	Secret string `yaml:"secret"`
+}
+
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an absolute http or https URL", w.URL)
+	}
+	for _, t := range w.Events {
+		if _, err := registry.ParseEventType(string(t)); err != nil {
+			return fmt.Errorf("webhook %s: %w", w.URL, err)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the event passes the webhook's filters.
+func (w Webhook) wants(e registry.Event) bool {
+	return (len(w.Names) == 0 || slices.Contains(w.Names, e.Instance.Name)) &&
+		(len(w.Events) == 0 || slices.Contains(w.Events, e.Type))
+}
+
+// WithWebhooks sends changes to the registry to these webhooks. Events are delivered
+// in order for each webhook, in the background. A request that fails, or whose response
+// is 429 or 5xx, is retried. An event that can't be delivered becomes a dead letter,
+// which is logged, and listed at /admin/api/webhooks/dead-letters.
+func WithWebhooks(webhooks ...Webhook) Option {
+	return func(c *config) {
+		c.webhooks = append(c.webhooks, webhooks...)
+	}
+}
+
+// WithWebhookRetry sets the number of attempts to deliver each event to a webhook,
+// and the pause after the first failure, which doubles after each failure after that.
+// The default is 5 attempts, from 1 second.
+func WithWebhookRetry(attempts int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.webhookAttempts = max(attempts, 1)
+		c.webhookBackoff = backoff
+	}
+}
+
+// webhookFile is the format of the file read by LoadWebhookFile.
+type webhookFile struct {
+	Webhooks []Webhook `yaml:"webhooks"`
+}
+
+// LoadWebhookFile reads webhooks from a YAML (or JSON) file, like:
+//
+//	webhooks:
+//	  - url: https://ops.internal/srsr
+//	    secret: sekrit
+//	    names: [orders, payments]
+//	    events: [deregistered, expired]
+func LoadWebhookFile(path string) ([]Webhook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file webhookFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, w := range file.Webhooks {
+		if err := w.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return file.Webhooks, nil
+}
+
+// delivery is an event waiting to be sent to a webhook.
+type delivery struct {
+	id    string
+	event registry.Event
+}
+
+// dispatcher delivers events to webhooks, and keeps those it couldn't.
+type dispatcher struct {
+	sr       registry.Registry
+	client   *http.Client
+	logger   *slog.Logger
+	attempts int
+	backoff  time.Duration
+
+	mutex       sync.Mutex
+	deadLetters []message.DeadLetter
+}
+
+// newDispatcher starts delivering the registry's events to the configured webhooks.
+func newDispatcher(sr registry.Registry, cfg *config) *dispatcher {
+	d := &dispatcher{
+		sr:       sr,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   cfg.logger,
+		attempts: cfg.webhookAttempts,
+		backoff:  cfg.webhookBackoff,
+	}
+	if d.logger == nil {
+		d.logger = slog.Default()
+	}
+	for _, w := range cfg.webhooks {
+		queue := make(chan delivery, webhookQueue)
+		go d.run(w, queue)
+		sr.AddHook(func(e registry.Event) {
+			if !w.wants(e) {
+				return
+			}
+			dl := delivery{id: uuid.NewString(), event: e}
+			select {
+			case queue <- dl:
+			default:
+				// The hook must not block the registry.
+				go func() {
+					d.dead(w, d.body(dl), 0, errors.New("queue is full"))
+				}()
+			}
+		})
+	}
+	return d
+}
+
+// run delivers the queued events to w, one at a time.
+func (d *dispatcher) run(w Webhook, queue <-chan delivery) {
+	for dl := range queue {
+		event := d.body(dl)
+		body, _ := json.Marshal(event)
+		backoff := d.backoff
+		for attempt := 1; ; attempt++ {
+			retry, err := d.send(w, event, body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= d.attempts {
+				d.dead(w, event, attempt, err)
+				break
+			}
+			d.logger.Warn("webhook failed", "url", w.URL, "event", event.ID, "attempt", attempt, "error", err)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, maxWebhookBackoff)
+		}
+	}
+}
+
+// body is the message sent for a delivery.
+func (d *dispatcher) body(dl delivery) message.WebhookEvent {
+	return message.WebhookEvent{
+		ID:       dl.id,
+		Type:     string(dl.event.Type),
+		Time:     dl.event.Time,
+		Instance: instanceInfo(dl.event.Instance, d.sr.Timeout(), dl.event.Time),
+	}
+}
+
+// send makes one attempt to deliver an event, and reports whether a failure is worth retrying.
+func (d *dispatcher) send(w Webhook, event message.WebhookEvent, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Srsr-Event", event.Type)
+	req.Header.Set("X-Srsr-Delivery", event.ID)
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, errors.New("status " + strconv.Itoa(resp.StatusCode))
+}
+
+// dead records an event that could not be delivered.
+func (d *dispatcher) dead(w Webhook, event message.WebhookEvent, attempts int, err error) {
+	d.logger.Error("webhook event dead-lettered", "url", w.URL, "event", event.ID, "type", event.Type,
+		"name", event.Instance.Name, "id", event.Instance.ID, "attempts", attempts, "error", err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deadLetters = append(d.deadLetters, message.DeadLetter{
+		Webhook:  w.URL,
+		Event:    event,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Failed:   time.Now(),
+	})
+	if len(d.deadLetters) > maxDeadLetters {
+		d.deadLetters = slices.Delete(d.deadLetters, 0, len(d.deadLetters)-maxDeadLetters)
+	}
+}
+
+// letters returns the dead letters, oldest first. d may be nil, if there are no webhooks.
+func (d *dispatcher) letters() []message.DeadLetter {
+	if d == nil {
+		return []message.DeadLetter{}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]message.DeadLetter{}, d.deadLetters...)
+}
+
+// Sign returns the value of the SignatureHeader for body, for receivers to compare,
+// with hmac.Equal, to the header they receive.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deadLetters(c *gin.Context, d *dispatcher) {
+	c.JSON(http.StatusOK, message.DeadLettersResponse{Success: true, DeadLetters: d.letters()})
+}
@@ -0,0 +1,181 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ifIMust/srsr/message"
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+)
+
+var _ = Describe("Webhooks", func() {
+	const token = "sekrit"
+	const secret = "hush"
+
+	// received is a request to the receiver.
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+
+	var reg registry.Registry
+	var router *gin.Engine
+	var receiver *httptest.Server
+	var requests chan received
+	var status atomic.Int32
+	// failures is the number of requests to fail with 503, before responding with status.
+	var failures atomic.Int32
+
+	event := func(r received) message.WebhookEvent {
+		var e message.WebhookEvent
+		Expect(json.Unmarshal(r.body, &e)).To(Succeed())
+		return e
+	}
+	deadLetters := func() []message.DeadLetter {
+		responseRecorder := httptest.NewRecorder()
+		reqHTTP, _ := http.NewRequest("GET", "/admin/api/webhooks/dead-letters", nil)
+		reqHTTP.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(responseRecorder, reqHTTP)
+		response := message.DeadLettersResponse{}
+		json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+		return response.DeadLetters
+	}
+	setup := func(webhook server.Webhook) {
+		webhook.URL = receiver.URL
+		router = server.SetupRouter(reg, server.WithAdminToken(token),
+			server.WithWebhooks(webhook), server.WithWebhookRetry(3, time.Millisecond))
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		requests = make(chan received, 10)
+		status.Store(http.StatusOK)
+		failures.Store(0)
+		receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			requests <- received{header: r.Header, body: body}
+			if failures.Add(-1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(int(status.Load()))
+		}))
+	})
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	It("posts signed events", func() {
+		setup(server.Webhook{Secret: secret})
+		reg.Register("dungen", "http://localhost:5000")
+
+		var r received
+		Eventually(requests).Should(Receive(&r))
+		Expect(r.header.Get(server.SignatureHeader)).To(Equal(server.Sign(secret, r.body)))
+		Expect(r.header.Get("X-Srsr-Event")).To(Equal("registered"))
+		e := event(r)
+		Expect(e.Type).To(Equal("registered"))
+		Expect(e.ID).To(Equal(r.header.Get("X-Srsr-Delivery")))
+		Expect(e.Instance.Name).To(Equal("dungen"))
+		Expect(e.Instance.Address).To(Equal("http://localhost:5000"))
+	})
+	It("posts unsigned events without a secret", func() {
+		setup(server.Webhook{})
+		reg.Register("dungen", "http://localhost:5000")
+
+		var r received
+		Eventually(requests).Should(Receive(&r))
+		Expect(r.header.Get(server.SignatureHeader)).To(BeEmpty())
+	})
+	It("filters events by name and type", func() {
+		setup(server.Webhook{Names: []string{"dungen"}, Events: []registry.EventType{registry.EventDeregistered}})
+		reg.Register("flard", "http://localhost:5001")
+		id, _ := reg.Register("dungen", "http://localhost:5000")
+		reg.Deregister(id)
+
+		var r received
+		Eventually(requests).Should(Receive(&r))
+		Expect(event(r).Type).To(Equal("deregistered"))
+		Expect(event(r).Instance.Name).To(Equal("dungen"))
+		Consistently(requests, 50*time.Millisecond).ShouldNot(Receive())
+	})
+	It("retries failed deliveries", func() {
+		failures.Store(2)
+		setup(server.Webhook{})
+		reg.Register("dungen", "http://localhost:5000")
+
+		var first, last received
+		Eventually(requests).Should(Receive(&first))
+		Eventually(requests).Should(Receive())
+		Eventually(requests).Should(Receive(&last))
+		Expect(event(last).ID).To(Equal(event(first).ID))
+		Consistently(requests, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(deadLetters()).To(BeEmpty())
+	})
+	It("dead-letters events after the last attempt", func() {
+		status.Store(http.StatusInternalServerError)
+		setup(server.Webhook{})
+		reg.Register("dungen", "http://localhost:5000")
+
+		Eventually(deadLetters).Should(HaveLen(1))
+		Expect(requests).To(HaveLen(3))
+		dead := deadLetters()[0]
+		Expect(dead.Webhook).To(Equal(receiver.URL))
+		Expect(dead.Attempts).To(Equal(3))
+		Expect(dead.Error).To(ContainSubstring("500"))
+		Expect(dead.Event.Instance.Name).To(Equal("dungen"))
+	})
+	It("doesn't retry refused events", func() {
+		status.Store(http.StatusBadRequest)
+		setup(server.Webhook{})
+		reg.Register("dungen", "http://localhost:5000")
+
+		Eventually(deadLetters).Should(HaveLen(1))
+		Expect(deadLetters()[0].Attempts).To(Equal(1))
+		Expect(requests).To(HaveLen(1))
+	})
+
+	Describe("LoadWebhookFile", func() {
+		write := func(content string) string {
+			path := filepath.Join(GinkgoT().TempDir(), "webhooks.yaml")
+			Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+			return path
+		}
+		It("reads webhooks", func() {
+			webhooks, err := server.LoadWebhookFile(write(`
+webhooks:
+  - url: https://ops.internal/srsr
+    secret: hush
+    names: [dungen]
+    events: [expired]
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(webhooks).To(Equal([]server.Webhook{{
+				URL:    "https://ops.internal/srsr",
+				Secret: "hush",
+				Names:  []string{"dungen"},
+				Events: []registry.EventType{registry.EventExpired},
+			}}))
+		})
+		It("rejects unknown event types", func() {
+			_, err := server.LoadWebhookFile(write("webhooks:\n  - url: https://ops.internal/srsr\n    events: [exploded]\n"))
+			Expect(err).To(MatchError(ContainSubstring("exploded")))
+		})
+		It("rejects relative URLs", func() {
+			_, err := server.LoadWebhookFile(write("webhooks:\n  - url: /srsr\n"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,226 @@
+// Package sidecar registers a child process with srsr for as long as it runs,
+// for services that can't use the client package themselves.
+package sidecar
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/ifIMust/srsr/client"
+)
+
+const (
+	defaultHealthInterval = 5 * time.Second
+	healthTimeout         = 2 * time.Second
+)
+
+type Config struct {
+	// Name, Address and Port are registered as the client package would.
+	// Address may be empty, to have it deduced.
+	Name    string
+	Address string
+	Port    string
+
+	// InstanceID optionally registers with a stable ID, such as the host name.
+	InstanceID string
+
+	// Zone and Region are where the child runs, for zone-aware lookups. Both are optional.
+	Zone   string
+	Region string
+
+	// Servers lists registry servers. The first is preferred.
+	Servers []string
+
+	// HealthURL, if set, is polled every HealthInterval. The child is registered
+	// only while the URL responds with a 2xx status.
+	HealthURL      string
+	HealthInterval time.Duration
+
+	// HeartbeatInterval overrides the client's default, if not zero.
+	HeartbeatInterval time.Duration
+
+	// Command is the child program and its arguments.
+	Command []string
+
+	// Signals received here are forwarded to the child at once, even while the registry
+	// is slow to respond. SIGTERM and SIGINT, which stop the child, also start deregistering
+	// it for good. Others, like SIGHUP to reload, leave it registered.
+	Signals <-chan os.Signal
+
+	// Logger reports registration changes. It defaults to the standard logger.
+	Logger *log.Logger
+}
+
+// Run starts the child, and registers it while it is alive and healthy.
+// It returns the child's exit code once the child exits, and has been deregistered.
+// If the child is killed by a signal, the code is 128 plus the signal number, like a shell.
+func Run(cfg Config) (int, error) {
+	if cfg.Name == "" {
+		return 0, errors.New("sidecar: name is required")
+	}
+	if len(cfg.Servers) == 0 {
+		return 0, errors.New("sidecar: a server is required")
+	}
+	if len(cfg.Command) == 0 {
+		return 0, errors.New("sidecar: a command is required")
+	}
+	if cfg.HealthInterval <= 0 {
+		cfg.HealthInterval = defaultHealthInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+
+	cmd := exec.Command(cfg.Command[0], cfg.Command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	c := client.NewServiceRegistryClient(cfg.Name, cfg.Address, cfg.Servers[0], clientOptions(cfg)...)
+	defer c.Close()
+
+	// Health checks and registration run apart, so that they never delay forwarding
+	// a signal, or noticing that the child has exited.
+	w := watcher{cfg: cfg, client: c}
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		w.watch(stop)
+	}()
+	stopWatching := func() {
+		select {
+		case <-stop:
+		default:
+			close(stop)
+		}
+	}
+
+	for {
+		select {
+		case err := <-exited:
+			stopWatching()
+			<-watched
+			return exitCode(cmd, err)
+
+		case sig := <-cfg.Signals:
+			if terminates(sig) {
+				// Stop discovery, so no new traffic arrives while the child shuts down.
+				stopWatching()
+			}
+			if err := cmd.Process.Signal(sig); err != nil {
+				cfg.Logger.Println("forwarding", sig, "failed, killing child:", err)
+				cmd.Process.Kill()
+			}
+		}
+	}
+}
+
+// terminates reports whether the signal asks the child to stop.
+func terminates(sig os.Signal) bool {
+	return sig == syscall.SIGTERM || sig == os.Interrupt
+}
+
+func clientOptions(cfg Config) []client.Option {
+	var opts []client.Option
+	if cfg.Port != "" {
+		opts = append(opts, client.WithPort(cfg.Port))
+	}
+	if len(cfg.Servers) > 1 {
+		opts = append(opts, client.WithServers(cfg.Servers[1:]...))
+	}
+	if cfg.InstanceID != "" {
+		opts = append(opts, client.WithInstanceID(cfg.InstanceID))
+	}
+	if cfg.Zone != "" || cfg.Region != "" {
+		opts = append(opts, client.WithLocality(cfg.Zone, cfg.Region))
+	}
+	if cfg.HeartbeatInterval > 0 {
+		opts = append(opts, client.WithHeartbeatInterval(cfg.HeartbeatInterval))
+	}
+	return opts
+}
+
+// watcher keeps the registration in line with the child's health.
+type watcher struct {
+	cfg        Config
+	client     client.ServiceRegistryClient
+	registered bool
+}
+
+// watch checks the child's health every HealthInterval, until stop is closed.
+// Then it deregisters the child, once any registration under way has finished.
+func (w *watcher) watch(stop <-chan struct{}) {
+	w.setRegistered(w.healthy())
+	ticker := time.NewTicker(w.cfg.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			w.setRegistered(false)
+			return
+		case <-ticker.C:
+			select {
+			case <-stop:
+				// Stopped during the last check. Don't register again.
+			default:
+				w.setRegistered(w.healthy())
+			}
+		}
+	}
+}
+
+func (w *watcher) setRegistered(registered bool) {
+	if registered == w.registered {
+		return
+	}
+	if registered {
+		if err := w.client.Register(); err != nil {
+			// Try again on the next check.
+			w.cfg.Logger.Println("register failed:", err)
+			return
+		}
+		w.cfg.Logger.Println("registered", w.cfg.Name)
+	} else {
+		w.client.Deregister()
+		w.cfg.Logger.Println("deregistered", w.cfg.Name)
+	}
+	w.registered = registered
+}
+
+func (w *watcher) healthy() bool {
+	if w.cfg.HealthURL == "" {
+		return true
+	}
+	httpClient := http.Client{Timeout: healthTimeout}
+	resp, err := httpClient.Get(w.cfg.HealthURL)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func exitCode(cmd *exec.Cmd, err error) (int, error) {
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return 0, err
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	return cmd.ProcessState.ExitCode(), nil
+}
@@ -0,0 +1,163 @@
+package sidecar_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ifIMust/srsr/registry"
+	"github.com/ifIMust/srsr/server"
+	"github.com/ifIMust/srsr/sidecar"
+)
+
+var _ = Describe("Sidecar", func() {
+	const name = "wrapped"
+	const address = "http://localhost:4949"
+
+	var reg registry.Registry
+	var srv *httptest.Server
+	var cfg sidecar.Config
+	var signals chan os.Signal
+
+	// start runs the sidecar in the background, delivering its exit code.
+	start := func() <-chan int {
+		codes := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			code, err := sidecar.Run(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			codes <- code
+		}()
+		return codes
+	}
+	lookup := func() string {
+		return reg.Lookup(name)
+	}
+
+	BeforeEach(func() {
+		reg = registry.NewServiceRegistry()
+		srv = httptest.NewServer(server.SetupRouter(reg))
+		signals = make(chan os.Signal, 1)
+		cfg = sidecar.Config{
+			Name:           name,
+			Address:        address,
+			Servers:        []string{srv.URL},
+			HealthInterval: 10 * time.Millisecond,
+			Signals:        signals,
+			Logger:         log.New(io.Discard, "", 0),
+		}
+	})
+	AfterEach(func() {
+		srv.Close()
+	})
+
+	It("requires a command", func() {
+		_, err := sidecar.Run(cfg)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails when the command can't be started", func() {
+		cfg.Command = []string{"/does/not/exist"}
+		_, err := sidecar.Run(cfg)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("registers while the child runs, and returns its exit code", func() {
+		cfg.Command = []string{"sh", "-c", "sleep 0.3; exit 7"}
+		codes := start()
+		Eventually(lookup).Should(Equal(address))
+		Eventually(codes, 2*time.Second).Should(Receive(Equal(7)))
+		Expect(lookup()).To(BeEmpty())
+	})
+
+	It("deregisters and forwards signals", func() {
+		cfg.Command = []string{"sh", "-c", "trap 'exit 3' TERM; while true; do sleep 0.01; done"}
+		codes := start()
+		Eventually(lookup).Should(Equal(address))
+		signals <- syscall.SIGTERM
+		Eventually(codes, 2*time.Second).Should(Receive(Equal(3)))
+		Expect(lookup()).To(BeEmpty())
+	})
+
+	It("forwards other signals without deregistering", func() {
+		reloaded := filepath.Join(GinkgoT().TempDir(), "reloaded")
+		cfg.Command = []string{"sh", "-c", "trap 'touch " + reloaded + "' HUP; while true; do sleep 0.01; done"}
+		codes := start()
+		Eventually(lookup).Should(Equal(address))
+		signals <- syscall.SIGHUP
+		Eventually(reloaded, 2*time.Second).Should(BeAnExistingFile())
+		Consistently(lookup, 100*time.Millisecond).Should(Equal(address))
+
+		signals <- syscall.SIGTERM
+		Eventually(codes, 2*time.Second).Should(Receive())
+		Expect(lookup()).To(BeEmpty())
+	})
+
+	It("forwards signals while the registry is slow to respond", func() {
+		release := make(chan struct{})
+		var once sync.Once
+		unblock := func() { once.Do(func() { close(release) }) }
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		// Cleanups run last first, so the server is unblocked before it is closed.
+		DeferCleanup(slow.Close)
+		DeferCleanup(unblock)
+		cfg.Servers = []string{slow.URL}
+		stopped := filepath.Join(GinkgoT().TempDir(), "stopped")
+		cfg.Command = []string{"sh", "-c", "trap 'touch " + stopped + "; exit 3' TERM; while true; do sleep 0.01; done"}
+		codes := start()
+		time.Sleep(100 * time.Millisecond)
+		signals <- syscall.SIGTERM
+		Eventually(stopped, time.Second).Should(BeAnExistingFile())
+
+		// Run returns once the registration under way has finished.
+		unblock()
+		Eventually(codes, 10*time.Second).Should(Receive(Equal(3)))
+	})
+
+	It("reports a child killed by a signal like a shell", func() {
+		cfg.Command = []string{"sh", "-c", "kill -KILL $$"}
+		codes := start()
+		Eventually(codes, 2*time.Second).Should(Receive(Equal(128 + int(syscall.SIGKILL))))
+	})
+
+	Context("with a health check", func() {
+		var healthy atomic.Bool
+		var health *httptest.Server
+
+		BeforeEach(func() {
+			healthy.Store(false)
+			health = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !healthy.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			cfg.HealthURL = health.URL
+			cfg.Command = []string{"sh", "-c", "sleep 1"}
+		})
+		AfterEach(func() {
+			signals <- syscall.SIGTERM
+			health.Close()
+		})
+
+		It("registers only while healthy", func() {
+			start()
+			Consistently(lookup, 100*time.Millisecond).Should(BeEmpty())
+			healthy.Store(true)
+			Eventually(lookup).Should(Equal(address))
+			healthy.Store(false)
+			Eventually(lookup).Should(BeEmpty())
+		})
+	})
+})